@@ -0,0 +1,312 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+)
+
+// Default limits of outgoing messages, see https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
+const (
+	DefaultGlobalSendInterval = time.Second / 30
+	DefaultGroupSendInterval  = time.Second
+	DefaultSendRetries        = 5
+	DefaultUnsureRetries      = 2
+)
+
+const maxRetryBackoff = 30 * time.Second
+
+// Dispatcher is http client for bot which queues outgoing messages to respect Telegram rate limits
+// and retries them on 429 responses and connection errors. Server errors and timeouts are retried fewer times,
+// because message may be delivered already. It's installed as bot.Client, so all plugins use it transparently,
+// requests other than sending messages are passed as is. Request isn't queued if it can't be sent before
+// deadline of its context, see BotWithContext.
+type Dispatcher struct {
+	Client tgbotapi.HttpClient
+	// GlobalInterval is min interval between any two sent messages
+	GlobalInterval time.Duration
+	// GroupInterval is min interval between messages to the same group
+	GroupInterval time.Duration
+	// MaxRetries is number of retries of transient errors
+	MaxRetries int
+	// MaxUnsureRetries is number of retries of 5xx responses and timeouts, when message may be delivered already
+	MaxUnsureRetries int
+	// Backoff is delay before first retry, it's doubled with each attempt
+	Backoff time.Duration
+
+	mtx        sync.Mutex
+	nextGlobal time.Time
+	nextChat   map[string]time.Time
+	depth      int32
+}
+
+// NewDispatcher wraps client with default limits
+func NewDispatcher(client tgbotapi.HttpClient) *Dispatcher {
+	return &Dispatcher{
+		Client:           client,
+		GlobalInterval:   DefaultGlobalSendInterval,
+		GroupInterval:    DefaultGroupSendInterval,
+		MaxRetries:       DefaultSendRetries,
+		MaxUnsureRetries: DefaultUnsureRetries,
+		Backoff:          time.Second,
+	}
+}
+
+// QueueDepth returns number of outgoing messages waiting to be sent or being sent
+func (d *Dispatcher) QueueDepth() int {
+	return int(atomic.LoadInt32(&d.depth))
+}
+
+// isSendMethod checks that api method sends or changes message, so it's subject to rate limits
+func isSendMethod(method string) bool {
+	for _, prefix := range []string{"send", "edit", "forward", "copy"} {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestChatID extracts chat_id parameter from url encoded or multipart request body
+func requestChatID(contentType string, body []byte) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return ""
+		}
+		return values.Get("chat_id")
+	case "multipart/form-data":
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return ""
+			}
+			if part.FormName() == "chat_id" && part.FileName() == "" {
+				value, _ := ioutil.ReadAll(part)
+				return string(value)
+			}
+		}
+	}
+	return ""
+}
+
+// reserve returns time when message to chat may be sent and books this slot.
+// Slot isn't booked if it's after non-zero deadline.
+func (d *Dispatcher) reserve(chatID string, now time.Time, deadline time.Time) (time.Time, bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for id, next := range d.nextChat {
+		if next.Before(now) {
+			delete(d.nextChat, id)
+		}
+	}
+	at := now
+	if d.nextGlobal.After(at) {
+		at = d.nextGlobal
+	}
+	if d.nextChat[chatID].After(at) {
+		at = d.nextChat[chatID]
+	}
+	if !deadline.IsZero() && at.After(deadline) {
+		return at, false
+	}
+	d.nextGlobal = at.Add(d.GlobalInterval)
+	// only groups have negative ids, private chats are limited by global interval
+	if strings.HasPrefix(chatID, "-") || strings.HasPrefix(chatID, "@") {
+		if d.nextChat == nil {
+			d.nextChat = map[string]time.Time{}
+		}
+		d.nextChat[chatID] = at.Add(d.GroupInterval)
+	}
+	return at, true
+}
+
+// delay postpones all messages and messages to chat, used when Telegram asks to retry after some time
+func (d *Dispatcher) delay(chatID string, until time.Time) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.nextGlobal.Before(until) {
+		d.nextGlobal = until
+	}
+	if chatID == "" {
+		return
+	}
+	if d.nextChat == nil {
+		d.nextChat = map[string]time.Time{}
+	}
+	if d.nextChat[chatID].Before(until) {
+		d.nextChat[chatID] = until
+	}
+}
+
+func sleepCtx(req *http.Request, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// backoff returns delay before retry with jitter to not retry all failed requests at once
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	backoff := d.Backoff << uint(attempt)
+	if backoff > maxRetryBackoff || backoff <= 0 {
+		backoff = maxRetryBackoff
+	}
+	return backoff + time.Duration(rand.Int63n(int64(backoff)/4+1))
+}
+
+// retryAfter returns delay requested by Telegram in 429 response
+func retryAfter(body []byte) time.Duration {
+	var apiResp tgbotapi.APIResponse
+	if err := json.Unmarshal(body, &apiResp); err == nil && apiResp.Parameters != nil && apiResp.Parameters.RetryAfter > 0 {
+		return time.Duration(apiResp.Parameters.RetryAfter) * time.Second
+	}
+	return 0
+}
+
+// isNotSent checks that request failed before it was sent, so it's safe to retry it
+func isNotSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isTimeout checks that request is timed out, it may be delivered already
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Do sends request, messages are delayed to respect rate limits and retried on transient errors
+func (d *Dispatcher) Do(req *http.Request) (*http.Response, error) {
+	if !isSendMethod(path.Base(req.URL.Path)) {
+		return d.Client.Do(req)
+	}
+
+	atomic.AddInt32(&d.depth, 1)
+	defer atomic.AddInt32(&d.depth, -1)
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read request")
+		}
+	}
+	chatID := requestChatID(req.Header.Get("Content-Type"), body)
+
+	deadline, _ := req.Context().Deadline()
+	for attempt := 0; ; attempt++ {
+		at, ok := d.reserve(chatID, time.Now(), deadline)
+		if !ok {
+			return nil, errors.Wrapf(context.DeadlineExceeded, "message to chat %s can't be sent until %s", chatID, at.Format(time.RFC3339))
+		}
+		if err := sleepCtx(req, time.Until(at)); err != nil {
+			return nil, err
+		}
+
+		attemptReq := req.Clone(req.Context())
+		attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		attemptReq.ContentLength = int64(len(body))
+
+		resp, err := d.Client.Do(attemptReq)
+		if err != nil {
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+			retries := 0
+			if isNotSent(err) {
+				retries = d.MaxRetries
+			} else if isTimeout(err) {
+				retries = d.MaxUnsureRetries
+			}
+			if attempt >= retries {
+				return nil, err
+			}
+			delay := d.backoff(attempt)
+			log.Printf("[WARN] send to chat %s failed, retry in %v: %v", chatID, delay, err)
+			if err := sleepCtx(req, delay); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		respBody, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read response")
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+		retries := 0
+		if resp.StatusCode == http.StatusTooManyRequests {
+			retries = d.MaxRetries
+		} else if resp.StatusCode >= 500 {
+			retries = d.MaxUnsureRetries
+		}
+		if attempt >= retries {
+			return resp, nil
+		}
+
+		delay := retryAfter(respBody)
+		if delay > 0 {
+			// flood limit applies to bot, not only to chat
+			d.delay(chatID, time.Now().Add(delay))
+		} else {
+			delay = d.backoff(attempt)
+		}
+		log.Printf("[WARN] send to chat %s failed with status %d, retry in %v", chatID, resp.StatusCode, delay)
+		if err := sleepCtx(req, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// contextClient binds requests to context, BotAPI doesn't accept context itself
+type contextClient struct {
+	ctx    context.Context
+	client tgbotapi.HttpClient
+}
+
+func (c *contextClient) Do(req *http.Request) (*http.Response, error) {
+	return c.client.Do(req.WithContext(c.ctx))
+}
+
+// BotWithContext returns copy of bot which requests are canceled with context,
+// e.g. to not keep http handler waiting in send queue longer than its timeout
+func BotWithContext(ctx context.Context, bot *tgbotapi.BotAPI) *tgbotapi.BotAPI {
+	res := *bot
+	res.Client = &contextClient{ctx: ctx, client: bot.Client}
+	return &res
+}
@@ -0,0 +1,193 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clientFunc func(req *http.Request) (*http.Response, error)
+
+func (f clientFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func jsonResponse(status int, body string) *http.Response {
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(body))}
+}
+
+func sendRequest(t *testing.T, d *Dispatcher, method string, chatID string) *http.Response {
+	body := url.Values{"chat_id": {chatID}, "text": {"hi"}}.Encode()
+	req, err := http.NewRequest("POST", "https://api.telegram.org/botTOKEN/"+method, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := d.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestDispatcherRetry(t *testing.T) {
+	var mtx sync.Mutex
+	calls := map[string]int{}
+	d := NewDispatcher(clientFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mtx.Lock()
+		defer mtx.Unlock()
+		calls[req.URL.Path]++
+		switch {
+		case strings.HasSuffix(req.URL.Path, "getUpdates"):
+			return jsonResponse(http.StatusBadGateway, `{"ok":false}`), nil
+		case calls[req.URL.Path] == 1 && strings.HasSuffix(req.URL.Path, "sendMessage"):
+			return jsonResponse(http.StatusTooManyRequests,
+				`{"ok":false,"error_code":429,"parameters":{"retry_after":1}}`), nil
+		case strings.HasSuffix(req.URL.Path, "editMessageText"):
+			return jsonResponse(http.StatusInternalServerError, `{"ok":false}`), nil
+		case calls[req.URL.Path] <= 2 && strings.HasSuffix(req.URL.Path, "forwardMessage"):
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		case calls[req.URL.Path] <= 2 && strings.HasSuffix(req.URL.Path, "sendPhoto"):
+			return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+		case strings.HasSuffix(req.URL.Path, "copyMessage"):
+			return nil, &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+		}
+		assert.Contains(t, string(body), "chat_id=1")
+		return jsonResponse(http.StatusOK, `{"ok":true}`), nil
+	}))
+	d.Backoff = 10 * time.Millisecond
+
+	start := time.Now()
+	resp := sendRequest(t, d, "sendMessage", "1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, time.Since(start) >= time.Second, "retry_after is honored")
+
+	// message may be delivered already, so it's retried fewer times
+	resp = sendRequest(t, d, "editMessageText", "1")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	resp = sendRequest(t, d, "sendPhoto", "1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// request failed before it was sent
+	resp = sendRequest(t, d, "forwardMessage", "1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	req, err := http.NewRequest("POST", "https://api.telegram.org/botTOKEN/copyMessage",
+		strings.NewReader(url.Values{"chat_id": {"1"}}.Encode()))
+	require.NoError(t, err)
+	_, err = d.Do(req)
+	assert.Error(t, err)
+
+	resp = sendRequest(t, d, "getUpdates", "1")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	assert.Equal(t, map[string]int{
+		"/botTOKEN/sendMessage":     2,
+		"/botTOKEN/editMessageText": 3,
+		"/botTOKEN/sendPhoto":       3,
+		"/botTOKEN/forwardMessage":  3,
+		"/botTOKEN/copyMessage":     1,
+		"/botTOKEN/getUpdates":      1,
+	}, calls)
+	assert.Equal(t, 0, d.QueueDepth())
+}
+
+func TestDispatcherRetryAfterGlobal(t *testing.T) {
+	calls := int32(0)
+	d := NewDispatcher(clientFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return jsonResponse(http.StatusTooManyRequests,
+				`{"ok":false,"error_code":429,"parameters":{"retry_after":1}}`), nil
+		}
+		return jsonResponse(http.StatusOK, `{"ok":true}`), nil
+	}))
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sendRequest(t, d, "sendMessage", "-100")
+	}()
+	require.Eventually(t, func() bool {
+		d.mtx.Lock()
+		defer d.mtx.Unlock()
+		return d.nextGlobal.Sub(start) > 500*time.Millisecond
+	}, time.Second, 10*time.Millisecond)
+
+	sendRequest(t, d, "sendMessage", "1")
+	assert.True(t, time.Since(start) >= time.Second, "retry_after delays messages to other chats")
+	wg.Wait()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestDispatcherGroupInterval(t *testing.T) {
+	block := make(chan struct{})
+	d := NewDispatcher(clientFunc(func(req *http.Request) (*http.Response, error) {
+		<-block
+		return jsonResponse(http.StatusOK, `{"ok":true}`), nil
+	}))
+	d.GroupInterval = 200 * time.Millisecond
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendRequest(t, d, "sendMessage", "-100")
+		}()
+	}
+	require.Eventually(t, func() bool { return d.QueueDepth() == 3 }, time.Second, 10*time.Millisecond)
+	close(block)
+	wg.Wait()
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "messages to group are spaced")
+
+	start = time.Now()
+	sendRequest(t, d, "sendMessage", "1")
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "private chat isn't delayed by group")
+	assert.Equal(t, 0, d.QueueDepth())
+}
+
+func TestDispatcherDeadline(t *testing.T) {
+	calls := int32(0)
+	d := NewDispatcher(clientFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return jsonResponse(http.StatusOK, `{"ok":true}`), nil
+	}))
+	d.GroupInterval = time.Minute
+
+	sendRequest(t, d, "sendMessage", "-100")
+	d.mtx.Lock()
+	booked := d.nextChat["-100"]
+	d.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	body := url.Values{"chat_id": {"-100"}, "text": {"hi"}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.telegram.org/botTOKEN/sendMessage", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	start := time.Now()
+	_, err = d.Do(req)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "request isn't queued after deadline")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, 0, d.QueueDepth())
+
+	// rejected request doesn't book slot
+	d.mtx.Lock()
+	assert.Equal(t, booked, d.nextChat["-100"])
+	d.mtx.Unlock()
+}
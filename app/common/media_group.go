@@ -0,0 +1,97 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+)
+
+// MediaUpload is a file for media group
+type MediaUpload struct {
+	// Type is 'photo' or 'document'
+	Type string
+	Name string
+	Data []byte
+}
+
+type inputMedia struct {
+	Type      string `json:"type"`
+	Media     string `json:"media"`
+	Caption   string `json:"caption,omitempty"`
+	ParseMode string `json:"parse_mode,omitempty"`
+}
+
+// SendMediaGroupUpload uploads files as album, caption is attached to the first one.
+// Library supports only already uploaded files for media groups, so request is made manually.
+func SendMediaGroupUpload(bot *tgbotapi.BotAPI, chatID int64, files []MediaUpload, caption string, parseMode string) ([]tgbotapi.Message, error) {
+	if len(files) < 2 || len(files) > 10 {
+		return nil, errors.Errorf("media group should contain from 2 to 10 files")
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	media := make([]inputMedia, 0, len(files))
+	for i, f := range files {
+		attachName := fmt.Sprintf("file%d", i)
+		item := inputMedia{Type: f.Type, Media: "attach://" + attachName}
+		if i == 0 {
+			item.Caption, item.ParseMode = caption, parseMode
+		}
+		media = append(media, item)
+
+		part, err := mw.CreateFormFile(attachName, f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = part.Write(f.Data); err != nil {
+			return nil, err
+		}
+	}
+	mediaJSON, err := json.Marshal(media)
+	if err != nil {
+		return nil, err
+	}
+	if err = mw.WriteField("chat_id", strconv.FormatInt(chatID, 10)); err != nil {
+		return nil, err
+	}
+	if err = mw.WriteField("media", string(mediaJSON)); err != nil {
+		return nil, err
+	}
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf(tgbotapi.APIEndpoint, bot.Token, "sendMediaGroup")
+	req, err := http.NewRequest("POST", endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := bot.Client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot send media group")
+	}
+	defer resp.Body.Close()
+
+	var apiResp tgbotapi.APIResponse
+	if err = json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return nil, errors.Wrapf(err, "cannot decode response")
+	}
+	if !apiResp.Ok {
+		params := tgbotapi.ResponseParameters{}
+		if apiResp.Parameters != nil {
+			params = *apiResp.Parameters
+		}
+		return nil, tgbotapi.Error{Code: apiResp.ErrorCode, Message: apiResp.Description, ResponseParameters: params}
+	}
+
+	var msgs []tgbotapi.Message
+	err = json.Unmarshal(apiResp.Result, &msgs)
+	return msgs, err
+}
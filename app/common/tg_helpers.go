@@ -24,3 +24,18 @@ func ReplyWithText(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, text string, par
 	}
 	return SentTextMessage(bot, msg.Chat.ID, text, parseMode)
 }
+
+// IsChatAdmin checks that user is creator or administrator of chat, any user is admin in private chat
+func IsChatAdmin(bot *tgbotapi.BotAPI, chat *tgbotapi.Chat, userID int) (bool, error) {
+	if chat == nil {
+		return false, errors.Errorf("chat is nil")
+	}
+	if chat.IsPrivate() {
+		return true, nil
+	}
+	member, err := bot.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: chat.ID, UserID: userID})
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot get chat member")
+	}
+	return member.IsCreator() || member.IsAdministrator(), nil
+}
@@ -3,14 +3,18 @@ package main
 import (
 	"bufio"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/vdimir/tg-tobym/app/plugin"
 	"github.com/vdimir/tg-tobym/app/service"
 )
 
@@ -27,7 +31,14 @@ type Opts struct {
 	Store struct {
 		Path string
 	}
-	WebAppURL string
+	WebAppURL      string
+	ScheduleGrace  time.Duration
+	MaxUploadSize  int64
+	NotifierSecret string
+	NotifierLimits plugin.NotifierLimits
+	OwnerIDs       string
+	ACLMode        string
+	ProbePrivate   bool
 }
 
 func overWriteWithEnv(value *string, envName string) {
@@ -46,13 +57,43 @@ func parseArgs() (Opts, error) {
 	flag.StringVar(&opts.Bot.Addr, "listen", ":8443", "addres to listen web requests ")
 	flag.BoolVar(&opts.Bot.UseLongPoll, "longpoll", false, "use long polling instead of web hooks")
 	flag.BoolVar(&opts.Bot.Debug, "debug", false, "print all bot mesaages to log")
+	flag.Int64Var(&opts.MaxUploadSize, "max_upload_size", plugin.DefaultMaxUploadSize, "max size of files uploaded to notifier in bytes")
+	flag.StringVar(&opts.NotifierSecret, "notifier_secret", "", "key to hash notifier tokens, random one is generated and saved by default [$NOTIFIER_SECRET]")
+	flag.IntVar(&opts.NotifierLimits.Token.Burst, "notify_token_burst", 10, "max burst of notifier requests per token")
+	flag.Float64Var(&opts.NotifierLimits.Token.PerMinute, "notify_token_rate", 20, "sustained notifier requests per minute per token, 0 to disable")
+	flag.IntVar(&opts.NotifierLimits.Chat.Burst, "notify_chat_burst", 20, "max burst of notifier requests per chat")
+	flag.Float64Var(&opts.NotifierLimits.Chat.PerMinute, "notify_chat_rate", 30, "sustained notifier requests per minute per chat, 0 to disable")
+	flag.IntVar(&opts.NotifierLimits.DailyQuota, "notify_daily_quota", 1000, "max notifier requests per token per day, 0 to disable")
+	flag.StringVar(&opts.OwnerIDs, "owner_ids", "", "comma separated telegram user ids of bot owners [$OWNER_IDS]")
+	flag.StringVar(&opts.ACLMode, "acl", service.ACLOpen, "access mode: open, allowlist or approve (owners approve new chats) [$ACL_MODE]")
+	flag.BoolVar(&opts.ProbePrivate, "probe_private", false, "allow /probe of loopback, private and link-local addresses")
+	flag.DurationVar(&opts.ScheduleGrace, "schedule_grace", time.Hour, "send recurring message missed during downtime or delayed if it's late less than this")
 
 	flag.Parse()
 
 	overWriteWithEnv(&opts.WebAppURL, "WEB_APP_URL")
+	overWriteWithEnv(&opts.NotifierSecret, "NOTIFIER_SECRET")
+	overWriteWithEnv(&opts.OwnerIDs, "OWNER_IDS")
+	overWriteWithEnv(&opts.ACLMode, "ACL_MODE")
 	return opts, nil
 }
 
+// parseOwnerIDs parses comma separated user ids
+func parseOwnerIDs(s string) ([]int, error) {
+	ids := []int{}
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		id, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "wrong owner id %q", f)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
 func readToken(path string) (string, error) {
 	tokenStr := os.Getenv("BOT_TOKEN")
 	if tokenStr != "" {
@@ -89,6 +130,11 @@ func main() {
 		log.Fatalf("[ERROR] token reading error %v", err)
 	}
 
+	ownerIDs, err := parseOwnerIDs(opts.OwnerIDs)
+	if err != nil {
+		log.Fatalf("[ERROR] Wrong arguments %v", err)
+	}
+
 	cfg := &service.Config{
 		Token:      token,
 		DataPath:   opts.Store.Path,
@@ -98,6 +144,14 @@ func main() {
 		UseWebHook: !opts.Bot.UseLongPoll,
 
 		AppVersion: revision,
+
+		ScheduleMissedRunGrace: opts.ScheduleGrace,
+		NotifierMaxUploadSize:  opts.MaxUploadSize,
+		NotifierSecret:         opts.NotifierSecret,
+		NotifierLimits:         opts.NotifierLimits,
+		OwnerIDs:               ownerIDs,
+		ACLMode:                opts.ACLMode,
+		ProbePrivateAddresses:  opts.ProbePrivate,
 	}
 
 	botService, err := service.NewBotService(cfg)
@@ -110,17 +164,14 @@ func main() {
 		log.Fatalf("[ERROR] cannot initialize bot %v", err)
 	}
 
-	defer func() {
-		err := botService.Close()
-		if err != nil {
-			log.Printf("[ERROR] Cannot close bot %v", err)
-		}
-		log.Printf("[INFO] Service closed")
-
-	}()
-
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+	sig := <-c
+
+	err = botService.CloseWithReason(fmt.Sprintf("received %v", sig))
+	if err != nil {
+		log.Printf("[ERROR] Cannot close bot %v", err)
+	}
+	log.Printf("[INFO] Service closed")
 	log.Printf("[INFO] Bye :)")
 }
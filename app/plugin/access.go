@@ -0,0 +1,304 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/asdine/storm/v3"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/vdimir/tg-tobym/app/common"
+)
+
+// Permission levels of commands
+const (
+	PermEveryone = "everyone"
+	PermAdmins   = "admins"
+	PermOwner    = "owner"
+)
+
+var permLevels = map[string]int{PermEveryone: 0, PermAdmins: 1, PermOwner: 2}
+
+// Named is a PlugIn that can be enabled or disabled in chat with /plugins
+type Named interface {
+	Name() string
+}
+
+// chatAccess is plugins and command permissions set for chat
+type chatAccess struct {
+	ChatID   int64 `storm:"id"`
+	Disabled []string
+	// Permissions overrides default permission level by command
+	Permissions map[string]string
+}
+
+// Access checks that plugin is enabled in chat and user is allowed to run command
+type Access struct {
+	NopPlugin
+	Bot   *tgbotapi.BotAPI
+	Store storm.Node
+	// OwnerIDs are telegram user ids of bot owners, owners pass all checks
+	OwnerIDs []int
+	// Router provides list of plugins and commands to manage
+	Router *Router
+
+	mtx sync.Mutex
+}
+
+func (plg *Access) chatAccess(chatID int64) (*chatAccess, error) {
+	acc := &chatAccess{}
+	err := plg.Store.One("ChatID", chatID, acc)
+	if err == storm.ErrNotFound {
+		return &chatAccess{ChatID: chatID, Permissions: map[string]string{}}, nil
+	}
+	if acc.Permissions == nil {
+		acc.Permissions = map[string]string{}
+	}
+	return acc, err
+}
+
+// updateChatAccess modifies access of chat under lock
+func (plg *Access) updateChatAccess(chatID int64, fn func(acc *chatAccess)) error {
+	plg.mtx.Lock()
+	defer plg.mtx.Unlock()
+	acc, err := plg.chatAccess(chatID)
+	if err != nil {
+		return err
+	}
+	fn(acc)
+	return plg.Store.Save(acc)
+}
+
+// loadChatAccess returns access of chat, defaults are used if it can't be loaded
+func (plg *Access) loadChatAccess(chatID int64) *chatAccess {
+	acc, err := plg.chatAccess(chatID)
+	if err != nil {
+		log.Printf("[WARN] cannot load access of chat %d: %v", chatID, err)
+		return &chatAccess{ChatID: chatID, Permissions: map[string]string{}}
+	}
+	return acc
+}
+
+type chatAccessKey struct{}
+
+// WithChat loads access of chat once, so all handlers of update are checked without reading store again
+func (plg *Access) WithChat(ctx context.Context, chatID int64) context.Context {
+	if plg == nil {
+		return ctx
+	}
+	if acc, ok := ctx.Value(chatAccessKey{}).(*chatAccess); ok && acc.ChatID == chatID {
+		return ctx
+	}
+	return context.WithValue(ctx, chatAccessKey{}, plg.loadChatAccess(chatID))
+}
+
+// chatAccessOf returns access of chat loaded by WithChat or loads it
+func (plg *Access) chatAccessOf(ctx context.Context, chatID int64) *chatAccess {
+	if acc, ok := ctx.Value(chatAccessKey{}).(*chatAccess); ok && acc.ChatID == chatID {
+		return acc
+	}
+	return plg.loadChatAccess(chatID)
+}
+
+func (acc *chatAccess) pluginEnabled(name string) bool {
+	for _, d := range acc.Disabled {
+		if d == name {
+			return false
+		}
+	}
+	return true
+}
+
+func (acc *chatAccess) permission(cmd CommandDescription) string {
+	if perm, ok := acc.Permissions[cmd.Cmd]; ok {
+		return perm
+	}
+	if cmd.Permission != "" {
+		return cmd.Permission
+	}
+	return PermEveryone
+}
+
+// PluginEnabled checks that plugin isn't disabled in chat
+func (plg *Access) PluginEnabled(ctx context.Context, chatID int64, name string) bool {
+	if plg == nil || name == "" {
+		return true
+	}
+	return plg.chatAccessOf(ctx, chatID).pluginEnabled(name)
+}
+
+// Permission returns level required to run command in chat
+func (plg *Access) Permission(chatID int64, cmd CommandDescription) string {
+	return plg.loadChatAccess(chatID).permission(cmd)
+}
+
+// IsOwner checks that user is bot owner
+func (plg *Access) IsOwner(userID int) bool {
+	for _, id := range plg.OwnerIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed checks that author of message has permission level
+func (plg *Access) Allowed(msg *tgbotapi.Message, perm string) (bool, error) {
+	if perm == PermEveryone || perm == "" {
+		return true, nil
+	}
+	if msg.From == nil {
+		return false, nil
+	}
+	if plg.IsOwner(msg.From.ID) {
+		return true, nil
+	}
+	if perm == PermOwner {
+		return false, nil
+	}
+	return common.IsChatAdmin(plg.Bot, msg.Chat, msg.From.ID)
+}
+
+// CheckCommand checks permission of command and replies if it isn't allowed
+func (plg *Access) CheckCommand(ctx context.Context, msg *tgbotapi.Message, cmd CommandDescription) (bool, error) {
+	if plg == nil {
+		return true, nil
+	}
+	perm := plg.chatAccessOf(ctx, msg.Chat.ID).permission(cmd)
+	allowed, err := plg.Allowed(msg, perm)
+	if err != nil || allowed {
+		return allowed, err
+	}
+	who := "chat admins"
+	if perm == PermOwner {
+		who = "bot owner"
+	}
+	return false, common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Only %s can use /%s", who, cmd.Cmd), "")
+}
+
+// RegisterHandlers declares /plugins command
+func (plg *Access) RegisterHandlers(r *Router) {
+	r.Command(CommandDescription{
+		Cmd:  "plugins",
+		Help: "Enable or disable plugins and restrict commands in chat",
+		Details: "Usage: /plugins to list, '/plugins on|off <name>', " +
+			"'/plugins perm <command> everyone|admins|owner' to set who can run command.",
+		Permission: PermAdmins,
+	}, plg.handlePlugins)
+}
+
+func (plg *Access) formatChatAccess(chatID int64) (string, error) {
+	acc, err := plg.chatAccess(chatID)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{"<b>Plugins</b>"}
+	for _, name := range plg.Router.Plugins() {
+		status := "on"
+		if !acc.pluginEnabled(name) {
+			status = "<b>off</b>"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", html.EscapeString(name), status))
+	}
+
+	perms := []string{}
+	for _, cmd := range plg.Router.Commands() {
+		perm := acc.permission(cmd)
+		if perm == PermEveryone {
+			continue
+		}
+		mark := ""
+		if _, ok := acc.Permissions[cmd.Cmd]; ok {
+			mark = " (changed)"
+		}
+		perms = append(perms, fmt.Sprintf("/%s: %s%s", cmd.Cmd, perm, mark))
+	}
+	if len(perms) > 0 {
+		lines = append(lines, "", "<b>Restricted commands</b>")
+		lines = append(lines, perms...)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (plg *Access) handlePlugins(_ context.Context, msg *tgbotapi.Message, args string) error {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		text, err := plg.formatChatAccess(msg.Chat.ID)
+		if err != nil {
+			return err
+		}
+		return common.ReplyWithText(plg.Bot, msg, text, tgbotapi.ModeHTML)
+	}
+
+	switch {
+	case (fields[0] == "on" || fields[0] == "off") && len(fields) == 2:
+		name := fields[1]
+		idx := sort.SearchStrings(plg.Router.Plugins(), name)
+		if idx >= len(plg.Router.Plugins()) || plg.Router.Plugins()[idx] != name {
+			return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Unknown plugin '%s'", name), "")
+		}
+		enable := fields[0] == "on"
+		err := plg.updateChatAccess(msg.Chat.ID, func(acc *chatAccess) {
+			disabled := []string{}
+			for _, d := range acc.Disabled {
+				if d != name {
+					disabled = append(disabled, d)
+				}
+			}
+			if !enable {
+				disabled = append(disabled, name)
+			}
+			acc.Disabled = disabled
+		})
+		if err != nil {
+			return errors.Wrapf(err, "cannot save plugins of chat")
+		}
+		return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Ok, %s is %s", name, fields[0]), "")
+	case fields[0] == "perm" && len(fields) == 3:
+		return plg.setPermission(msg, strings.TrimPrefix(fields[1], "/"), fields[2])
+	}
+	return common.ReplyWithText(plg.Bot, msg, "Usage: /plugins [on|off <name>] [perm <command> everyone|admins|owner]", "")
+}
+
+func (plg *Access) setPermission(msg *tgbotapi.Message, cmdName string, perm string) error {
+	if _, ok := permLevels[perm]; !ok {
+		return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Unknown level '%s', use everyone, admins or owner", perm), "")
+	}
+	var cmd *CommandDescription
+	for _, c := range plg.Router.Commands() {
+		if c.Cmd == cmdName {
+			c := c
+			cmd = &c
+		}
+	}
+	if cmd == nil {
+		return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Unknown command '%s'", cmdName), "")
+	}
+
+	// only owner can grant or revoke owner level
+	if perm == PermOwner || plg.Permission(msg.Chat.ID, *cmd) == PermOwner {
+		if allowed, err := plg.Allowed(msg, PermOwner); err != nil || !allowed {
+			if err != nil {
+				return err
+			}
+			return common.ReplyWithText(plg.Bot, msg, "Only bot owner can change owner level", "")
+		}
+	}
+
+	err := plg.updateChatAccess(msg.Chat.ID, func(acc *chatAccess) {
+		if perm == cmd.Permission || (perm == PermEveryone && cmd.Permission == "") {
+			delete(acc.Permissions, cmd.Cmd)
+			return
+		}
+		acc.Permissions[cmd.Cmd] = perm
+	})
+	if err != nil {
+		return errors.Wrapf(err, "cannot save permissions of chat")
+	}
+	return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Ok, /%s is allowed to %s", cmd.Cmd, perm), "")
+}
@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronNext(t *testing.T) {
+	// Wednesday
+	now := time.Date(2020, 1, 1, 12, 30, 0, 0, time.UTC)
+	tbl := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2020, 1, 1, 12, 31, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2020, 1, 2, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * sat,sun", time.Date(2020, 1, 4, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2020, 1, 5, 9, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 1, 1, 12, 45, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tbl {
+		spec, err := parseCron(tt.expr)
+		require.NoError(t, err, tt.expr)
+		assert.Equal(t, tt.next, spec.Next(now), tt.expr)
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * * * foo", "5-1 * * * *", "*/0 * * * *"} {
+		_, err := parseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestParseScheduleArgs(t *testing.T) {
+	expr, text, err := parseScheduleArgs(`"0 9 * * 1-5" Standup time!`)
+	require.NoError(t, err)
+	assert.Equal(t, "0 9 * * 1-5", expr)
+	assert.Equal(t, "Standup time!", text)
+
+	expr, text, err = parseScheduleArgs(`0  9 * * 1-5   Standup  time!`)
+	require.NoError(t, err)
+	assert.Equal(t, "0 9 * * 1-5", expr)
+	assert.Equal(t, "Standup  time!", text)
+
+	_, _, err = parseScheduleArgs(`"0 9 * * 1-5"`)
+	assert.Error(t, err)
+}
@@ -9,16 +9,16 @@ import (
 	"github.com/vdimir/tg-tobym/app/common"
 )
 
-// Help sends usage info
+// Help sends usage info for commands registered in Router
 type Help struct {
 	NopPlugin
-	Bot  *tgbotapi.BotAPI
-	Cmds []CommandDescription
+	Bot    *tgbotapi.BotAPI
+	Router *Router
 }
 
 func (plg *Help) formatHelpText(short bool, botName string) string {
 	lines := []string{}
-	for _, cmd := range plg.Cmds {
+	for _, cmd := range plg.Router.Commands() {
 		lines = append(lines, fmt.Sprintf("/%s%s - %s", cmd.Cmd, botName, cmd.Help))
 		if !short && cmd.Details != "" {
 			lines = append(lines, cmd.Details)
@@ -27,33 +27,23 @@ func (plg *Help) formatHelpText(short bool, botName string) string {
 	return strings.Join(lines, "\n")
 }
 
-func (plg *Help) Commands() []CommandDescription {
-	return []CommandDescription{{
+// RegisterHandlers declares help commands
+func (plg *Help) RegisterHandlers(r *Router) {
+	r.Command(CommandDescription{
 		Cmd:     "help",
 		Help:    "Show usage",
 		Details: "",
-	}}
+	}, plg.handleHelp(false))
+	r.Command(CommandDescription{Cmd: "help_short"}, plg.handleHelp(true))
 }
 
-func (plg *Help) HandleUpdate(ctx context.Context, upd *tgbotapi.Update) (bool, error) {
-	if upd.Message == nil {
-		return false, nil
-	}
-
-	msgToMe := plg.Bot.IsMessageToMe(*upd.Message) || upd.Message.Chat.IsPrivate()
-	if cmd := upd.Message.Command(); msgToMe && cmd == "help" || cmd == "help_short" {
+func (plg *Help) handleHelp(short bool) CommandHandler {
+	return func(_ context.Context, msg *tgbotapi.Message, args string) error {
 		botName := ""
-		if !upd.Message.Chat.IsPrivate() {
-			botMe, err := plg.Bot.GetMe()
-			if err != nil {
-				return true, err
-			}
-			botName = "@" + botMe.UserName
+		if !msg.Chat.IsPrivate() {
+			botName = "@" + plg.Bot.Self.UserName
 		}
-		args := upd.Message.CommandArguments()
-		text := plg.formatHelpText(args == "short" || cmd == "help_short", botName)
-		err := common.ReplyWithText(plg.Bot, upd.Message, text, "")
-		return true, err
+		text := plg.formatHelpText(short || args == "short", botName)
+		return common.ReplyWithText(plg.Bot, msg, text, "")
 	}
-	return false, nil
 }
@@ -2,19 +2,50 @@ package plugin
 
 import (
 	"context"
+	"fmt"
+	"html"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/asdine/storm/v3"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
 	"github.com/vdimir/tg-tobym/app/common"
 )
 
-// Monitor notifies subscribers on service update
+// Monitor notifies subscribers on service update and watches heartbeats of external jobs
 type Monitor struct {
 	NopPlugin
-	Bot           *tgbotapi.BotAPI
-	Store         storm.Node
+	Bot *tgbotapi.BotAPI
+	// Store keeps subscribers of service events
+	Store storm.Node
+	// HeartbeatStore keeps heartbeat watches
+	HeartbeatStore storm.Node
+	// ProbeStore keeps uptime probes
+	ProbeStore storm.Node
+	// StateStore keeps service state to report downtime on startup
+	StateStore storm.Node
+	AppURL     string
+	// Version is shown in startup message
+	Version string
+	// CheckInterval is how often heartbeats and probes are checked
+	CheckInterval time.Duration
+	// MinProbeInterval limits how often probe may be run
+	MinProbeInterval time.Duration
+	// MaxChatProbes limits number of probes in chat
+	MaxChatProbes int
+	// AllowPrivateProbes allows probes of loopback, private and link-local addresses, e.g. if bot runs in trusted network
+	AllowPrivateProbes bool
+	// Access mutes heartbeat and probe alerts in chats where plugin is disabled, everything is sent if it's nil
+	Access *Access
+	// AllowedChat mutes heartbeat and probe alerts in denied chats, everything is sent if it's nil
+	AllowedChat func(chatID int64) bool
+
+	mtx           sync.Mutex
 	closeNotifier chan (struct{})
+	probeCancel   context.CancelFunc
+	loops         sync.WaitGroup
 }
 
 type subscriberData struct {
@@ -22,12 +53,49 @@ type subscriberData struct {
 	Subscribed bool
 }
 
-func (plg *Monitor) Commands() []CommandDescription {
-	return []CommandDescription{{
+func (plg *Monitor) Name() string {
+	return "monitor"
+}
+
+// RegisterHandlers declares monitor commands
+func (plg *Monitor) RegisterHandlers(r *Router) {
+	r.Command(CommandDescription{
 		Cmd:     "subscibe_to_service",
 		Help:    "Subscribe to service events (e.g. startup)",
 		Details: "To unsubscibe add 'off' argument",
-	}}
+	}, plg.handleSubscribe)
+	r.Command(CommandDescription{
+		Cmd:     "watch",
+		Help:    "Alert if job doesn't ping url in time",
+		Details: "Usage: /watch <name> <interval> [grace], e.g. /watch backup 1d 30m",
+	}, plg.handleWatch)
+	r.Command(CommandDescription{
+		Cmd:  "watches",
+		Help: "List heartbeats",
+	}, plg.handleWatches)
+	r.Command(CommandDescription{
+		Cmd:  "unwatch",
+		Help: "Remove heartbeat by name",
+	}, plg.handleUnwatch)
+	r.Command(CommandDescription{
+		Cmd:  "probe",
+		Help: "Check HTTP url or TCP port periodically",
+		Details: "Usage: /probe add <url|host:port> [every 1m] [status=200] [contains=text], " +
+			"/probe list, /probe remove <id>. Only public addresses may be probed.",
+		Permission: PermAdmins,
+	}, plg.handleProbe)
+}
+
+func (plg *Monitor) handleSubscribe(_ context.Context, msg *tgbotapi.Message, args string) error {
+	enable := args != "off"
+	if err := plg.subsctibeUser(msg.Chat.ID, enable); err != nil {
+		return err
+	}
+	text := "Subscibed :ok_hand:"
+	if !enable {
+		text = "Unsubscibed :ok_hand:"
+	}
+	return common.ReplyWithText(plg.Bot, msg, text, tgbotapi.ModeMarkdown)
 }
 
 func (plg *Monitor) subsctibeUser(chatID int64, enable bool) error {
@@ -38,63 +106,149 @@ func (plg *Monitor) subsctibeUser(chatID int64, enable bool) error {
 	return err
 }
 
-func (plg *Monitor) notifySubscibersOnStartup() {
+// serviceState is persisted to know how long service was down
+type serviceState struct {
+	ID       int `storm:"id"`
+	LastSeen int64
+	// CleanShutdown is set if service was stopped gracefully
+	CleanShutdown bool
+}
+
+const serviceStateID = 1
+
+func (plg *Monitor) loadState() (*serviceState, error) {
+	state := &serviceState{}
+	err := plg.StateStore.One("ID", serviceStateID, state)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return state, err
+}
+
+func (plg *Monitor) saveState(clean bool) error {
+	return plg.StateStore.Save(&serviceState{ID: serviceStateID, LastSeen: time.Now().Unix(), CleanShutdown: clean})
+}
+
+// startupMessage tells version and how long service was down
+func (plg *Monitor) startupMessage(prev *serviceState, now time.Time) string {
+	text := fmt.Sprintf("Hello! I'm awake! Version <code>%s</code>.", html.EscapeString(plg.Version))
+	if prev != nil && prev.LastSeen != 0 {
+		downtime := now.Sub(time.Unix(prev.LastSeen, 0)).Round(time.Second)
+		how := "crash"
+		if prev.CleanShutdown {
+			how = "shutdown"
+		}
+		text += fmt.Sprintf(" I was down for %s after %s.", downtime, how)
+	}
+	return text + " You may send /version to me."
+}
+
+// sendEnabled checks that heartbeat and probe alerts may be sent to chat
+func (plg *Monitor) sendEnabled(chatID int64) bool {
+	if plg.AllowedChat != nil && !plg.AllowedChat(chatID) {
+		return false
+	}
+	return plg.Access.PluginEnabled(context.Background(), chatID, plg.Name())
+}
+
+// Subscribers returns chats subscribed to service events
+func (plg *Monitor) Subscribers() ([]int64, error) {
 	subscribers := []subscriberData{}
-	err := plg.Store.All(&subscribers)
+	if err := plg.Store.All(&subscribers); err != nil {
+		return nil, err
+	}
+	chats := []int64{}
+	for _, s := range subscribers {
+		if s.Subscribed && s.ChatID != 0 {
+			chats = append(chats, s.ChatID)
+		}
+	}
+	return chats, nil
+}
+
+// Broadcast sends HTML message to all subscribers and returns number of sent messages
+func (plg *Monitor) Broadcast(text string) int {
+	return plg.notifySubscribers(text)
+}
+
+func (plg *Monitor) notifySubscribers(text string) int {
+	chats, err := plg.Subscribers()
 	if err != nil {
 		log.Printf("[ERROR] cannot get subscribers: %v", err)
-		return
+		return 0
 	}
 
-	for _, s := range subscribers {
-		select {
-		case <-plg.closeNotifier:
-			break
-		default:
+	sent := 0
+	for _, chatID := range chats {
+		err := common.SentTextMessage(plg.Bot, chatID, text, tgbotapi.ModeHTML)
+		if err != nil {
+			log.Printf("[ERROR] cannot send message to subscriber: %v", err)
+			continue
 		}
+		sent++
+	}
+	return sent
+}
 
-		if s.Subscribed && s.ChatID != 0 {
-			err := common.SentTextMessage(plg.Bot, s.ChatID, "Hello! I'm awake! You may send /version to me.", "")
-			if err != nil {
-				log.Printf("[ERROR] cannot send message to subscriber: %v", err)
-			}
-		}
+// NotifyShutdown tells subscribers that service is stopping, it should be called before Close
+func (plg *Monitor) NotifyShutdown(reason string) {
+	text := "Going down for a while, bye!"
+	if reason != "" {
+		text = fmt.Sprintf("Going down for a while: %s", html.EscapeString(reason))
 	}
+	plg.notifySubscribers(text)
+}
+
+// NotifyFailures alerts subscribers that update handlers panic too often
+func (plg *Monitor) NotifyFailures(count uint32, lastErr string) {
+	plg.notifySubscribers(fmt.Sprintf("🔥 Something is going wrong: %d failures during update handling, last one: <code>%s</code>",
+		count, html.EscapeString(lastErr)))
 }
 
 func (plg *Monitor) Init() error {
+	if plg.AppURL == "" {
+		plg.AppURL = "http://127.0.0.1"
+	}
+	if plg.CheckInterval <= 0 {
+		plg.CheckInterval = defaultHeartbeatCheckInterval
+	}
+	if plg.MinProbeInterval <= 0 {
+		plg.MinProbeInterval = defaultMinProbeInterval
+	}
+	if plg.MaxChatProbes <= 0 {
+		plg.MaxChatProbes = defaultMaxChatProbes
+	}
 	plg.closeNotifier = make(chan struct{})
-	go plg.notifySubscibersOnStartup()
+	var probeCtx context.Context
+	probeCtx, plg.probeCancel = context.WithCancel(context.Background())
+	prevState, err := plg.loadState()
+	if err != nil {
+		log.Printf("[WARN] cannot load service state: %v", err)
+	}
+	if err := plg.saveState(false); err != nil {
+		log.Printf("[WARN] cannot save service state: %v", err)
+	}
+	go plg.notifySubscribers(plg.startupMessage(prevState, time.Now()))
+	plg.loops.Add(2)
+	go plg.runHeartbeatLoop()
+	go plg.runProbeLoop(probeCtx)
 	return nil
 }
 
 func (plg *Monitor) Close() error {
 	close(plg.closeNotifier)
-	return nil
-}
+	plg.probeCancel()
 
-func (plg *Monitor) HandleUpdate(ctx context.Context, upd *tgbotapi.Update) (bool, error) {
-	if upd.Message == nil {
-		return false, nil
-	}
-
-	msgToMe := plg.Bot.IsMessageToMe(*upd.Message) || upd.Message.Chat.IsPrivate()
-	if cmd := upd.Message.Command(); msgToMe && cmd == "subscibe_to_service" {
-		args := upd.Message.CommandArguments()
-		enable := args != "off"
-
-		err := plg.subsctibeUser(upd.Message.Chat.ID, enable)
-
-		text := "Subscibed :ok_hand:"
-		if err != nil {
-			text = "Can't subscribe, internal error :("
-			return true, err
-		}
-		if !enable {
-			text = "Unsubscibed :ok_hand:"
-		}
-		err = common.ReplyWithText(plg.Bot, upd.Message, text, tgbotapi.ModeMarkdown)
-		return true, err
+	loopsDone := make(chan struct{})
+	go func() {
+		plg.loops.Wait()
+		close(loopsDone)
+	}()
+	select {
+	case <-loopsDone:
+	case <-time.After(5 * time.Second):
+		return errors.Errorf("monitor loops aren't finished")
 	}
-	return false, nil
+	// state is saved after loops are stopped, so heartbeat loop doesn't overwrite it
+	return errors.Wrapf(plg.saveState(true), "cannot save service state")
 }
@@ -0,0 +1,261 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/vdimir/tg-tobym/app/common"
+)
+
+const (
+	defaultHeartbeatCheckInterval = 30 * time.Second
+	defaultHeartbeatGrace         = time.Minute
+)
+
+// heartbeat is dead man's switch, chat is alerted if there is no ping during interval and grace period
+type heartbeat struct {
+	// ID is secret part of ping url
+	ID     string `storm:"id"`
+	ChatID int64
+	Name   string
+	// Interval and Grace are durations in seconds
+	Interval int64
+	Grace    int64
+	// LastPing is unix timestamp of last ping or creation
+	LastPing int64
+	Down     bool
+}
+
+func (hb *heartbeat) deadline() time.Time {
+	return time.Unix(hb.LastPing+hb.Interval+hb.Grace, 0)
+}
+
+// parseWatchArgs parses `<name> <interval> [grace]`
+func parseWatchArgs(args string) (name string, interval time.Duration, grace time.Duration, err error) {
+	fields := strings.Fields(args)
+	if len(fields) < 2 || len(fields) > 3 {
+		return "", 0, 0, errors.Errorf("usage: /watch <name> <interval> [grace]")
+	}
+	name = fields[0]
+	if interval, err = parseDuration(fields[1]); err != nil {
+		return "", 0, 0, err
+	}
+	grace = defaultHeartbeatGrace
+	if len(fields) == 3 {
+		if fields[2] == "0" {
+			grace = 0
+		} else if grace, err = time.ParseDuration(fields[2]); err != nil || grace < 0 {
+			return "", 0, 0, errors.Errorf("wrong grace period '%s'", fields[2])
+		}
+	}
+	return name, interval, grace, nil
+}
+
+func (plg *Monitor) pingURL(hb *heartbeat) string {
+	return fmt.Sprintf("%s/monitor/ping/%s", plg.AppURL, hb.ID)
+}
+
+func (plg *Monitor) Routes() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/ping/{id}", plg.handlePing)
+	r.Post("/ping/{id}", plg.handlePing)
+	r.Head("/ping/{id}", plg.handlePing)
+	return r
+}
+
+func (plg *Monitor) handlePing(w http.ResponseWriter, r *http.Request) {
+	recovered, err := plg.ping(chi.URLParam(r, "id"), time.Now())
+	if err == storm.ErrNotFound {
+		render.Status(r, http.StatusNotFound)
+		render.PlainText(w, r, http.StatusText(http.StatusNotFound))
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] cannot save heartbeat ping: %v", err)
+		render.Status(r, http.StatusInternalServerError)
+		render.PlainText(w, r, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if recovered != nil && plg.sendEnabled(recovered.ChatID) {
+		text := fmt.Sprintf("✅ <b>%s</b> is up again", html.EscapeString(recovered.Name))
+		if err := common.SentTextMessage(plg.Bot, recovered.ChatID, text, tgbotapi.ModeHTML); err != nil {
+			log.Printf("[ERROR] cannot send heartbeat recovery: %v", err)
+		}
+	}
+	render.PlainText(w, r, "OK")
+}
+
+// ping saves time of heartbeat, it returns heartbeat if it was down
+func (plg *Monitor) ping(id string, now time.Time) (*heartbeat, error) {
+	plg.mtx.Lock()
+	defer plg.mtx.Unlock()
+
+	hb := &heartbeat{}
+	if err := plg.HeartbeatStore.One("ID", id, hb); err != nil {
+		return nil, err
+	}
+	wasDown := hb.Down
+	hb.LastPing, hb.Down = now.Unix(), false
+	if err := plg.HeartbeatStore.Save(hb); err != nil {
+		return nil, err
+	}
+	if wasDown {
+		return hb, nil
+	}
+	return nil, nil
+}
+
+// overdueHeartbeats marks heartbeats without pings in time as down and returns them
+func (plg *Monitor) overdueHeartbeats(now time.Time) ([]heartbeat, error) {
+	plg.mtx.Lock()
+	defer plg.mtx.Unlock()
+
+	var beats []heartbeat
+	err := plg.HeartbeatStore.Select(q.Eq("Down", false)).Find(&beats)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	overdue := []heartbeat{}
+	for _, hb := range beats {
+		if hb.deadline().After(now) {
+			continue
+		}
+		hb.Down = true
+		if err := plg.HeartbeatStore.Save(&hb); err != nil {
+			return overdue, err
+		}
+		overdue = append(overdue, hb)
+	}
+	return overdue, nil
+}
+
+func (plg *Monitor) checkHeartbeats(now time.Time) {
+	overdue, err := plg.overdueHeartbeats(now)
+	if err != nil {
+		log.Printf("[ERROR] cannot check heartbeats: %v", err)
+	}
+	for _, hb := range overdue {
+		if !plg.sendEnabled(hb.ChatID) {
+			continue
+		}
+		text := fmt.Sprintf("🔥 <b>%s</b> is down: no ping since %s",
+			html.EscapeString(hb.Name), time.Unix(hb.LastPing, 0).UTC().Format("2006-01-02 15:04:05 MST"))
+		if err := common.SentTextMessage(plg.Bot, hb.ChatID, text, tgbotapi.ModeHTML); err != nil {
+			log.Printf("[ERROR] cannot send heartbeat alert: %v", err)
+		}
+	}
+}
+
+func (plg *Monitor) runHeartbeatLoop() {
+	defer plg.loops.Done()
+	ticker := time.NewTicker(plg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-plg.closeNotifier:
+			return
+		case <-ticker.C:
+			plg.checkHeartbeats(time.Now())
+			if err := plg.saveState(false); err != nil {
+				log.Printf("[WARN] cannot save service state: %v", err)
+			}
+		}
+	}
+}
+
+func (plg *Monitor) chatHeartbeats(chatID int64) ([]heartbeat, error) {
+	var beats []heartbeat
+	err := plg.HeartbeatStore.Select(q.Eq("ChatID", chatID)).Find(&beats)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return beats, err
+}
+
+func (plg *Monitor) handleWatch(_ context.Context, msg *tgbotapi.Message, args string) error {
+	name, interval, grace, err := parseWatchArgs(args)
+	if err != nil {
+		return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Can't watch: %s", err), "")
+	}
+	beats, err := plg.chatHeartbeats(msg.Chat.ID)
+	if err != nil {
+		return err
+	}
+	for _, hb := range beats {
+		if hb.Name == name {
+			return common.ReplyWithText(plg.Bot, msg, "Heartbeat with this name already exists", "")
+		}
+	}
+
+	hb := &heartbeat{
+		ID:       uuid.NewV4().String(),
+		ChatID:   msg.Chat.ID,
+		Name:     name,
+		Interval: int64(interval.Seconds()),
+		Grace:    int64(grace.Seconds()),
+		LastPing: time.Now().Unix(),
+	}
+	if err := plg.HeartbeatStore.Save(hb); err != nil {
+		_ = common.ReplyWithText(plg.Bot, msg, "Can't watch, internal error :(", "")
+		return err
+	}
+	text := fmt.Sprintf("Ok, ping <code>%s</code> at least every %s, grace period %s",
+		html.EscapeString(plg.pingURL(hb)), interval, grace)
+	return common.ReplyWithText(plg.Bot, msg, text, tgbotapi.ModeHTML)
+}
+
+func (plg *Monitor) handleWatches(_ context.Context, msg *tgbotapi.Message, _ string) error {
+	beats, err := plg.chatHeartbeats(msg.Chat.ID)
+	if err != nil {
+		return err
+	}
+	if len(beats) == 0 {
+		return common.ReplyWithText(plg.Bot, msg, "No heartbeats, add one with /watch", "")
+	}
+	lines := []string{}
+	for _, hb := range beats {
+		status := "up"
+		if hb.Down {
+			status = "<b>down</b>"
+		}
+		lines = append(lines, fmt.Sprintf("<b>%s</b> %s, every %s, last ping %s",
+			html.EscapeString(hb.Name), status, time.Duration(hb.Interval)*time.Second,
+			time.Unix(hb.LastPing, 0).UTC().Format("2006-01-02 15:04 MST")))
+	}
+	return common.ReplyWithText(plg.Bot, msg, strings.Join(lines, "\n"), tgbotapi.ModeHTML)
+}
+
+func (plg *Monitor) handleUnwatch(_ context.Context, msg *tgbotapi.Message, args string) error {
+	name := strings.TrimSpace(args)
+	beats, err := plg.chatHeartbeats(msg.Chat.ID)
+	if err != nil {
+		return err
+	}
+	for i := range beats {
+		if beats[i].Name == name {
+			plg.mtx.Lock()
+			err := plg.HeartbeatStore.DeleteStruct(&beats[i])
+			plg.mtx.Unlock()
+			if err != nil {
+				return err
+			}
+			return common.ReplyWithText(plg.Bot, msg, "Ok, heartbeat removed", "")
+		}
+	}
+	return common.ReplyWithText(plg.Bot, msg, "Not found", "")
+}
@@ -0,0 +1,363 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/vdimir/tg-tobym/app/common"
+)
+
+const (
+	defaultProbeInterval    = time.Minute
+	defaultMinProbeInterval = 10 * time.Second
+	probeTimeout            = 10 * time.Second
+	maxProbeBodySize        = 1 << 20
+	defaultMaxChatProbes    = 10
+)
+
+// errProbeAddress is returned if probe target resolves to internal address
+var errProbeAddress = errors.New("internal address can't be probed")
+
+// sharedAddressSpace is range of carrier-grade NAT, it isn't covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP checks that address isn't loopback, private or link-local, e.g. cloud metadata 169.254.169.254
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// probeDialer checks address of each connection after name is resolved,
+// so redirects and DNS records pointing to internal network are rejected too
+func (plg *Monitor) probeDialer() *net.Dialer {
+	dialer := &net.Dialer{}
+	if plg.AllowPrivateProbes {
+		return dialer
+	}
+	dialer.Control = func(_ string, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+			return errProbeAddress
+		}
+		return nil
+	}
+	return dialer
+}
+
+// probe is periodic check of HTTP url or TCP address
+type probe struct {
+	ID     int   `storm:"id,increment"`
+	ChatID int64 `storm:"index"`
+	Target string
+	// Kind is 'http' or 'tcp'
+	Kind string
+	// Every is interval between checks in seconds
+	Every int64
+	// ExpectStatus is required HTTP status, any 2xx or 3xx status is accepted if it isn't set
+	ExpectStatus int
+	// Contains is substring required in HTTP response body
+	Contains string
+
+	NextCheck   int64
+	Down        bool
+	Checked     bool
+	LatencyMs   int64
+	LastError   string
+	LastChanged int64
+}
+
+// probeResult is outcome of single check
+type probeResult struct {
+	latency time.Duration
+	err     error
+}
+
+// parseProbeArgs parses `<url|host:port> [every 1m] [status=200] [contains=text]`
+func parseProbeArgs(args string, minInterval time.Duration) (*probe, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return nil, errors.Errorf("target isn't set")
+	}
+	p := &probe{Target: fields[0], Every: int64(defaultProbeInterval.Seconds())}
+
+	switch {
+	case strings.HasPrefix(p.Target, "http://") || strings.HasPrefix(p.Target, "https://"):
+		p.Kind = "http"
+	default:
+		if _, _, err := net.SplitHostPort(p.Target); err != nil {
+			return nil, errors.Errorf("target should be http(s) url or host:port")
+		}
+		p.Kind = "tcp"
+	}
+
+	for i := 1; i < len(fields); i++ {
+		switch f := fields[i]; {
+		case f == "every" && i+1 < len(fields):
+			i++
+			every, err := parseDuration(fields[i])
+			if err != nil {
+				return nil, err
+			}
+			if every < minInterval {
+				return nil, errors.Errorf("interval should be at least %s", minInterval)
+			}
+			p.Every = int64(every.Seconds())
+		case strings.HasPrefix(f, "status=") && p.Kind == "http":
+			status, err := strconv.Atoi(strings.TrimPrefix(f, "status="))
+			if err != nil || status < 100 || status > 599 {
+				return nil, errors.Errorf("wrong status '%s'", f)
+			}
+			p.ExpectStatus = status
+		case strings.HasPrefix(f, "contains=") && p.Kind == "http":
+			p.Contains = strings.TrimPrefix(strings.Join(fields[i:], " "), "contains=")
+			i = len(fields)
+		default:
+			return nil, errors.Errorf("unexpected argument '%s'", f)
+		}
+	}
+	return p, nil
+}
+
+func checkHTTP(ctx context.Context, p *probe, dialer *net.Dialer) error {
+	req, err := http.NewRequest("GET", p.Target, nil)
+	if err != nil {
+		return err
+	}
+	// proxy isn't used, it would connect to target bypassing dialer check
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true}}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if p.ExpectStatus != 0 && resp.StatusCode != p.ExpectStatus {
+		return errors.Errorf("status %d, expected %d", resp.StatusCode, p.ExpectStatus)
+	}
+	if p.ExpectStatus == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 400) {
+		return errors.Errorf("status %d", resp.StatusCode)
+	}
+	if p.Contains != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxProbeBodySize))
+		if err != nil {
+			return errors.Wrapf(err, "can't read body")
+		}
+		if !strings.Contains(string(body), p.Contains) {
+			return errors.Errorf("body doesn't contain %q", p.Contains)
+		}
+	}
+	return nil
+}
+
+func checkTCP(ctx context.Context, p *probe, dialer *net.Dialer) error {
+	conn, err := dialer.DialContext(ctx, "tcp", p.Target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// runProbe checks target once, connections are made with dialer
+func runProbe(ctx context.Context, p *probe, dialer *net.Dialer) probeResult {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+	if p.Kind == "http" {
+		err = checkHTTP(ctx, p, dialer)
+	} else {
+		err = checkTCP(ctx, p, dialer)
+	}
+	return probeResult{latency: time.Since(start), err: err}
+}
+
+// applyResult updates probe state, it returns message if state is changed
+func (p *probe) applyResult(res probeResult, now time.Time) string {
+	p.NextCheck = now.Add(time.Duration(p.Every) * time.Second).Unix()
+	p.LatencyMs = res.latency.Milliseconds()
+	p.LastError = ""
+	if res.err != nil {
+		p.LastError = res.err.Error()
+	}
+
+	// probe is considered up before first check, so only failure is reported after adding
+	down := res.err != nil
+	p.Checked = true
+	if p.Down == down {
+		return ""
+	}
+	p.Down, p.LastChanged = down, now.Unix()
+	if down {
+		return fmt.Sprintf("🔥 <b>%s</b> is down: %s", html.EscapeString(p.Target), html.EscapeString(p.LastError))
+	}
+	return fmt.Sprintf("✅ <b>%s</b> is up, latency %dms", html.EscapeString(p.Target), p.LatencyMs)
+}
+
+func (plg *Monitor) runProbeLoop(ctx context.Context) {
+	defer plg.loops.Done()
+	ticker := time.NewTicker(plg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-plg.closeNotifier:
+			return
+		case <-ticker.C:
+			plg.checkProbes(ctx, time.Now())
+		}
+	}
+}
+
+func (plg *Monitor) checkProbes(ctx context.Context, now time.Time) {
+	var probes []probe
+	err := plg.ProbeStore.Select(q.Lte("NextCheck", now.Unix())).Find(&probes)
+	if err != nil && err != storm.ErrNotFound {
+		log.Printf("[ERROR] cannot get probes: %v", err)
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	for i := range probes {
+		wg.Add(1)
+		go func(p *probe) {
+			defer wg.Done()
+			res := runProbe(ctx, p, plg.probeDialer())
+			if ctx.Err() != nil {
+				return
+			}
+			text := p.applyResult(res, time.Now())
+			if saved, err := plg.saveProbe(p); err != nil || !saved {
+				if err != nil {
+					log.Printf("[ERROR] cannot save probe %d: %v", p.ID, err)
+				}
+				return
+			}
+			if text == "" || !plg.sendEnabled(p.ChatID) {
+				return
+			}
+			if err := common.SentTextMessage(plg.Bot, p.ChatID, text, tgbotapi.ModeHTML); err != nil {
+				log.Printf("[ERROR] cannot send probe status: %v", err)
+			}
+		}(&probes[i])
+	}
+	wg.Wait()
+}
+
+// saveProbe updates probe if it isn't removed during check
+func (plg *Monitor) saveProbe(p *probe) (bool, error) {
+	plg.mtx.Lock()
+	defer plg.mtx.Unlock()
+	err := plg.ProbeStore.One("ID", p.ID, &probe{})
+	if err == storm.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, plg.ProbeStore.Save(p)
+}
+
+// addProbe saves new probe if chat doesn't have too many probes
+func (plg *Monitor) addProbe(p *probe) (bool, error) {
+	plg.mtx.Lock()
+	defer plg.mtx.Unlock()
+	count, err := plg.ProbeStore.Select(q.Eq("ChatID", p.ChatID)).Count(&probe{})
+	if err != nil {
+		return false, err
+	}
+	if count >= plg.MaxChatProbes {
+		return false, nil
+	}
+	return true, plg.ProbeStore.Save(p)
+}
+
+func formatProbe(p *probe) string {
+	status := "pending"
+	if p.Checked && p.Down {
+		status = "<b>down</b>: " + html.EscapeString(p.LastError)
+	} else if p.Checked {
+		status = fmt.Sprintf("up, %dms", p.LatencyMs)
+	}
+	return fmt.Sprintf("#%d %s every %s, %s", p.ID, html.EscapeString(p.Target), time.Duration(p.Every)*time.Second, status)
+}
+
+func (plg *Monitor) handleProbe(_ context.Context, msg *tgbotapi.Message, args string) error {
+	args = strings.TrimSpace(args)
+	cmd := ""
+	if fields := strings.Fields(args); len(fields) > 0 {
+		cmd = fields[0]
+	}
+	args = strings.TrimSpace(strings.TrimPrefix(args, cmd))
+
+	switch cmd {
+	case "add":
+		p, err := parseProbeArgs(args, plg.MinProbeInterval)
+		if err != nil {
+			return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Can't add probe: %s", err), "")
+		}
+		p.ChatID, p.NextCheck = msg.Chat.ID, time.Now().Unix()
+		added, err := plg.addProbe(p)
+		if err != nil {
+			_ = common.ReplyWithText(plg.Bot, msg, "Can't add probe, internal error :(", "")
+			return err
+		}
+		if !added {
+			return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Can't add probe, chat may have at most %d probes", plg.MaxChatProbes), "")
+		}
+		return common.ReplyWithText(plg.Bot, msg, "Ok, "+formatProbe(p), tgbotapi.ModeHTML)
+	case "list", "":
+		var probes []probe
+		err := plg.ProbeStore.Find("ChatID", msg.Chat.ID, &probes)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		if len(probes) == 0 {
+			return common.ReplyWithText(plg.Bot, msg, "No probes, add one with /probe add <url|host:port> [every 1m]", "")
+		}
+		lines := []string{}
+		for i := range probes {
+			lines = append(lines, formatProbe(&probes[i]))
+		}
+		return common.ReplyWithText(plg.Bot, msg, strings.Join(lines, "\n"), tgbotapi.ModeHTML)
+	case "remove":
+		id, err := strconv.Atoi(strings.TrimPrefix(args, "#"))
+		if err != nil {
+			return common.ReplyWithText(plg.Bot, msg, "Pass probe id, see /probe list", "")
+		}
+		plg.mtx.Lock()
+		p := &probe{}
+		err = plg.ProbeStore.One("ID", id, p)
+		if err == nil && p.ChatID == msg.Chat.ID {
+			err = plg.ProbeStore.DeleteStruct(p)
+		} else if err == nil {
+			err = storm.ErrNotFound
+		}
+		plg.mtx.Unlock()
+		if err == storm.ErrNotFound {
+			return common.ReplyWithText(plg.Bot, msg, "Not found", "")
+		}
+		if err != nil {
+			return err
+		}
+		return common.ReplyWithText(plg.Bot, msg, "Ok, probe removed", "")
+	}
+	return common.ReplyWithText(plg.Bot, msg, "Usage: /probe add|list|remove", "")
+}
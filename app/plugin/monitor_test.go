@@ -0,0 +1,210 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProbeArgs(t *testing.T) {
+	p, err := parseProbeArgs("https://example.com/health every 5m status=204", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "http", p.Kind)
+	assert.Equal(t, int64(300), p.Every)
+	assert.Equal(t, 204, p.ExpectStatus)
+
+	p, err = parseProbeArgs("http://example.com contains=all systems go", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "all systems go", p.Contains)
+	assert.Equal(t, int64(60), p.Every)
+
+	p, err = parseProbeArgs("db.local:5432", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", p.Kind)
+
+	for _, args := range []string{
+		"",
+		"example.com",
+		"http://example.com every 1s",
+		"http://example.com status=abc",
+		"db.local:5432 contains=ok",
+		"http://example.com every",
+	} {
+		_, err := parseProbeArgs(args, time.Minute)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestRunProbe(t *testing.T) {
+	var healthy int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = w.Write([]byte("status: ok"))
+	}))
+	defer ts.Close()
+
+	now := time.Now()
+	p, err := parseProbeArgs(ts.URL+" contains=ok", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "", p.applyResult(runProbe(context.Background(), p, &net.Dialer{}), now))
+	assert.False(t, p.Down)
+	assert.True(t, p.Checked)
+
+	atomic.StoreInt32(&healthy, 0)
+	text := p.applyResult(runProbe(context.Background(), p, &net.Dialer{}), now)
+	assert.Contains(t, text, "is down: status 503")
+	assert.Equal(t, "", p.applyResult(runProbe(context.Background(), p, &net.Dialer{}), now))
+
+	atomic.StoreInt32(&healthy, 1)
+	text = p.applyResult(runProbe(context.Background(), p, &net.Dialer{}), now)
+	assert.Contains(t, text, "is up, latency")
+
+	p.Contains = "missing"
+	text = p.applyResult(runProbe(context.Background(), p, &net.Dialer{}), now)
+	assert.Contains(t, text, "doesn&#39;t contain")
+
+	tcp, err := parseProbeArgs(strings.TrimPrefix(ts.URL, "http://"), time.Second)
+	require.NoError(t, err)
+	assert.NoError(t, runProbe(context.Background(), tcp, &net.Dialer{}).err)
+
+	// take free port and close listener to get refused connection
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+	tcp, err = parseProbeArgs(addr, time.Second)
+	require.NoError(t, err)
+	assert.Contains(t, tcp.applyResult(runProbe(context.Background(), tcp, &net.Dialer{}), now), "is down")
+}
+
+func TestProbeAddressCheck(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"8.8.8.8":          true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"0.0.0.0":          false,
+	} {
+		assert.Equal(t, public, isPublicIP(net.ParseIP(addr)), addr)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	plg := &Monitor{}
+	p, err := parseProbeArgs(ts.URL, time.Second)
+	require.NoError(t, err)
+	assert.Contains(t, runProbe(context.Background(), p, plg.probeDialer()).err.Error(), errProbeAddress.Error())
+
+	// name is checked after resolving
+	p, err = parseProbeArgs(strings.Replace(ts.URL, "127.0.0.1", "localhost", 1), time.Second)
+	require.NoError(t, err)
+	assert.Contains(t, runProbe(context.Background(), p, plg.probeDialer()).err.Error(), errProbeAddress.Error())
+
+	tcp, err := parseProbeArgs(strings.TrimPrefix(ts.URL, "http://"), time.Second)
+	require.NoError(t, err)
+	assert.Contains(t, runProbe(context.Background(), tcp, plg.probeDialer()).err.Error(), errProbeAddress.Error())
+
+	plg.AllowPrivateProbes = true
+	assert.NoError(t, runProbe(context.Background(), p, plg.probeDialer()).err)
+}
+
+func TestMonitorStartupMessage(t *testing.T) {
+	plg := &Monitor{Version: "v1.2"}
+	now := time.Unix(1600000000, 0)
+	assert.Equal(t, "Hello! I'm awake! Version <code>v1.2</code>. You may send /version to me.", plg.startupMessage(nil, now))
+	assert.Equal(t, "Hello! I'm awake! Version <code>v1.2</code>. I was down for 1m30s after shutdown. You may send /version to me.",
+		plg.startupMessage(&serviceState{LastSeen: now.Add(-90 * time.Second).Unix(), CleanShutdown: true}, now))
+	assert.Contains(t, plg.startupMessage(&serviceState{LastSeen: now.Add(-time.Hour).Unix()}, now), "after crash")
+}
+
+func TestMonitorCleanShutdown(t *testing.T) {
+	bot, tg := newTestBot(t)
+	db := newTestDB(t)
+	newMonitor := func() *Monitor {
+		return &Monitor{
+			Bot:            bot,
+			Store:          db.From("service_subscribers"),
+			HeartbeatStore: db.From("heartbeat"),
+			ProbeStore:     db.From("probe"),
+			StateStore:     db.From("service_state"),
+			CheckInterval:  10 * time.Millisecond,
+		}
+	}
+	plg := newMonitor()
+	require.NoError(t, plg.Store.Save(&subscriberData{ChatID: 1, Subscribed: true}))
+	require.NoError(t, plg.Init())
+	require.Eventually(t, func() bool { return len(tg.Texts()) == 1 }, time.Second, 10*time.Millisecond)
+
+	plg.NotifyShutdown("")
+	time.Sleep(50 * time.Millisecond) // heartbeat loop keeps saving state until close
+	require.NoError(t, plg.Close())
+
+	plg = newMonitor()
+	require.NoError(t, plg.Init())
+	defer plg.Close()
+	require.Eventually(t, func() bool { return len(tg.Texts()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Contains(t, tg.Texts()[2], "after shutdown")
+}
+
+func TestMonitorDisabledOrDeniedChat(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	bot, tg := newTestBot(t)
+	db := newTestDB(t)
+	plg := &Monitor{Bot: bot, HeartbeatStore: db.From("heartbeat"), ProbeStore: db.From("probe"), AllowPrivateProbes: true}
+	plg.Access = newTestAccess(t, db, 1, plg.Name())
+	plg.AllowedChat = func(chatID int64) bool { return chatID != 3 }
+	now := time.Now()
+
+	for _, chatID := range []int64{1, 2, 3} {
+		hb := &heartbeat{ID: fmt.Sprintf("hb%d", chatID), ChatID: chatID, Name: fmt.Sprintf("job%d", chatID),
+			Interval: 60, LastPing: now.Add(-time.Hour).Unix()}
+		require.NoError(t, plg.HeartbeatStore.Save(hb))
+		p, err := parseProbeArgs(ts.URL, time.Second)
+		require.NoError(t, err)
+		p.ChatID = chatID
+		require.NoError(t, plg.ProbeStore.Save(p))
+	}
+
+	plg.checkHeartbeats(now)
+	plg.checkProbes(context.Background(), now)
+	texts := tg.Texts()
+	require.Len(t, texts, 2)
+	assert.Contains(t, texts[0], "job2</b> is down")
+	assert.Contains(t, texts[1], "is down: status 503")
+
+	// heartbeat and probe state is kept, so alerts aren't repeated after plugin is enabled
+	var beats []heartbeat
+	require.NoError(t, plg.HeartbeatStore.All(&beats))
+	for _, hb := range beats {
+		assert.True(t, hb.Down, hb.Name)
+	}
+	var probes []probe
+	require.NoError(t, plg.ProbeStore.All(&probes))
+	for _, p := range probes {
+		assert.True(t, p.Down, p.ChatID)
+	}
+}
@@ -4,11 +4,18 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
+	"log"
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/go-chi/chi"
@@ -21,9 +28,28 @@ import (
 )
 
 type NotifierApp struct {
+	NopPlugin
 	Bot    *tgbotapi.BotAPI
 	Store  *NotifierStore
 	AppURL string
+	// MaxUploadSize limits size of multipart request with files, DefaultMaxUploadSize is used if it isn't set
+	MaxUploadSize int64
+	// Adapters convert payloads of external services posted to /notify/{name}, DefaultWebhookAdapters are used if it isn't set
+	Adapters []WebhookAdapter
+	// Limits restricts request rate of tokens and chats, zero value means no limits
+	Limits NotifierLimits
+	// Access rejects tokens of chats where notifier is disabled, everything is allowed if it's nil
+	Access *Access
+	// Allowed checks that chat and creator of token aren't denied, everything is allowed if it's nil
+	Allowed func(chatID int64, creatorID int) bool
+
+	limiter       *notifierLimiter
+	templates     templateCache
+	outboxWake    chan (struct{})
+	closeNotifier chan (struct{})
+	loopDone      chan (struct{})
+	// cancelOutbox interrupts messages being sent by outbox loop
+	cancelOutbox context.CancelFunc
 }
 
 type handlable interface {
@@ -34,150 +60,678 @@ func (sapp *NotifierApp) Init() error {
 	if sapp.AppURL == "" {
 		sapp.AppURL = "http://127.0.0.1"
 	}
+	if sapp.MaxUploadSize <= 0 {
+		sapp.MaxUploadSize = DefaultMaxUploadSize
+	}
+	sapp.limiter = newNotifierLimiter(sapp.Limits)
+	if err := sapp.Store.InitSecret(); err != nil {
+		return err
+	}
+	if err := sapp.Store.MigrateTokens(); err != nil {
+		return err
+	}
+
+	sapp.outboxWake = make(chan struct{}, 1)
+	sapp.closeNotifier = make(chan struct{})
+	sapp.loopDone = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	sapp.cancelOutbox = cancel
+	go sapp.runOutbox(common.BotWithContext(ctx, sapp.Bot))
 	return nil
 }
 
 func (sapp *NotifierApp) Routes() http.Handler {
 	r := chi.NewRouter()
 	r.Get("/", sapp.handleWeb)
+	r.Get("/status/{deliveryID}", sapp.handleStatus)
 	r.Get("/{parseMode}", sapp.handleWeb)
 	r.Post("/", sapp.handleWeb)
 	r.Post("/{parseMode}", sapp.handleWeb)
+	for _, adapter := range sapp.webhookAdapters() {
+		r.Post("/"+adapter.Name(), sapp.handleWebhook(adapter))
+		r.Post("/"+adapter.Name()+"/{token}", sapp.handleWebhook(adapter))
+	}
+	r.Put("/{messageID}", sapp.handleEdit)
+	r.Delete("/{messageID}", sapp.handleDelete)
 	return r
 }
 
-func (sapp *NotifierApp) handleWeb(w http.ResponseWriter, r *http.Request) {
-	reqToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	if reqToken == "" {
-		render.Status(r, http.StatusUnauthorized)
-		render.PlainText(w, r, http.StatusText(http.StatusUnauthorized))
-		return
+// notifyRequest is a message to send, it can be passed as JSON
+type notifyRequest struct {
+	Text                  string          `json:"text"`
+	ParseMode             string          `json:"parse_mode"`
+	DisableNotification   bool            `json:"disable_notification"`
+	DisableWebPagePreview bool            `json:"disable_web_page_preview"`
+	ReplyToMessageID      int             `json:"reply_to_message_id"`
+	Buttons               json.RawMessage `json:"buttons"`
+}
+
+// notifyButton is inline keyboard button with URL
+type notifyButton struct {
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
+type notifyResponse struct {
+	MessageID  int   `json:"message_id"`
+	MessageIDs []int `json:"message_ids,omitempty"`
+}
+
+// notifySendTimeout limits time synchronous request waits in send queue, async mode should be used for long queues
+const notifySendTimeout = 30 * time.Second
+
+var notifyParseModes = map[string]string{
+	"":           "",
+	"html":       tgbotapi.ModeHTML,
+	"md":         tgbotapi.ModeMarkdownV2,
+	"markdownv2": tgbotapi.ModeMarkdownV2,
+	"markdown":   tgbotapi.ModeMarkdown,
+}
+
+// parseButtons accepts list of rows or flat list of buttons placed in single row
+func parseButtons(raw json.RawMessage) (*tgbotapi.InlineKeyboardMarkup, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var rows [][]notifyButton
+	if err := json.Unmarshal(raw, &rows); err != nil {
+		var row []notifyButton
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return nil, errors.Errorf("buttons should be list of {text, url} or list of such lists")
+		}
+		rows = [][]notifyButton{row}
 	}
 
-	chatID := sapp.Store.FindToken(reqToken)
-	if chatID == 0 {
-		render.Status(r, http.StatusForbidden)
-		render.PlainText(w, r, http.StatusText(http.StatusForbidden))
-		return
+	kbRows := [][]tgbotapi.InlineKeyboardButton{}
+	for _, row := range rows {
+		kbRow := []tgbotapi.InlineKeyboardButton{}
+		for _, btn := range row {
+			if btn.Text == "" || btn.URL == "" {
+				return nil, errors.Errorf("button should have text and url")
+			}
+			kbRow = append(kbRow, tgbotapi.NewInlineKeyboardButtonURL(btn.Text, btn.URL))
+		}
+		if len(kbRow) > 0 {
+			kbRows = append(kbRows, kbRow)
+		}
+	}
+	if len(kbRows) == 0 {
+		return nil, nil
 	}
+	markup := tgbotapi.NewInlineKeyboardMarkup(kbRows...)
+	return &markup, nil
+}
 
-	var text string
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// readNotifyRequest gets message from query, plain text body or JSON body
+func readNotifyRequest(w http.ResponseWriter, r *http.Request) (*notifyRequest, int, string) {
+	req := &notifyRequest{ParseMode: chi.URLParam(r, "parseMode")}
+	if req.ParseMode == "" {
+		req.ParseMode = r.URL.Query().Get("parse_mode")
+	}
 	switch r.Method {
 	case "GET":
-		text = r.URL.Query().Get("text")
-	case "POST":
+		req.Text = r.URL.Query().Get("text")
+	case "POST", "PUT":
 		reqBody, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
 		if err != nil && err != io.EOF {
-			render.Status(r, http.StatusBadRequest)
-			render.JSON(w, r, common.JSON{"error": "can't read body"})
-			return
+			return nil, http.StatusBadRequest, "can't read body"
 		}
 		if !utf8.Valid(reqBody) {
+			return nil, http.StatusBadRequest, "text must be encoded in UTF-8"
+		}
+		if !isJSONRequest(r) {
+			req.Text = string(reqBody)
+			break
+		}
+		if err := json.Unmarshal(reqBody, req); err != nil {
+			return nil, http.StatusBadRequest, "can't parse json"
+		}
+		if req.ParseMode == "" {
+			req.ParseMode = chi.URLParam(r, "parseMode")
+		}
+		if req.ParseMode == "" {
+			req.ParseMode = r.URL.Query().Get("parse_mode")
+		}
+	default:
+		return nil, http.StatusNotImplemented, ""
+	}
+
+	if req.Text == "" {
+		return nil, http.StatusBadRequest, "text isn't provided"
+	}
+	return req, http.StatusOK, ""
+}
+
+func (req *notifyRequest) editMessage(chatID int64, messageID int) (tgbotapi.EditMessageTextConfig, error) {
+	edit := tgbotapi.NewEditMessageText(chatID, messageID, req.Text)
+	parseMode, ok := notifyParseModes[strings.ToLower(req.ParseMode)]
+	if !ok {
+		return edit, errors.Errorf("unknown parse mode %q", req.ParseMode)
+	}
+	edit.ParseMode = parseMode
+	edit.DisableWebPagePreview = req.DisableWebPagePreview
+
+	markup, err := parseButtons(req.Buttons)
+	if err != nil {
+		return edit, err
+	}
+	edit.ReplyMarkup = markup
+	return edit, nil
+}
+
+func (req *notifyRequest) message(chatID int64) (tgbotapi.MessageConfig, error) {
+	resp := tgbotapi.NewMessage(chatID, req.Text)
+	parseMode, ok := notifyParseModes[strings.ToLower(req.ParseMode)]
+	if !ok {
+		return resp, errors.Errorf("unknown parse mode %q", req.ParseMode)
+	}
+	resp.ParseMode = parseMode
+	resp.DisableNotification = req.DisableNotification
+	resp.DisableWebPagePreview = req.DisableWebPagePreview
+	resp.ReplyToMessageID = req.ReplyToMessageID
+
+	markup, err := parseButtons(req.Buttons)
+	if err != nil {
+		return resp, err
+	}
+	if markup != nil {
+		resp.ReplyMarkup = *markup
+	}
+	return resp, nil
+}
+
+// authorize checks bearer token and its scope and returns stored token, it writes error response if token isn't valid
+func (sapp *NotifierApp) authorize(w http.ResponseWriter, r *http.Request, scope string) (token string, tok *chatToken, ok bool) {
+	return sapp.authorizeToken(w, r, bearerToken(r), scope)
+}
+
+// bearerToken returns token from Authorization header
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func (sapp *NotifierApp) authorizeToken(w http.ResponseWriter, r *http.Request, reqToken string, scope string) (token string, tok *chatToken, ok bool) {
+	tok, ok = sapp.checkToken(w, r, reqToken, scope)
+	if !ok {
+		return "", nil, false
+	}
+	now := time.Now()
+	if retryAfter, allowed := sapp.limiter.allow(tok.Token, tok.ChatID, now); !allowed {
+		rateLimited(w, r, "rate limit exceeded", retryAfter)
+		return "", nil, false
+	}
+	allowed, err := sapp.Store.UseToken(tok, now, sapp.Limits.DailyQuota)
+	if err != nil {
+		log.Printf("[WARN] cannot update token usage: %v", err)
+	} else if !allowed {
+		rateLimited(w, r, "daily quota exceeded", untilNextDay(now))
+		return "", nil, false
+	}
+	return reqToken, tok, true
+}
+
+// checkToken checks that token is valid and may be used in chat, it doesn't count token usage
+func (sapp *NotifierApp) checkToken(w http.ResponseWriter, r *http.Request, reqToken string, scope string) (*chatToken, bool) {
+	if reqToken == "" {
+		render.Status(r, http.StatusUnauthorized)
+		render.PlainText(w, r, http.StatusText(http.StatusUnauthorized))
+		return nil, false
+	}
+
+	tok := sapp.Store.FindToken(reqToken)
+	if tok == nil || !tok.HasScope(scope) {
+		render.Status(r, http.StatusForbidden)
+		render.PlainText(w, r, http.StatusText(http.StatusForbidden))
+		return nil, false
+	}
+	if sapp.Allowed != nil && !sapp.Allowed(tok.ChatID, tok.CreatorID) {
+		render.Status(r, http.StatusForbidden)
+		render.JSON(w, r, common.JSON{"error": "chat or user is denied"})
+		return nil, false
+	}
+	if !sapp.Access.PluginEnabled(r.Context(), tok.ChatID, sapp.Name()) {
+		render.Status(r, http.StatusForbidden)
+		render.JSON(w, r, common.JSON{"error": "notifier is disabled in chat"})
+		return nil, false
+	}
+	return tok, true
+}
+
+func rateLimited(w http.ResponseWriter, r *http.Request, reason string, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", retryAfterHeader(retryAfter))
+	render.Status(r, http.StatusTooManyRequests)
+	render.JSON(w, r, common.JSON{"error": reason, "retry_after": retryAfterHeader(retryAfter)})
+}
+
+// requestBot returns bot which requests are canceled with http request or after notifySendTimeout
+func (sapp *NotifierApp) requestBot(r *http.Request) (*tgbotapi.BotAPI, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), notifySendTimeout)
+	return common.BotWithContext(ctx, sapp.Bot), cancel
+}
+
+// sentMessage finds message sent with token by id from url, it writes error response if message isn't found
+func (sapp *NotifierApp) sentMessage(w http.ResponseWriter, r *http.Request, token string, chatID int64) (int, bool) {
+	messageID, err := strconv.Atoi(chi.URLParam(r, "messageID"))
+	if err != nil || messageID <= 0 {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, common.JSON{"error": "wrong message id"})
+		return 0, false
+	}
+	if !sapp.Store.IsSentWithToken(token, chatID, messageID) {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, common.JSON{"error": "message isn't found"})
+		return 0, false
+	}
+	return messageID, true
+}
+
+func (sapp *NotifierApp) handleWeb(w http.ResponseWriter, r *http.Request) {
+	scope := TokenScopeText
+	if r.Method == "POST" && isMultipartRequest(r) {
+		scope = TokenScopeFiles
+	}
+	token, tok, ok := sapp.authorize(w, r, scope)
+	if !ok {
+		return
+	}
+	chatID := tok.ChatID
+
+	if _, ok := notifyParseModes[chi.URLParam(r, "parseMode")]; !ok {
+		render.Status(r, http.StatusNotFound)
+		render.PlainText(w, r, http.StatusText(http.StatusNotFound))
+		return
+	}
+
+	if r.Method == "POST" && isMultipartRequest(r) {
+		if isAsyncRequest(r) {
 			render.Status(r, http.StatusBadRequest)
-			render.JSON(w, r, common.JSON{"error": "text must be encoded in UTF-8"})
+			render.JSON(w, r, common.JSON{"error": "async mode isn't supported for files"})
 			return
 		}
-		text = string(reqBody)
-	default:
+		sapp.handleUpload(w, r, token, chatID)
+		return
+	}
+
+	var req *notifyRequest
+	var status int
+	var errText string
+	tmpl, err := sapp.templates.get(tok)
+	if err != nil {
+		log.Printf("[WARN] cannot parse template of token %s: %v", tok.Hint, err)
+	}
+	if tmpl != nil && r.Method == "POST" && isJSONRequest(r) {
+		req, status, errText = readTemplateRequest(w, r, tmpl)
+	} else {
+		req, status, errText = readNotifyRequest(w, r)
+	}
+	if status == http.StatusNotImplemented {
 		render.Status(r, http.StatusNotImplemented)
 		render.PlainText(w, r, http.StatusText(http.StatusNotImplemented))
 		return
 	}
+	if req == nil {
+		render.Status(r, status)
+		render.JSON(w, r, common.JSON{"error": errText})
+		return
+	}
 
-	if text == "" {
+	resp, err := req.message(chatID)
+	if err != nil {
 		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, common.JSON{"error": "text isn't provided"})
+		render.JSON(w, r, common.JSON{"error": err.Error()})
 		return
 	}
 
-	resp := tgbotapi.NewMessage(chatID, text)
-	parseMode := chi.URLParam(r, "parseMode")
-	switch parseMode {
-	case "":
-		break
-	case "html":
-		resp.ParseMode = tgbotapi.ModeHTML
-	case "md":
-		resp.ParseMode = tgbotapi.ModeMarkdownV2
-	default:
-		render.Status(r, http.StatusNotFound)
-		render.PlainText(w, r, http.StatusText(http.StatusNotFound))
+	if isAsyncRequest(r) {
+		sapp.enqueue(w, r, token, tok, req)
 		return
 	}
 
-	_, err := sapp.Bot.Send(resp)
+	bot, cancel := sapp.requestBot(r)
+	defer cancel()
+	sent, err := bot.Send(resp)
 	if err != nil {
 		render.Status(r, http.StatusServiceUnavailable)
 		render.JSON(w, r, common.JSON{"error": "can't send message", "verbose": err.Error()})
 		return
 	}
+	if err := sapp.Store.SaveSentMessage(token, chatID, sent.MessageID); err != nil {
+		log.Printf("[WARN] cannot save sent message: %v", err)
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, notifyResponse{MessageID: sent.MessageID})
+}
+
+func (sapp *NotifierApp) handleEdit(w http.ResponseWriter, r *http.Request) {
+	token, tok, ok := sapp.authorize(w, r, TokenScopeEdit)
+	if !ok {
+		return
+	}
+	chatID := tok.ChatID
+	messageID, ok := sapp.sentMessage(w, r, token, chatID)
+	if !ok {
+		return
+	}
+
+	req, status, errText := readNotifyRequest(w, r)
+	if req == nil {
+		render.Status(r, status)
+		render.JSON(w, r, common.JSON{"error": errText})
+		return
+	}
+
+	edit, err := req.editMessage(chatID, messageID)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, common.JSON{"error": err.Error()})
+		return
+	}
+
+	bot, cancel := sapp.requestBot(r)
+	defer cancel()
+	_, err = bot.Send(edit)
+	if err != nil {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, common.JSON{"error": "can't edit message", "verbose": err.Error()})
+		return
+	}
 	render.Status(r, http.StatusOK)
+	render.JSON(w, r, notifyResponse{MessageID: messageID})
 }
 
-func (sapp *NotifierApp) fomatTokenMsg(token string) string {
+func (sapp *NotifierApp) handleDelete(w http.ResponseWriter, r *http.Request) {
+	token, tok, ok := sapp.authorize(w, r, TokenScopeEdit)
+	if !ok {
+		return
+	}
+	chatID := tok.ChatID
+	messageID, ok := sapp.sentMessage(w, r, token, chatID)
+	if !ok {
+		return
+	}
+
+	bot, cancel := sapp.requestBot(r)
+	defer cancel()
+	_, err := bot.DeleteMessage(tgbotapi.NewDeleteMessage(chatID, messageID))
+	if err != nil {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, common.JSON{"error": "can't delete message", "verbose": err.Error()})
+		return
+	}
+	if err := sapp.Store.RemoveSentMessage(chatID, messageID); err != nil {
+		log.Printf("[WARN] cannot remove sent message: %v", err)
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, notifyResponse{MessageID: messageID})
+}
+
+func (sapp *NotifierApp) fomatTokenMsg(token string, webhookSecret string, tok *tokenOptions) string {
 	cmd := fmt.Sprintf(
 		`echo -n "Hello 界" | curl --data-binary @- -H "Content-Type: text/plain; charset=utf-8" -H "Authorization: Bearer %s" "%s/notify"`,
 		token, sapp.AppURL)
-	return fmt.Sprintf("token: `%s` created.\nExample usage `%s`", token, cmd)
+	expires := "never"
+	if !tok.ExpiresAt.IsZero() {
+		expires = tok.ExpiresAt.UTC().Format("2006-01-02 15:04 MST")
+	}
+	return fmt.Sprintf("token <code>%s</code>: <code>%s</code> created.\nScopes: %s, expires: %s\nWebhook secret: <code>%s</code>\nExample usage <code>%s</code>",
+		html.EscapeString(tok.Label), html.EscapeString(token), html.EscapeString(strings.Join(tok.Scopes, ",")),
+		expires, html.EscapeString(webhookSecret), html.EscapeString(cmd))
 }
 
-func (sapp *NotifierApp) Commands() []CommandDescription {
-	return []CommandDescription{
-		{
-			Cmd:     "notify_token",
-			Help:    "Create or revoke notify token for chat.",
-			Details: "To revoke token pass 'revoke' argument with token to revoke or without to revoke all ones.",
-		},
-	}
+func (sapp *NotifierApp) Name() string {
+	return "notifier"
 }
 
-func (sapp *NotifierApp) HandleUpdate(ctx context.Context, upd *tgbotapi.Update) (bool, error) {
-	if upd.Message == nil {
-		return false, nil
+// RegisterHandlers declares notifier commands
+func (sapp *NotifierApp) RegisterHandlers(r *Router) {
+	r.Command(CommandDescription{
+		Cmd:  "notify_token",
+		Help: "Create or revoke notify token for chat.",
+		Details: "Optional arguments: label, 'scope=text,files,edit', 'expires=30d'. " +
+			"To revoke token pass 'revoke' argument with token or label to revoke or without to revoke all ones. " +
+			"Webhooks of GitHub, GitLab, Alertmanager and Grafana are accepted at /notify/{service}/{token}, " +
+			"GitHub webhook should be signed with webhook secret shown on token creation. " +
+			"To render any JSON posted with token pass 'template <label>' and Go text/template on next line, without template to remove it.",
+		Permission: PermAdmins,
+	}, sapp.handleTokenCmd)
+	r.Command(CommandDescription{
+		Cmd:  "notify_tokens",
+		Help: "List notify tokens of chat.",
+	}, sapp.handleTokensCmd)
+}
+
+// tokenOptions are parameters of new token
+type tokenOptions struct {
+	Label     string
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+// parseDuration extends time.ParseDuration with days and weeks, e.g. '30d', '2w'
+func parseDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, suffix)); strings.HasSuffix(s, suffix) && err == nil && n > 0 {
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("wrong duration '%s'", s)
 	}
-	msgToMe := sapp.Bot.IsMessageToMe(*upd.Message) || upd.Message.Chat.IsPrivate()
-	if cmd := upd.Message.Command(); msgToMe && cmd == "notify_token" {
-		if args := upd.Message.CommandArguments(); args == "" {
-			token, err := sapp.generateToken(upd.Message.Chat.ID)
-			if err == nil {
-				resp := tgbotapi.NewMessage(upd.Message.Chat.ID, sapp.fomatTokenMsg(token))
-				resp.ParseMode = tgbotapi.ModeMarkdown
+	return d, nil
+}
 
-				_, err := sapp.Bot.Send(resp)
-				return true, err
+// parseTokenOptions parses `[label] [scope=text,files,edit] [expires=30d]`
+func parseTokenOptions(args string, now time.Time) (*tokenOptions, error) {
+	opts := &tokenOptions{Scopes: AllTokenScopes}
+	for _, arg := range strings.Fields(args) {
+		switch {
+		case strings.HasPrefix(arg, "scope="):
+			opts.Scopes = nil
+			for _, scope := range strings.Split(strings.TrimPrefix(arg, "scope="), ",") {
+				known := false
+				for _, s := range AllTokenScopes {
+					known = known || s == scope
+				}
+				if !known {
+					return nil, errors.Errorf("unknown scope '%s', use %s", scope, strings.Join(AllTokenScopes, ", "))
+				}
+				opts.Scopes = append(opts.Scopes, scope)
 			}
-			return true, errors.Wrapf(err, "generate token error")
-		} else if strings.HasPrefix(args, "revoke") {
-			tokenToRevoke := strings.TrimSpace(strings.TrimPrefix(args, "revoke"))
-			revokedCnt, err := sapp.revokeTokens(upd.Message.Chat.ID, tokenToRevoke)
-			var resp tgbotapi.MessageConfig
+		case strings.HasPrefix(arg, "expires="):
+			d, err := parseDuration(strings.TrimPrefix(arg, "expires="))
 			if err != nil {
-				resp = tgbotapi.NewMessage(upd.Message.Chat.ID, fmt.Sprintf("Can't revoke token"))
-			} else if revokedCnt == 0 {
-				resp = tgbotapi.NewMessage(upd.Message.Chat.ID, fmt.Sprintf("Not found"))
-			} else if revokedCnt == 1 {
-				resp = tgbotapi.NewMessage(upd.Message.Chat.ID, fmt.Sprintf("Ok, token revoked"))
-			} else {
-				resp = tgbotapi.NewMessage(upd.Message.Chat.ID, fmt.Sprintf("Ok, all tokens revoked"))
+				return nil, err
 			}
-			_, err = sapp.Bot.Send(resp)
-			return true, err
+			opts.ExpiresAt = now.Add(d)
+		case opts.Label == "" && !strings.Contains(arg, "="):
+			opts.Label = arg
+		default:
+			return nil, errors.Errorf("unexpected argument '%s'", arg)
 		}
 	}
-	return false, nil
+	return opts, nil
+}
+
+func formatTokenTime(ts int64) string {
+	if ts == 0 {
+		return "never"
+	}
+	return time.Unix(ts, 0).UTC().Format("2006-01-02 15:04 MST")
+}
+
+func (sapp *NotifierApp) formatTokenList(chatID int64) (string, error) {
+	tokens, err := sapp.Store.ChatTokens(chatID)
+	if err != nil {
+		return "", err
+	}
+	if len(tokens) == 0 {
+		return "No tokens, create one with /notify_token", nil
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt < tokens[j].CreatedAt })
+
+	lines := []string{}
+	now := time.Now()
+	for _, tok := range tokens {
+		label := tok.Label
+		if label == "" {
+			label = "(no label)"
+		}
+		scopes := strings.Join(tok.Scopes, ",")
+		if scopes == "" {
+			scopes = strings.Join(AllTokenScopes, ",")
+		}
+		status := ""
+		if tok.expired(now) {
+			status = " <b>expired</b>"
+		}
+		if tok.Template != "" {
+			status += " (template)"
+		}
+		lines = append(lines, fmt.Sprintf(
+			"<b>%s</b> <code>%s</code>%s\n  scopes: %s\n  created: %s, expires: %s\n  used %d times, last: %s",
+			html.EscapeString(label), html.EscapeString(tok.Hint), status, scopes,
+			formatTokenTime(tok.CreatedAt), formatTokenTime(tok.ExpiresAt), tok.UseCount, formatTokenTime(tok.LastUsedAt)))
+		if limits := sapp.formatTokenLimits(&tok, now); limits != "" {
+			lines = append(lines, "  "+limits)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// formatTokenLimits shows how many requests token may do now and today
+func (sapp *NotifierApp) formatTokenLimits(tok *chatToken, now time.Time) string {
+	parts := []string{}
+	if sapp.Limits.Token.PerMinute > 0 {
+		parts = append(parts, fmt.Sprintf("rate: %d/%.0f available, %g per minute",
+			sapp.limiter.available(tok.Token, now), sapp.Limits.Token.burst(), sapp.Limits.Token.PerMinute))
+	}
+	if sapp.Limits.DailyQuota > 0 {
+		parts = append(parts, fmt.Sprintf("today: %d/%d", tok.dailyUsed(now), sapp.Limits.DailyQuota))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (sapp *NotifierApp) handleTokensCmd(_ context.Context, msg *tgbotapi.Message, _ string) error {
+	text, err := sapp.formatTokenList(msg.Chat.ID)
+	if err != nil {
+		return err
+	}
+	return common.ReplyWithText(sapp.Bot, msg, text, tgbotapi.ModeHTML)
+}
+
+func (sapp *NotifierApp) handleTokenCmd(_ context.Context, msg *tgbotapi.Message, args string) error {
+	if fields := strings.Fields(args); len(fields) > 0 && fields[0] == "template" {
+		return sapp.handleTemplateCmd(msg, args)
+	}
+	if fields := strings.Fields(args); len(fields) > 0 && fields[0] == "revoke" {
+		return sapp.handleRevokeCmd(msg, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(args), "revoke")))
+	}
+
+	opts, err := parseTokenOptions(args, time.Now())
+	if err != nil {
+		return common.ReplyWithText(sapp.Bot, msg, fmt.Sprintf("Can't create token: %s", err), "")
+	}
+	creatorID := 0
+	if msg.From != nil {
+		creatorID = msg.From.ID
+	}
+	token, err := sapp.generateToken(msg.Chat.ID, creatorID, opts)
+	if errors.Cause(err) == errLabelExists {
+		return common.ReplyWithText(sapp.Bot, msg, "Token with this label already exists", "")
+	}
+	if err != nil {
+		return errors.Wrapf(err, "generate token error")
+	}
+	webhookSecret := ""
+	if tok := sapp.Store.FindToken(token); tok != nil {
+		webhookSecret = tok.WebhookSecret
+	}
+	resp := tgbotapi.NewMessage(msg.Chat.ID, sapp.fomatTokenMsg(token, webhookSecret, opts))
+	resp.ParseMode = tgbotapi.ModeHTML
+	_, err = sapp.Bot.Send(resp)
+	return err
+}
+
+func (sapp *NotifierApp) handleRevokeCmd(msg *tgbotapi.Message, tokenToRevoke string) error {
+	revokedCnt, err := sapp.revokeTokens(msg.Chat.ID, tokenToRevoke)
+	var resp tgbotapi.MessageConfig
+	if err != nil {
+		resp = tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("Can't revoke token"))
+	} else if revokedCnt == 0 {
+		resp = tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("Not found"))
+	} else if revokedCnt == 1 {
+		resp = tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("Ok, token revoked"))
+	} else {
+		resp = tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("Ok, all tokens revoked"))
+	}
+	_, err = sapp.Bot.Send(resp)
+	return err
+}
+
+func (sapp *NotifierApp) handleTemplateCmd(msg *tgbotapi.Message, args string) error {
+	label, tmpl, parsed, err := parseTemplateArgs(args)
+	if err != nil {
+		return common.ReplyWithText(sapp.Bot, msg, fmt.Sprintf("Can't set template: %s", err), "")
+	}
+	tok, err := sapp.Store.SetTemplate(msg.Chat.ID, label, tmpl)
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return common.ReplyWithText(sapp.Bot, msg, "Token isn't found, see /notify_tokens", "")
+	}
+	sapp.templates.set(tok, parsed)
+	if tmpl == "" {
+		return common.ReplyWithText(sapp.Bot, msg, "Ok, template removed", "")
+	}
+	return common.ReplyWithText(sapp.Bot, msg, "Ok, JSON posted with this token will be rendered with template", "")
 }
 
 func (sapp *NotifierApp) Close() error {
+	if sapp.closeNotifier == nil {
+		return nil
+	}
+	close(sapp.closeNotifier)
+	select {
+	case <-sapp.loopDone:
+	case <-time.After(5 * time.Second):
+		log.Printf("[WARN] outbox loop isn't finished, interrupt sending")
+		sapp.cancelOutbox()
+		<-sapp.loopDone
+	}
+	sapp.cancelOutbox()
 	return nil
 }
 
-func (sapp *NotifierApp) generateToken(chatID int64) (string, error) {
+var errLabelExists = errors.New("label exists")
+
+func (sapp *NotifierApp) generateToken(chatID int64, creatorID int, opts *tokenOptions) (string, error) {
+	if opts.Label == "" {
+		tokens, err := sapp.Store.ChatTokens(chatID)
+		if err != nil {
+			return "", err
+		}
+		opts.Label = fmt.Sprintf("token%d", len(tokens)+1)
+	}
+	if has, err := sapp.Store.HasLabel(chatID, opts.Label); has || err != nil {
+		if err == nil {
+			err = errLabelExists
+		}
+		return "", err
+	}
+
 	rawUID := make([]byte, 8)
 	rawUID = append(rawUID, uuid.NewV4().Bytes()...)
 	binary.LittleEndian.PutUint64(rawUID, uint64(chatID))
 	token := base64.RawURLEncoding.EncodeToString(rawUID)
 
-	err := sapp.Store.SaveToken(chatID, token)
+	err := sapp.Store.SaveToken(chatID, creatorID, token, opts.Label, opts.Scopes, opts.ExpiresAt)
 	return token, err
 }
 
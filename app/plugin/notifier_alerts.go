@@ -0,0 +1,164 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AlertmanagerAdapter renders Prometheus Alertmanager webhook notifications
+type AlertmanagerAdapter struct{}
+
+// GrafanaAdapter renders Grafana alerts, both unified alerting and legacy payloads are supported
+type GrafanaAdapter struct{}
+
+// alert is single alert in Alertmanager payload, Grafana unified alerting uses the same format
+type alert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	GeneratorURL string            `json:"generatorURL"`
+}
+
+type alertmanagerPayload struct {
+	Status       string            `json:"status"`
+	Alerts       []alert           `json:"alerts"`
+	CommonLabels map[string]string `json:"commonLabels"`
+	GroupLabels  map[string]string `json:"groupLabels"`
+	ExternalURL  string            `json:"externalURL"`
+
+	// fields of Grafana payload
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	State    string `json:"state"`
+	RuleName string `json:"ruleName"`
+	RuleURL  string `json:"ruleUrl"`
+}
+
+const maxListedAlerts = 10
+
+// oneLine joins lines of text, e.g. alert description
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func alertStatusIcon(status string) string {
+	switch strings.ToLower(status) {
+	case "firing", "alerting":
+		return "🔥"
+	case "resolved", "ok":
+		return "✅"
+	case "no_data", "pending":
+		return "⚠️"
+	}
+	return "ℹ️"
+}
+
+// formatLabels formats labels sorted by name
+func formatLabels(labels map[string]string, skip ...string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := []string{}
+	for _, name := range names {
+		skipped := false
+		for _, s := range skip {
+			skipped = skipped || s == name
+		}
+		if !skipped {
+			parts = append(parts, name+"="+labels[name])
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// renderAlerts formats alerts grouped in single notification
+func renderAlerts(title string, status string, alerts []alert, sourceURL string) string {
+	firing := 0
+	for _, a := range alerts {
+		if a.Status == "firing" {
+			firing++
+		}
+	}
+	header := fmt.Sprintf("%s <b>%s</b>", alertStatusIcon(status), htmlLink(sourceURL, fmt.Sprintf("[%s] %s", strings.ToUpper(status), title)))
+	if len(alerts) > 1 {
+		header += escapef(" (%s)", fmt.Sprintf("%d firing, %d resolved", firing, len(alerts)-firing))
+	}
+	lines := []string{header}
+	for i, a := range alerts {
+		if i == maxListedAlerts {
+			lines = append(lines, fmt.Sprintf("… and %d more", len(alerts)-maxListedAlerts))
+			break
+		}
+		summary := a.Annotations["summary"]
+		if summary == "" {
+			summary = a.Annotations["description"]
+		}
+		if summary == "" {
+			summary = a.Labels["alertname"]
+		}
+		line := alertStatusIcon(a.Status) + " " + htmlLink(a.GeneratorURL, oneLine(summary))
+		if labels := formatLabels(a.Labels, "alertname", "__alert_rule_uid__"); labels != "" {
+			line += escapef(" <i>%s</i>", labels)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (a *AlertmanagerAdapter) Name() string {
+	return "alertmanager"
+}
+
+func (a *AlertmanagerAdapter) Render(r *http.Request, body []byte, _ string) (string, error) {
+	p := alertmanagerPayload{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return "", errors.Errorf("can't parse payload")
+	}
+	if len(p.Alerts) == 0 {
+		return "", errors.Errorf("no alerts in payload")
+	}
+	title := p.CommonLabels["alertname"]
+	if title == "" {
+		title = formatLabels(p.GroupLabels)
+	}
+	return renderAlerts(title, p.Status, p.Alerts, p.ExternalURL), nil
+}
+
+func (a *GrafanaAdapter) Name() string {
+	return "grafana"
+}
+
+func (a *GrafanaAdapter) Render(r *http.Request, body []byte, _ string) (string, error) {
+	p := alertmanagerPayload{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return "", errors.Errorf("can't parse payload")
+	}
+	if len(p.Alerts) > 0 {
+		title := p.CommonLabels["alertname"]
+		if title == "" {
+			title = p.Title
+		}
+		return renderAlerts(title, p.Status, p.Alerts, p.ExternalURL), nil
+	}
+
+	// legacy alerting sends single rule state
+	if p.State == "" {
+		return "", errors.Errorf("no alerts in payload")
+	}
+	title := p.RuleName
+	if title == "" {
+		title = p.Title
+	}
+	text := fmt.Sprintf("%s <b>%s</b>", alertStatusIcon(p.State), htmlLink(p.RuleURL, fmt.Sprintf("[%s] %s", strings.ToUpper(p.State), title)))
+	if p.Message != "" {
+		text += "\n" + escapef("%s", oneLine(p.Message))
+	}
+	return text, nil
+}
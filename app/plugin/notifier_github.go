@@ -0,0 +1,177 @@
+package plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const maxListedCommits = 5
+
+// GithubAdapter renders GitHub webhook events. Signature is required if token has webhook secret.
+type GithubAdapter struct{}
+
+type githubUser struct {
+	Login string `json:"login"`
+}
+
+type githubPayload struct {
+	Action     string     `json:"action"`
+	Ref        string     `json:"ref"`
+	Compare    string     `json:"compare"`
+	Sender     githubUser `json:"sender"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+	Pusher struct {
+		Name string `json:"name"`
+	} `json:"pusher"`
+	Commits []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		URL     string `json:"url"`
+		Author  struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commits"`
+	PullRequest *struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+		Merged  bool   `json:"merged"`
+	} `json:"pull_request"`
+	Issue *struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+	} `json:"issue"`
+	Comment *struct {
+		Body    string `json:"body"`
+		HTMLURL string `json:"html_url"`
+	} `json:"comment"`
+	Release *struct {
+		Name    string `json:"name"`
+		TagName string `json:"tag_name"`
+		HTMLURL string `json:"html_url"`
+	} `json:"release"`
+	WorkflowRun *struct {
+		Name       string `json:"name"`
+		HeadBranch string `json:"head_branch"`
+		Conclusion string `json:"conclusion"`
+		HTMLURL    string `json:"html_url"`
+	} `json:"workflow_run"`
+}
+
+func (a *GithubAdapter) Name() string {
+	return "github"
+}
+
+// verifyGithubSignature checks X-Hub-Signature-256 header, it isn't checked only if secret is empty
+func verifyGithubSignature(r *http.Request, body []byte, secret string) error {
+	if secret == "" {
+		return nil
+	}
+	signature := r.Header.Get("X-Hub-Signature-256")
+	if signature == "" {
+		return &webhookError{status: http.StatusUnauthorized, msg: "signature is required"}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return &webhookError{status: http.StatusUnauthorized, msg: "wrong signature"}
+	}
+	return nil
+}
+
+// firstLine returns first line of multiline text, e.g. commit message
+func firstLine(s string) string {
+	return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
+}
+
+func (a *GithubAdapter) Render(r *http.Request, body []byte, secret string) (string, error) {
+	if err := verifyGithubSignature(r, body, secret); err != nil {
+		return "", err
+	}
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "ping" {
+		return "", nil
+	}
+
+	p := githubPayload{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return "", errors.Errorf("can't parse payload")
+	}
+	repo := "<b>" + htmlLink(p.Repository.HTMLURL, p.Repository.FullName) + "</b>"
+
+	switch {
+	case event == "push":
+		branch := strings.TrimPrefix(strings.TrimPrefix(p.Ref, "refs/heads/"), "refs/tags/")
+		if len(p.Commits) == 0 {
+			return repo + escapef(": %s pushed to %s", p.Pusher.Name, branch), nil
+		}
+		lines := []string{repo + escapef(": %s pushed ", p.Pusher.Name) +
+			htmlLink(p.Compare, fmt.Sprintf("%d commits", len(p.Commits))) + escapef(" to %s", branch)}
+		for i, c := range p.Commits {
+			if i == maxListedCommits {
+				lines = append(lines, fmt.Sprintf("… and %d more", len(p.Commits)-maxListedCommits))
+				break
+			}
+			sha := c.ID
+			if len(sha) > 7 {
+				sha = sha[:7]
+			}
+			lines = append(lines, "<code>"+htmlLink(c.URL, sha)+"</code> "+escapef("%s (%s)", firstLine(c.Message), c.Author.Name))
+		}
+		return strings.Join(lines, "\n"), nil
+	case event == "pull_request" && p.PullRequest != nil:
+		action := p.Action
+		if action == "closed" && p.PullRequest.Merged {
+			action = "merged"
+		}
+		return repo + escapef(": %s %s pull request ", p.Sender.Login, action) +
+			htmlLink(p.PullRequest.HTMLURL, fmt.Sprintf("#%d %s", p.PullRequest.Number, p.PullRequest.Title)), nil
+	case event == "issue_comment" && p.Issue != nil && p.Comment != nil:
+		return repo + escapef(": %s commented ", p.Sender.Login) +
+			htmlLink(p.Comment.HTMLURL, fmt.Sprintf("#%d %s", p.Issue.Number, p.Issue.Title)) +
+			"\n" + escapef("%s", firstLine(p.Comment.Body)), nil
+	case event == "issues" && p.Issue != nil:
+		return repo + escapef(": %s %s issue ", p.Sender.Login, p.Action) +
+			htmlLink(p.Issue.HTMLURL, fmt.Sprintf("#%d %s", p.Issue.Number, p.Issue.Title)), nil
+	case event == "release" && p.Release != nil:
+		name := p.Release.Name
+		if name == "" {
+			name = p.Release.TagName
+		}
+		return repo + escapef(": release %s ", p.Action) + htmlLink(p.Release.HTMLURL, name), nil
+	case event == "workflow_run" && p.WorkflowRun != nil:
+		if p.Action != "completed" {
+			return "", nil
+		}
+		icon := "✅"
+		if p.WorkflowRun.Conclusion != "success" {
+			icon = "❌"
+		}
+		return icon + " " + repo + ": " + htmlLink(p.WorkflowRun.HTMLURL, p.WorkflowRun.Name) +
+			escapef(" %s on %s", p.WorkflowRun.Conclusion, p.WorkflowRun.HeadBranch), nil
+	}
+
+	if event == "" {
+		return "", errors.Errorf("X-GitHub-Event header isn't set")
+	}
+	text := repo + escapef(": %s", event)
+	if p.Action != "" {
+		text += escapef(" %s", p.Action)
+	}
+	if p.Sender.Login != "" {
+		text += escapef(" by %s", p.Sender.Login)
+	}
+	return text, nil
+}
@@ -0,0 +1,113 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GitlabAdapter renders GitLab webhook events, notify token should be set as secret token of webhook
+type GitlabAdapter struct{}
+
+type gitlabPayload struct {
+	ObjectKind string `json:"object_kind"`
+	Ref        string `json:"ref"`
+	UserName   string `json:"user_name"`
+	User       struct {
+		Name string `json:"name"`
+	} `json:"user"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+	TotalCommitsCount int `json:"total_commits_count"`
+	Commits           []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		URL     string `json:"url"`
+		Author  struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commits"`
+	ObjectAttributes struct {
+		ID     int    `json:"id"`
+		IID    int    `json:"iid"`
+		Title  string `json:"title"`
+		URL    string `json:"url"`
+		Action string `json:"action"`
+		Status string `json:"status"`
+		Ref    string `json:"ref"`
+		Note   string `json:"note"`
+	} `json:"object_attributes"`
+}
+
+func (a *GitlabAdapter) Name() string {
+	return "gitlab"
+}
+
+func (p *gitlabPayload) userName() string {
+	if p.UserName != "" {
+		return p.UserName
+	}
+	return p.User.Name
+}
+
+func (a *GitlabAdapter) Render(r *http.Request, body []byte, _ string) (string, error) {
+	p := gitlabPayload{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return "", errors.Errorf("can't parse payload")
+	}
+	project := "<b>" + htmlLink(p.Project.WebURL, p.Project.PathWithNamespace) + "</b>"
+	attrs := p.ObjectAttributes
+
+	switch p.ObjectKind {
+	case "push", "tag_push":
+		ref := strings.TrimPrefix(strings.TrimPrefix(p.Ref, "refs/heads/"), "refs/tags/")
+		lines := []string{project + escapef(": %s pushed %s to %s", p.userName(),
+			fmt.Sprintf("%d commits", p.TotalCommitsCount), ref)}
+		for i, c := range p.Commits {
+			if i == maxListedCommits {
+				lines = append(lines, fmt.Sprintf("… and %d more", p.TotalCommitsCount-maxListedCommits))
+				break
+			}
+			sha := c.ID
+			if len(sha) > 8 {
+				sha = sha[:8]
+			}
+			lines = append(lines, "<code>"+htmlLink(c.URL, sha)+"</code> "+escapef("%s (%s)", firstLine(c.Message), c.Author.Name))
+		}
+		return strings.Join(lines, "\n"), nil
+	case "merge_request":
+		return project + escapef(": %s %s merge request ", p.userName(), attrs.Action) +
+			htmlLink(attrs.URL, fmt.Sprintf("!%d %s", attrs.IID, attrs.Title)), nil
+	case "issue":
+		return project + escapef(": %s %s issue ", p.userName(), attrs.Action) +
+			htmlLink(attrs.URL, fmt.Sprintf("#%d %s", attrs.IID, attrs.Title)), nil
+	case "note":
+		return project + escapef(": %s ", p.userName()) + htmlLink(attrs.URL, "commented") +
+			"\n" + escapef("%s", firstLine(attrs.Note)), nil
+	case "pipeline":
+		icon := ""
+		switch attrs.Status {
+		case "success":
+			icon = "✅ "
+		case "failed":
+			icon = "❌ "
+		case "running", "pending", "created":
+			// notify only about finished pipelines
+			return "", nil
+		}
+		pipelineURL := ""
+		if p.Project.WebURL != "" {
+			pipelineURL = fmt.Sprintf("%s/-/pipelines/%d", p.Project.WebURL, attrs.ID)
+		}
+		return icon + project + ": " + htmlLink(pipelineURL, fmt.Sprintf("pipeline #%d", attrs.ID)) +
+			escapef(" %s on %s", attrs.Status, attrs.Ref), nil
+	case "":
+		return "", errors.Errorf("object_kind isn't set")
+	}
+	return project + escapef(": %s by %s", p.ObjectKind, p.userName()), nil
+}
@@ -0,0 +1,159 @@
+package plugin
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit is token bucket parameters, zero PerMinute disables limit
+type RateLimit struct {
+	Burst     int
+	PerMinute float64
+}
+
+// NotifierLimits restricts how often notifications may be sent
+type NotifierLimits struct {
+	Token RateLimit
+	Chat  RateLimit
+	// DailyQuota is max number of requests per token per UTC day, zero means unlimited.
+	// It's counted in NotifierStore to survive restarts.
+	DailyQuota int
+}
+
+// limiterSweepInterval is how often buckets which aren't used anymore are removed
+const limiterSweepInterval = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// notifierLimiter keeps state of rate limits in memory, it's reset on restart
+type notifierLimiter struct {
+	limits NotifierLimits
+
+	mtx       sync.Mutex
+	tokens    map[string]*tokenBucket
+	chats     map[int64]*tokenBucket
+	lastSweep time.Time
+}
+
+func newNotifierLimiter(limits NotifierLimits) *notifierLimiter {
+	return &notifierLimiter{
+		limits: limits,
+		tokens: map[string]*tokenBucket{},
+		chats:  map[int64]*tokenBucket{},
+	}
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// refill returns bucket with tokens accumulated since last request
+func (l RateLimit) refill(b *tokenBucket, now time.Time) *tokenBucket {
+	if b == nil {
+		return &tokenBucket{tokens: l.burst(), last: now}
+	}
+	elapsed := now.Sub(b.last).Minutes()
+	if elapsed > 0 {
+		b.tokens = math.Min(l.burst(), b.tokens+elapsed*l.PerMinute)
+		b.last = now
+	}
+	return b
+}
+
+// full checks that bucket is refilled completely, such bucket is the same as new one
+func (l RateLimit) full(b *tokenBucket, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Minutes()*l.PerMinute >= l.burst()
+}
+
+// wait returns time until bucket has one token
+func (l RateLimit) wait(b *tokenBucket) time.Duration {
+	if l.PerMinute <= 0 || b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.PerMinute * float64(time.Minute))
+}
+
+func dayKey(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+// untilNextDay returns time until daily quota is reset
+func untilNextDay(now time.Time) time.Duration {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
+
+// sweep removes full buckets, so maps don't grow with tokens and chats which don't send requests anymore
+func (lim *notifierLimiter) sweep(now time.Time) {
+	if now.Sub(lim.lastSweep) < limiterSweepInterval {
+		return
+	}
+	lim.lastSweep = now
+	for key, b := range lim.tokens {
+		if lim.limits.Token.full(b, now) {
+			delete(lim.tokens, key)
+		}
+	}
+	for chatID, b := range lim.chats {
+		if lim.limits.Chat.full(b, now) {
+			delete(lim.chats, chatID)
+		}
+	}
+}
+
+// allow takes one request from token and chat limits, if request isn't allowed it returns time to retry after
+func (lim *notifierLimiter) allow(tokenKey string, chatID int64, now time.Time) (time.Duration, bool) {
+	lim.mtx.Lock()
+	defer lim.mtx.Unlock()
+	lim.sweep(now)
+
+	var tokenBkt, chatBkt *tokenBucket
+	var retryAfter time.Duration
+	if lim.limits.Token.PerMinute > 0 {
+		tokenBkt = lim.limits.Token.refill(lim.tokens[tokenKey], now)
+		lim.tokens[tokenKey] = tokenBkt
+		retryAfter = lim.limits.Token.wait(tokenBkt)
+	}
+	if lim.limits.Chat.PerMinute > 0 {
+		chatBkt = lim.limits.Chat.refill(lim.chats[chatID], now)
+		lim.chats[chatID] = chatBkt
+		if wait := lim.limits.Chat.wait(chatBkt); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, false
+	}
+
+	if tokenBkt != nil {
+		tokenBkt.tokens--
+	}
+	if chatBkt != nil {
+		chatBkt.tokens--
+	}
+	return 0, true
+}
+
+// available returns number of requests token may do now without taking request
+func (lim *notifierLimiter) available(tokenKey string, now time.Time) int {
+	lim.mtx.Lock()
+	defer lim.mtx.Unlock()
+
+	if b, ok := lim.tokens[tokenKey]; ok {
+		return int(lim.limits.Token.refill(b, now).tokens)
+	}
+	return int(lim.limits.Token.burst())
+}
+
+// retryAfterHeader formats duration as value of Retry-After header in seconds
+func retryAfterHeader(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
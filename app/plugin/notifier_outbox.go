@@ -0,0 +1,173 @@
+package plugin
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/vdimir/tg-tobym/app/common"
+)
+
+const (
+	outboxCheckInterval = 5 * time.Second
+	outboxMaxAttempts   = 10
+	outboxMaxBackoff    = time.Hour
+	// delivered and failed notifications are kept to check status
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// outboxStatus is response of async notification status
+type outboxStatus struct {
+	DeliveryID string `json:"delivery_id"`
+	Status     string `json:"status"`
+	Attempts   int    `json:"attempts"`
+	MessageID  int    `json:"message_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func newOutboxStatus(item *outboxItem) outboxStatus {
+	return outboxStatus{
+		DeliveryID: item.ID,
+		Status:     item.Status,
+		Attempts:   item.Attempts,
+		MessageID:  item.MessageID,
+		Error:      item.Error,
+	}
+}
+
+func isAsyncRequest(r *http.Request) bool {
+	switch r.URL.Query().Get("async") {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// outboxBackoff returns delay before next delivery attempt
+func outboxBackoff(attempts int) time.Duration {
+	delay := 10 * time.Second << uint(attempts)
+	if delay > outboxMaxBackoff || delay <= 0 {
+		return outboxMaxBackoff
+	}
+	return delay
+}
+
+// isPermanentError checks that request is rejected by Telegram and retry doesn't help
+func isPermanentError(err error) bool {
+	if tgErr, ok := errors.Cause(err).(tgbotapi.Error); ok {
+		return tgErr.Code >= 400 && tgErr.Code < 500 && tgErr.Code != http.StatusTooManyRequests
+	}
+	return false
+}
+
+// enqueue saves notification to outbox and wakes up delivery loop
+func (sapp *NotifierApp) enqueue(w http.ResponseWriter, r *http.Request, token string, tok *chatToken, req *notifyRequest) {
+	item, err := sapp.Store.AddOutbox(token, tok.ChatID, tok.CreatorID, req)
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, common.JSON{"error": "can't save message", "verbose": err.Error()})
+		return
+	}
+	select {
+	case sapp.outboxWake <- struct{}{}:
+	default:
+	}
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, newOutboxStatus(item))
+}
+
+func (sapp *NotifierApp) handleStatus(w http.ResponseWriter, r *http.Request) {
+	// status request doesn't send anything, so it isn't counted to limits
+	token := bearerToken(r)
+	if _, ok := sapp.checkToken(w, r, token, TokenScopeText); !ok {
+		return
+	}
+	item, err := sapp.Store.OutboxItem(token, chi.URLParam(r, "deliveryID"))
+	if err == storm.ErrNotFound {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, common.JSON{"error": "delivery isn't found"})
+		return
+	}
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, common.JSON{"error": "can't get delivery", "verbose": err.Error()})
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, newOutboxStatus(item))
+}
+
+// runOutbox delivers queued notifications with bot until notifier is closed
+func (sapp *NotifierApp) runOutbox(bot *tgbotapi.BotAPI) {
+	defer close(sapp.loopDone)
+	ticker := time.NewTicker(outboxCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		sapp.deliverDue(bot, time.Now())
+		select {
+		case <-sapp.closeNotifier:
+			return
+		case <-sapp.outboxWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (sapp *NotifierApp) deliverDue(bot *tgbotapi.BotAPI, now time.Time) {
+	items, err := sapp.Store.DueOutbox(now)
+	if err != nil {
+		log.Printf("[ERROR] cannot get outbox: %v", err)
+		return
+	}
+	for i := range items {
+		select {
+		case <-sapp.closeNotifier:
+			return
+		default:
+		}
+		sapp.deliver(bot, &items[i], now)
+		if err := sapp.Store.UpdateOutbox(&items[i]); err != nil {
+			log.Printf("[ERROR] cannot update outbox item %s: %v", items[i].ID, err)
+		}
+	}
+	if err := sapp.Store.CleanOutbox(now.Add(-outboxRetention)); err != nil {
+		log.Printf("[WARN] cannot clean outbox: %v", err)
+	}
+}
+
+// deliver sends notification and updates its status
+func (sapp *NotifierApp) deliver(bot *tgbotapi.BotAPI, item *outboxItem, now time.Time) {
+	if sapp.Allowed != nil && !sapp.Allowed(item.ChatID, item.CreatorID) {
+		// chat or token creator is denied after notification is queued
+		log.Printf("[INFO] drop outbox item %s of denied chat %d", item.ID, item.ChatID)
+		item.Status, item.Error = OutboxFailed, "chat or user is denied"
+		return
+	}
+	item.Attempts++
+	msg, err := item.Request.message(item.ChatID)
+	if err == nil {
+		var sent tgbotapi.Message
+		sent, err = bot.Send(msg)
+		if err == nil {
+			item.Status, item.MessageID, item.Error = OutboxSent, sent.MessageID, ""
+			if err := sapp.Store.saveSentMessage(item.Token, item.ChatID, sent.MessageID); err != nil {
+				log.Printf("[WARN] cannot save sent message: %v", err)
+			}
+			return
+		}
+	}
+
+	item.Error = err.Error()
+	if isPermanentError(err) || item.Attempts >= outboxMaxAttempts {
+		log.Printf("[WARN] outbox item %s failed: %v", item.ID, err)
+		item.Status = OutboxFailed
+		return
+	}
+	item.NextAttempt = now.Add(outboxBackoff(item.Attempts)).Unix()
+}
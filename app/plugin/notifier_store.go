@@ -1,28 +1,223 @@
 package plugin
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+
 	"github.com/asdine/storm/v3"
 	"github.com/asdine/storm/v3/q"
 	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
 )
 
+// NotifierStore keeps only keyed hashes of tokens, so data file doesn't contain working credentials
 type NotifierStore struct {
 	Bkt storm.Node
+	// Secret is key for token hashes, changing it invalidates all tokens. Random secret is generated if it isn't set.
+	Secret []byte
+}
+
+const notifierSecretID = "token_secret"
+
+// notifierSecret identifies key tokens are hashed with
+type notifierSecret struct {
+	ID string `storm:"id"`
+	// Secret is saved only if it's generated
+	Secret      []byte
+	Fingerprint string
 }
 
+// Token scopes restrict what token can do, token without scopes (created before scopes were introduced) can do anything
+const (
+	TokenScopeText  = "text"
+	TokenScopeFiles = "files"
+	TokenScopeEdit  = "edit"
+)
+
+// AllTokenScopes are granted to new token by default
+var AllTokenScopes = []string{TokenScopeText, TokenScopeFiles, TokenScopeEdit}
+
 type chatToken struct {
+	// Token is hash of token, raw token before migration if Hashed isn't set
 	Token  string `storm:"id"`
+	Hashed bool
+	// Hint is masked token to show it to user
+	Hint   string
 	ChatID int64
+	// CreatorID is user created token, it's zero for tokens created before it was added
+	CreatorID int
+	Label     string
+	Scopes    []string
+	// CreatedAt, ExpiresAt and LastUsedAt are unix timestamps, zero ExpiresAt means token never expires
+	CreatedAt  int64
+	ExpiresAt  int64
+	LastUsedAt int64
+	UseCount   int
+	// DayCount is number of requests in UsageDay, it's used to enforce daily quota
+	UsageDay string
+	DayCount int
+	// Template renders JSON posted with token to message text
+	Template string
+	// WebhookSecret is key of webhook payload signatures, it's kept as is because it's needed to verify them.
+	// Tokens created before it was added have no secret.
+	WebhookSecret string
+}
+
+// HasScope checks that token is allowed to do action
+func (t *chatToken) HasScope(scope string) bool {
+	if len(t.Scopes) == 0 {
+		return true
+	}
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
 }
 
-func (s *NotifierStore) SaveToken(chatID int64, token string) error {
+func (t *chatToken) expired(now time.Time) bool {
+	return t.ExpiresAt != 0 && now.Unix() >= t.ExpiresAt
+}
+
+// dailyUsed returns number of requests made with token in day of now
+func (t *chatToken) dailyUsed(now time.Time) int {
+	if t.UsageDay != dayKey(now) {
+		return 0
+	}
+	return t.DayCount
+}
+
+// maskToken hides most of token to show it in chat
+func maskToken(token string) string {
+	if len(token) <= 8 {
+		return strings.Repeat("*", len(token))
+	}
+	return token[:4] + "…" + token[len(token)-4:]
+}
+
+func (s *NotifierStore) hashToken(token string) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	_, _ = mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *NotifierStore) secretFingerprint() string {
+	return s.hashToken(notifierSecretID)
+}
+
+// InitSecret loads generated secret or generates new one if secret isn't set.
+// Set secret is checked to be the same as one tokens were hashed with.
+func (s *NotifierStore) InitSecret() error {
+	stored := &notifierSecret{}
+	err := s.Bkt.One("ID", notifierSecretID, stored)
+	if err != nil && err != storm.ErrNotFound {
+		return errors.Wrapf(err, "cannot load notifier secret")
+	}
+	found := err == nil
+
+	if len(s.Secret) == 0 && found && len(stored.Secret) > 0 {
+		s.Secret = stored.Secret
+		return nil
+	}
+	generated := len(s.Secret) == 0
+	if generated {
+		s.Secret = make([]byte, 32)
+		if _, err := rand.Read(s.Secret); err != nil {
+			return errors.Wrapf(err, "cannot generate notifier secret")
+		}
+		log.Printf("[INFO] notifier secret isn't set, random one is generated")
+	}
+	fingerprint := s.secretFingerprint()
+	if found && stored.Fingerprint == fingerprint {
+		return nil
+	}
+	if found && stored.Fingerprint != "" {
+		// only tokens hashed with previous secret are broken, plaintext ones are migrated with current one
+		tokens, err := s.Bkt.Select(q.Eq("Hashed", true)).Count(&chatToken{})
+		if err != nil && err != storm.ErrNotFound {
+			return errors.Wrapf(err, "cannot count tokens")
+		}
+		if tokens > 0 {
+			log.Printf("[WARN] notifier secret is changed, %d tokens hashed with previous secret don't work anymore", tokens)
+		}
+	}
+
+	stored = &notifierSecret{ID: notifierSecretID, Fingerprint: fingerprint}
+	if generated {
+		stored.Secret = s.Secret
+	}
+	return errors.Wrapf(s.Bkt.Save(stored), "cannot save notifier secret")
+}
+
+// MigrateTokens replaces plaintext tokens saved by previous versions with hashes
+func (s *NotifierStore) MigrateTokens() error {
+	var tokens []chatToken
+	err := s.Bkt.Select(q.Eq("Hashed", false)).Find(&tokens)
+	if err != nil && err != storm.ErrNotFound {
+		return errors.Wrapf(err, "cannot load tokens")
+	}
+	for _, tok := range tokens {
+		rawToken := tok.Token
+		tok.Token, tok.Hashed, tok.Hint = s.hashToken(rawToken), true, maskToken(rawToken)
+		if err := s.Bkt.Save(&tok); err != nil {
+			return errors.Wrapf(err, "cannot save hashed token")
+		}
+		if err := s.Bkt.DeleteStruct(&chatToken{Token: rawToken}); err != nil {
+			return errors.Wrapf(err, "cannot remove plaintext token")
+		}
+	}
+
+	var msgs []sentMessage
+	err = s.Bkt.Select(q.Eq("Hashed", false)).Find(&msgs)
+	if err != nil && err != storm.ErrNotFound {
+		return errors.Wrapf(err, "cannot load sent messages")
+	}
+	for _, msg := range msgs {
+		msg.Token, msg.Hashed = s.hashToken(msg.Token), true
+		if err := s.Bkt.Save(&msg); err != nil {
+			return errors.Wrapf(err, "cannot save sent message")
+		}
+	}
+	if len(tokens) > 0 || len(msgs) > 0 {
+		log.Printf("[INFO] %d notifier tokens and %d sent messages migrated to hashed tokens", len(tokens), len(msgs))
+	}
+	return nil
+}
+
+// SaveToken saves new token, nil scopes grant all permissions and zero expiresAt means token never expires
+func (s *NotifierStore) SaveToken(chatID int64, creatorID int, token string, label string, scopes []string, expiresAt time.Time) error {
 	if token == "" {
 		return errors.Errorf("empty token")
 	}
-	err := s.Bkt.Save(&chatToken{Token: token, ChatID: chatID})
-	return err
+	webhookSecret := make([]byte, 20)
+	if _, err := rand.Read(webhookSecret); err != nil {
+		return errors.Wrapf(err, "cannot generate webhook secret")
+	}
+	data := &chatToken{
+		Token:     s.hashToken(token),
+		Hashed:    true,
+		Hint:      maskToken(token),
+		ChatID:    chatID,
+		CreatorID: creatorID,
+		Label:     label,
+		Scopes:    scopes,
+		CreatedAt: time.Now().Unix(),
+
+		WebhookSecret: hex.EncodeToString(webhookSecret),
+	}
+	if !expiresAt.IsZero() {
+		data.ExpiresAt = expiresAt.Unix()
+	}
+	return s.Bkt.Save(data)
 }
 
+// RemoveTokens revokes token by value or label, empty token means all chat tokens
 func (s *NotifierStore) RemoveTokens(chatID int64, token string) (int, error) {
 	if token == "" {
 		err := s.Bkt.Select(q.Eq("ChatID", chatID)).Delete(&chatToken{})
@@ -32,22 +227,227 @@ func (s *NotifierStore) RemoveTokens(chatID int64, token string) (int, error) {
 		// do not count number of deleted entries actually, say "more than one"
 		return 2, err
 	}
-	err := s.Bkt.DeleteStruct(&chatToken{Token: token, ChatID: chatID})
+
+	tx, err := s.Bkt.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	tok := &chatToken{}
+	err = tx.Select(q.Eq("ChatID", chatID), q.Eq("Label", token)).First(tok)
 	if err == storm.ErrNotFound {
+		err = tx.One("Token", s.hashToken(token), tok)
+	}
+	if err == storm.ErrNotFound || (err == nil && tok.ChatID != chatID) {
 		return 0, nil
 	}
-	return 1, err
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.DeleteStruct(tok); err != nil {
+		return 0, err
+	}
+	return 1, tx.Commit()
 }
 
-func (s *NotifierStore) FindToken(token string) int64 {
+// ChatTokens returns all tokens of chat
+func (s *NotifierStore) ChatTokens(chatID int64) ([]chatToken, error) {
+	var tokens []chatToken
+	err := s.Bkt.Select(q.Eq("ChatID", chatID)).Find(&tokens)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return tokens, err
+}
+
+// TokensCount returns number of tokens of all chats
+func (s *NotifierStore) TokensCount() (int, error) {
+	return s.Bkt.Count(&chatToken{})
+}
+
+// SetTemplate sets template of chat token with label, empty template removes it. Nil is returned if token isn't found.
+func (s *NotifierStore) SetTemplate(chatID int64, label string, tmpl string) (*chatToken, error) {
+	tok := &chatToken{}
+	err := s.Bkt.Select(q.Eq("ChatID", chatID), q.Eq("Label", label)).First(tok)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tok.Template = tmpl
+	return tok, s.Bkt.UpdateField(tok, "Template", tmpl)
+}
+
+// HasLabel checks that chat has token with label
+func (s *NotifierStore) HasLabel(chatID int64, label string) (bool, error) {
+	err := s.Bkt.Select(q.Eq("ChatID", chatID), q.Eq("Label", label)).First(&chatToken{})
+	if err == storm.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// FindToken returns token info or nil if token isn't found or expired
+func (s *NotifierStore) FindToken(token string) *chatToken {
 	if token == "" {
-		return 0
+		return nil
 	}
 
+	tokenHash := s.hashToken(token)
 	res := &chatToken{}
-	err := s.Bkt.One("Token", token, res)
+	err := s.Bkt.One("Token", tokenHash, res)
+	// lookup is done by hash, so its timing doesn't depend on token itself, compare in constant time anyway
+	if err != nil || !res.Hashed || !hmac.Equal([]byte(res.Token), []byte(tokenHash)) {
+		return nil
+	}
+	if res.ChatID == 0 || res.expired(time.Now()) {
+		return nil
+	}
+	return res
+}
+
+// UseToken counts request made with token, it returns false and doesn't count request if daily quota is exceeded.
+// Counters are updated in transaction to not lose concurrent requests, zero quota means unlimited.
+func (s *NotifierStore) UseToken(tok *chatToken, now time.Time, dailyQuota int) (bool, error) {
+	tx, err := s.Bkt.Begin(true)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	stored := &chatToken{}
+	if err := tx.One("Token", tok.Token, stored); err != nil {
+		return false, err
+	}
+	if dailyQuota > 0 && stored.dailyUsed(now) >= dailyQuota {
+		return false, nil
+	}
+	stored.DayCount = stored.dailyUsed(now) + 1
+	stored.UsageDay = dayKey(now)
+	stored.UseCount++
+	stored.LastUsedAt = now.Unix()
+	if err := tx.Save(stored); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	*tok = *stored
+	return true, nil
+}
+
+// sentMessage is message sent by token, only it can edit or delete the message
+type sentMessage struct {
+	ID MsgChatID `storm:"id"`
+	// Token is hash of token, it was raw token before migration if Hashed isn't set
+	Token  string `storm:"index"`
+	Hashed bool
+}
+
+func (s *NotifierStore) SaveSentMessage(token string, chatID int64, messageID int) error {
+	return s.saveSentMessage(s.hashToken(token), chatID, messageID)
+}
+
+func (s *NotifierStore) saveSentMessage(tokenHash string, chatID int64, messageID int) error {
+	return s.Bkt.Save(&sentMessage{
+		ID:     MsgChatID{MessageID: messageID, ChatID: chatID},
+		Token:  tokenHash,
+		Hashed: true,
+	})
+}
+
+func (s *NotifierStore) IsSentWithToken(token string, chatID int64, messageID int) bool {
+	res := &sentMessage{}
+	err := s.Bkt.One("ID", MsgChatID{MessageID: messageID, ChatID: chatID}, res)
+	return err == nil && hmac.Equal([]byte(res.Token), []byte(s.hashToken(token)))
+}
+
+func (s *NotifierStore) RemoveSentMessage(chatID int64, messageID int) error {
+	err := s.Bkt.DeleteStruct(&sentMessage{ID: MsgChatID{MessageID: messageID, ChatID: chatID}})
 	if err == storm.ErrNotFound {
-		return 0
+		return nil
+	}
+	return err
+}
+
+// Delivery statuses of outbox items
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+)
+
+// outboxItem is notification accepted to be delivered asynchronously
+type outboxItem struct {
+	ID string `storm:"id"`
+	// Token is hash of token which created notification
+	Token  string
+	ChatID int64
+	// CreatorID is creator of token, it's checked on delivery like on request
+	CreatorID int
+	Request   notifyRequest
+	Status    string `storm:"index"`
+	// NextAttempt is unix timestamp of next delivery attempt of pending item
+	NextAttempt int64
+	Attempts    int
+	MessageID   int
+	Error       string
+	CreatedAt   int64
+	UpdatedAt   int64
+}
+
+// AddOutbox saves notification to deliver it later
+func (s *NotifierStore) AddOutbox(token string, chatID int64, creatorID int, req *notifyRequest) (*outboxItem, error) {
+	now := time.Now().Unix()
+	item := &outboxItem{
+		ID:          uuid.NewV4().String(),
+		Token:       s.hashToken(token),
+		ChatID:      chatID,
+		CreatorID:   creatorID,
+		Request:     *req,
+		Status:      OutboxPending,
+		NextAttempt: now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}
-	return res.ChatID
+	return item, s.Bkt.Save(item)
+}
+
+// OutboxItem returns notification if it was created by token
+func (s *NotifierStore) OutboxItem(token string, id string) (*outboxItem, error) {
+	item := &outboxItem{}
+	if err := s.Bkt.One("ID", id, item); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(item.Token), []byte(s.hashToken(token))) {
+		return nil, storm.ErrNotFound
+	}
+	return item, nil
+}
+
+// DueOutbox returns pending notifications which should be delivered now
+func (s *NotifierStore) DueOutbox(now time.Time) ([]outboxItem, error) {
+	var items []outboxItem
+	err := s.Bkt.Select(q.Eq("Status", OutboxPending), q.Lte("NextAttempt", now.Unix())).OrderBy("CreatedAt").Find(&items)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return items, err
+}
+
+// UpdateOutbox saves delivery result
+func (s *NotifierStore) UpdateOutbox(item *outboxItem) error {
+	item.UpdatedAt = time.Now().Unix()
+	return s.Bkt.Save(item)
+}
+
+// CleanOutbox removes delivered and failed notifications updated before time
+func (s *NotifierStore) CleanOutbox(before time.Time) error {
+	err := s.Bkt.Select(q.Not(q.Eq("Status", OutboxPending)), q.Lt("UpdatedAt", before.Unix())).Delete(&outboxItem{})
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
 }
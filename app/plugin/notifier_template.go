@@ -0,0 +1,317 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+)
+
+const (
+	maxTemplateSize     = 4096
+	maxTemplateBodySize = 64 << 10
+	// maxTemplateDataDepth limits nesting of JSON rendered with template
+	maxTemplateDataDepth = 32
+	// maxTemplateRangeDepth limits nested loops, so template work is linear to payload size
+	maxTemplateRangeDepth = 1
+	templateTimeout       = time.Second
+)
+
+// errTemplateOutputSize is returned if template output doesn't fit to message
+var errTemplateOutputSize = errors.Errorf("template output is longer than %d characters", maxWebhookTextLen)
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	// orEmpty is appended to printed pipelines, because missing keys and nulls are printed as "<no value>"
+	"orEmpty": func(v interface{}) interface{} {
+		if v == nil {
+			return ""
+		}
+		return v
+	},
+}
+
+// parseNotifyTemplate parses template attached to token
+func parseNotifyTemplate(tmpl string) (*template.Template, error) {
+	if utf8.RuneCountInString(tmpl) > maxTemplateSize {
+		return nil, errors.Errorf("template is longer than %d characters", maxTemplateSize)
+	}
+	t, err := template.New("notify").Funcs(templateFuncs).Option("missingkey=zero").Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	if t.Tree != nil {
+		if err := checkRangeDepth(t, t.Tree.Root, 0, nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, tt := range t.Templates() {
+		if tt.Tree != nil {
+			printEmptyValues(tt.Tree.Root)
+		}
+	}
+	return t, nil
+}
+
+// checkRangeDepth checks that loops of template, including ones of invoked templates, aren't nested too deep.
+// Recursive templates are rejected, because they are unbounded loops as well.
+func checkRangeDepth(t *template.Template, node parse.Node, depth int, invoked []string) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := checkRangeDepth(t, child, depth, invoked); err != nil {
+				return err
+			}
+		}
+	case *parse.IfNode:
+		return checkBranchRangeDepth(t, &n.BranchNode, depth, invoked)
+	case *parse.WithNode:
+		return checkBranchRangeDepth(t, &n.BranchNode, depth, invoked)
+	case *parse.RangeNode:
+		if depth >= maxTemplateRangeDepth {
+			return errors.Errorf("nested range isn't allowed")
+		}
+		return checkBranchRangeDepth(t, &n.BranchNode, depth+1, invoked)
+	case *parse.TemplateNode:
+		for _, name := range invoked {
+			if name == n.Name {
+				return errors.Errorf("recursive template %q isn't allowed", n.Name)
+			}
+		}
+		tt := t.Lookup(n.Name)
+		if tt == nil || tt.Tree == nil {
+			return nil
+		}
+		return checkRangeDepth(t, tt.Tree.Root, depth, append(invoked, n.Name))
+	}
+	return nil
+}
+
+func checkBranchRangeDepth(t *template.Template, n *parse.BranchNode, depth int, invoked []string) error {
+	if err := checkRangeDepth(t, n.List, depth, invoked); err != nil {
+		return err
+	}
+	return checkRangeDepth(t, n.ElseList, depth, invoked)
+}
+
+// dataDepth returns nesting depth of decoded JSON
+func dataDepth(data interface{}) int {
+	depth := 0
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for _, item := range v {
+			if d := dataDepth(item); d > depth {
+				depth = d
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if d := dataDepth(item); d > depth {
+				depth = d
+			}
+		}
+	default:
+		return 0
+	}
+	return depth + 1
+}
+
+// printEmptyValues appends orEmpty to pipelines printed by actions of template tree
+func printEmptyValues(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			printEmptyValues(child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) == 0 {
+			n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Pos:      n.Pos,
+				Args:     []parse.Node{parse.NewIdentifier("orEmpty").SetPos(n.Pos)},
+			})
+		}
+	case *parse.IfNode:
+		printEmptyValues(n.List)
+		printEmptyValues(n.ElseList)
+	case *parse.RangeNode:
+		printEmptyValues(n.List)
+		printEmptyValues(n.ElseList)
+	case *parse.WithNode:
+		printEmptyValues(n.List)
+		printEmptyValues(n.ElseList)
+	}
+}
+
+// limitedBuffer fails write if output exceeds limit of characters or deadline is passed, it stops template execution
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int
+	deadline time.Time
+	runes    int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if time.Now().After(b.deadline) {
+		return 0, errors.Errorf("template execution timeout")
+	}
+	if b.runes += utf8.RuneCount(p); b.runes > b.limit {
+		return 0, errTemplateOutputSize
+	}
+	return b.Buffer.Write(p)
+}
+
+// executeNotifyTemplate renders JSON payload, panic in template is returned as error.
+// Template can't be canceled, so it's executed in goroutine which is abandoned after templateTimeout.
+// Work of abandoned template is bounded anyway: loops aren't nested, payload size and depth are limited
+// and execution is stopped on next output after deadline.
+func executeNotifyTemplate(t *template.Template, payload []byte) (string, error) {
+	if len(payload) > maxTemplateBodySize {
+		return "", errors.Errorf("json is larger than %d bytes", maxTemplateBodySize)
+	}
+	var data interface{}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return "", errors.Errorf("can't parse json")
+	}
+	if dataDepth(data) > maxTemplateDataDepth {
+		return "", errors.Errorf("json is nested deeper than %d levels", maxTemplateDataDepth)
+	}
+
+	type result struct {
+		text string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{err: errors.Errorf("template panic: %v", r)}
+			}
+		}()
+		buf := &limitedBuffer{limit: maxWebhookTextLen, deadline: time.Now().Add(templateTimeout)}
+		if err := t.Execute(buf, data); err != nil {
+			done <- result{err: err}
+			return
+		}
+		done <- result{text: strings.TrimSpace(buf.String())}
+	}()
+
+	timer := time.NewTimer(templateTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.text, res.err
+	case <-timer.C:
+		return "", errors.Errorf("template execution timeout")
+	}
+}
+
+// cachedTemplate is parsed template of token, source is kept to detect changes of stored template
+type cachedTemplate struct {
+	source string
+	tmpl   *template.Template
+}
+
+// templateCache keeps parsed templates by token hash
+type templateCache struct {
+	mtx       sync.Mutex
+	templates map[string]cachedTemplate
+}
+
+// set caches template parsed on saving
+func (c *templateCache) set(tok *chatToken, tmpl *template.Template) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if tok.Template == "" {
+		delete(c.templates, tok.Token)
+		return
+	}
+	if c.templates == nil {
+		c.templates = map[string]cachedTemplate{}
+	}
+	c.templates[tok.Token] = cachedTemplate{source: tok.Template, tmpl: tmpl}
+}
+
+// get returns parsed template of token, it's parsed only if it isn't cached yet, e.g. after restart
+func (c *templateCache) get(tok *chatToken) (*template.Template, error) {
+	if tok.Template == "" {
+		return nil, nil
+	}
+	c.mtx.Lock()
+	cached, ok := c.templates[tok.Token]
+	c.mtx.Unlock()
+	if ok && cached.source == tok.Template {
+		return cached.tmpl, nil
+	}
+	tmpl, err := parseNotifyTemplate(tok.Template)
+	if err != nil {
+		return nil, err
+	}
+	c.set(tok, tmpl)
+	return tmpl, nil
+}
+
+// parseTemplateArgs parses `template <label>` followed by template body on the same or next lines,
+// parsed template is nil if body is empty
+func parseTemplateArgs(args string) (label string, tmpl string, parsed *template.Template, err error) {
+	args = strings.TrimLeft(strings.TrimPrefix(args, "template"), " \t")
+	fields := strings.Fields(args)
+	if len(fields) == 0 || strings.HasPrefix(args, "\n") {
+		return "", "", nil, errors.Errorf("token label isn't set")
+	}
+	label = fields[0]
+	tmpl = strings.TrimSpace(args[len(label):])
+	if tmpl != "" {
+		if parsed, err = parseNotifyTemplate(tmpl); err != nil {
+			return "", "", nil, err
+		}
+	}
+	return label, tmpl, parsed, nil
+}
+
+// readTemplateRequest renders JSON body with token template to message
+func readTemplateRequest(w http.ResponseWriter, r *http.Request, tmpl *template.Template) (*notifyRequest, int, string) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxTemplateBodySize))
+	if err != nil {
+		return nil, http.StatusBadRequest, "can't read body"
+	}
+	text, err := executeNotifyTemplate(tmpl, body)
+	if errors.Cause(err) == errTemplateOutputSize {
+		// output isn't truncated, because it may break html or markdown markup
+		return nil, http.StatusRequestEntityTooLarge, err.Error()
+	}
+	if err != nil {
+		return nil, http.StatusUnprocessableEntity, fmt.Sprintf("template error: %v", err)
+	}
+	if text == "" {
+		return nil, http.StatusUnprocessableEntity, "template result is empty"
+	}
+
+	req := &notifyRequest{Text: text, ParseMode: chi.URLParam(r, "parseMode")}
+	if req.ParseMode == "" {
+		req.ParseMode = r.URL.Query().Get("parse_mode")
+	}
+	return req, http.StatusOK, ""
+}
@@ -0,0 +1,398 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTokenOptions(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	opts, err := parseTokenOptions("", now)
+	require.NoError(t, err)
+	assert.Equal(t, "", opts.Label)
+	assert.Equal(t, AllTokenScopes, opts.Scopes)
+	assert.True(t, opts.ExpiresAt.IsZero())
+
+	opts, err = parseTokenOptions("ci scope=text,files expires=30d", now)
+	require.NoError(t, err)
+	assert.Equal(t, "ci", opts.Label)
+	assert.Equal(t, []string{TokenScopeText, TokenScopeFiles}, opts.Scopes)
+	assert.Equal(t, now.AddDate(0, 0, 30), opts.ExpiresAt)
+
+	opts, err = parseTokenOptions("expires=12h", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(12*time.Hour), opts.ExpiresAt)
+
+	for _, args := range []string{
+		"scope=text,admin",
+		"expires=soon",
+		"expires=-1d",
+		"ci deploy",
+	} {
+		_, err = parseTokenOptions(args, now)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestMaskToken(t *testing.T) {
+	assert.Equal(t, "abcd…wxyz", maskToken("abcdefghijklmnopqrstuvwxyz"))
+	assert.Equal(t, "******", maskToken("secret"))
+}
+
+func TestNotifierStoreMigrateTokens(t *testing.T) {
+	db, err := storm.Open(filepath.Join(t.TempDir(), "data.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	s := &NotifierStore{Bkt: db.From("notifier"), Secret: []byte("key")}
+	require.NoError(t, s.Bkt.Save(&chatToken{Token: "plaintexttoken", ChatID: 1}))
+	require.NoError(t, s.Bkt.Save(&sentMessage{ID: MsgChatID{MessageID: 42, ChatID: 1}, Token: "plaintexttoken"}))
+	require.NoError(t, s.SaveToken(1, 0, "newtoken", "new", nil, time.Time{}))
+
+	assert.Nil(t, s.FindToken("plaintexttoken"))
+	require.NoError(t, s.MigrateTokens())
+	require.NoError(t, s.MigrateTokens())
+
+	tok := s.FindToken("plaintexttoken")
+	require.NotNil(t, tok)
+	assert.Equal(t, int64(1), tok.ChatID)
+	assert.Equal(t, "plai…oken", tok.Hint)
+	assert.True(t, s.IsSentWithToken("plaintexttoken", 1, 42))
+	assert.NotNil(t, s.FindToken("newtoken"))
+
+	var tokens []chatToken
+	require.NoError(t, s.Bkt.All(&tokens))
+	require.Len(t, tokens, 2)
+	for _, tok := range tokens {
+		assert.NotContains(t, []string{"plaintexttoken", "newtoken"}, tok.Token)
+	}
+
+	other := &NotifierStore{Bkt: s.Bkt, Secret: []byte("other")}
+	assert.Nil(t, other.FindToken("plaintexttoken"))
+}
+
+func TestNotifierLimiter(t *testing.T) {
+	now := time.Date(2020, 5, 1, 23, 59, 0, 0, time.UTC)
+	lim := newNotifierLimiter(NotifierLimits{
+		Token: RateLimit{Burst: 2, PerMinute: 6},
+		Chat:  RateLimit{Burst: 3, PerMinute: 6},
+	})
+
+	for i := 0; i < 2; i++ {
+		_, ok := lim.allow("a", 1, now)
+		require.True(t, ok)
+	}
+	retryAfter, ok := lim.allow("a", 1, now)
+	assert.False(t, ok)
+	assert.Equal(t, 10*time.Second, retryAfter)
+
+	// chat limit is shared between tokens
+	_, ok = lim.allow("b", 1, now)
+	require.True(t, ok)
+	_, ok = lim.allow("b", 1, now)
+	assert.False(t, ok)
+
+	now = now.Add(10 * time.Second)
+	_, ok = lim.allow("a", 1, now)
+	assert.True(t, ok)
+	assert.Equal(t, 0, lim.available("a", now))
+	assert.Equal(t, 2, lim.available("c", now))
+	assert.Len(t, lim.tokens, 2)
+
+	// buckets refilled completely are removed
+	now = now.Add(limiterSweepInterval)
+	_, ok = lim.allow("c", 2, now)
+	assert.True(t, ok)
+	assert.Len(t, lim.tokens, 1)
+	assert.Len(t, lim.chats, 1)
+	assert.Equal(t, 2, lim.available("a", now))
+
+	assert.Equal(t, "2", retryAfterHeader(1500*time.Millisecond))
+	assert.Equal(t, time.Minute, untilNextDay(time.Date(2020, 5, 1, 23, 59, 0, 0, time.UTC)))
+}
+
+func TestNotifyTemplate(t *testing.T) {
+	label, src, tmpl, err := parseTemplateArgs("template sentry\n{{.project}}: {{.message | upper}}")
+	require.NoError(t, err)
+	assert.Equal(t, "sentry", label)
+	assert.Equal(t, "{{.project}}: {{.message | upper}}", src)
+
+	text, err := executeNotifyTemplate(tmpl, []byte(`{"project": "api", "message": "panic"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "api: PANIC", text)
+
+	label, src, tmpl, err = parseTemplateArgs("template sentry")
+	require.NoError(t, err)
+	assert.Equal(t, "sentry", label)
+	assert.Equal(t, "", src)
+	assert.Nil(t, tmpl)
+
+	_, _, _, err = parseTemplateArgs("template\n{{.x}}")
+	assert.Error(t, err)
+	_, _, _, err = parseTemplateArgs("template sentry {{.x")
+	assert.Error(t, err)
+
+	execute := func(src string, payload string) (string, error) {
+		tmpl, err := parseNotifyTemplate(src)
+		require.NoError(t, err)
+		return executeNotifyTemplate(tmpl, []byte(payload))
+	}
+
+	// missing keys and nulls are rendered as empty strings
+	text, err = execute(`{{define "x"}}[{{.b}}]{{end}}{{.a}}-{{.n}}-{{if true}}{{.b}}{{end}}{{template "x" .}}{{$v := .a}}{{$v}}`, `{"n": null}`)
+	require.NoError(t, err)
+	assert.Equal(t, "--[]", text)
+
+	_, err = execute("{{.a.b.c}}", `{"a": 1}`)
+	assert.Error(t, err)
+	_, err = execute("{{index .a 5}}", `{"a": [1]}`)
+	assert.Error(t, err)
+	_, err = execute("{{.a}}", `not json`)
+	assert.Error(t, err)
+
+	// work of template is bounded
+	for _, src := range []string{
+		`{{range .a}}{{range $.a}}{{.}}{{end}}{{end}}`,
+		`{{range .a}}{{if .}}{{with .}}{{range $.a}}{{end}}{{end}}{{end}}{{end}}`,
+		`{{define "x"}}{{range $.a}}{{end}}{{end}}{{range .a}}{{template "x" $}}{{end}}`,
+		`{{define "x"}}{{template "x" .}}{{end}}{{template "x" .}}`,
+	} {
+		_, err = parseNotifyTemplate(src)
+		assert.Error(t, err, src)
+	}
+	text, err = execute(`{{define "x"}}{{.}}{{end}}{{range .a}}{{template "x" .}}{{end}}{{range .a}}{{.}}{{end}}`, `{"a": [1, 2]}`)
+	require.NoError(t, err)
+	assert.Equal(t, "1212", text)
+	_, err = execute(`{{.}}`, strings.Repeat("[", maxTemplateDataDepth+1)+strings.Repeat("]", maxTemplateDataDepth+1))
+	assert.Error(t, err)
+
+	// output isn't truncated, because it may break markup
+	_, err = execute(`{{range .a}}<b>{{.}}</b>{{end}}`, "{\"a\": ["+strings.Repeat(`"abcdefghij",`, 500)+`"x"]}`)
+	assert.Equal(t, errTemplateOutputSize, err)
+}
+
+func TestTemplateCache(t *testing.T) {
+	cache := templateCache{}
+	tok := &chatToken{Token: "hash", Template: "{{.a}}"}
+
+	tmpl, err := cache.get(tok)
+	require.NoError(t, err)
+	require.NotNil(t, tmpl)
+	cached, err := cache.get(tok)
+	require.NoError(t, err)
+	assert.True(t, tmpl == cached, "template is parsed once")
+
+	// template changed in store
+	tok.Template = "{{.b}}"
+	changed, err := cache.get(tok)
+	require.NoError(t, err)
+	assert.False(t, tmpl == changed)
+	text, err := executeNotifyTemplate(changed, []byte(`{"a": 1, "b": 2}`))
+	require.NoError(t, err)
+	assert.Equal(t, "2", text)
+
+	tok.Template = ""
+	cache.set(tok, nil)
+	assert.Empty(t, cache.templates)
+	tmpl, err = cache.get(tok)
+	require.NoError(t, err)
+	assert.Nil(t, tmpl)
+}
+
+func TestNotifierStoreTokenUsage(t *testing.T) {
+	s := &NotifierStore{Bkt: newTestDB(t).From("notifier"), Secret: []byte("key")}
+	require.NoError(t, s.SaveToken(1, 0, "chat1token", "ci", nil, time.Time{}))
+	require.NoError(t, s.SaveToken(2, 0, "chat2token", "ci", nil, time.Time{}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tok := s.FindToken("chat1token")
+			allowed, err := s.UseToken(tok, time.Now(), 0)
+			assert.NoError(t, err)
+			assert.True(t, allowed)
+		}()
+	}
+	wg.Wait()
+	tok := s.FindToken("chat1token")
+	require.NotNil(t, tok)
+	assert.Equal(t, 20, tok.UseCount)
+	assert.NotZero(t, tok.LastUsedAt)
+
+	// daily quota is counted in store, so it isn't reset on restart
+	day := time.Date(2020, 5, 1, 23, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		allowed, err := s.UseToken(tok, day, 3)
+		require.NoError(t, err)
+		require.True(t, allowed)
+	}
+	allowed, err := s.UseToken(s.FindToken("chat1token"), day.Add(time.Minute), 3)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	tok = s.FindToken("chat1token")
+	assert.Equal(t, 3, tok.dailyUsed(day))
+	assert.Equal(t, 23, tok.UseCount)
+	allowed, err = s.UseToken(tok, day.Add(time.Hour), 3)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 1, tok.dailyUsed(day.Add(time.Hour)))
+
+	removed, err := s.RemoveTokens(1, "chat2token")
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+	assert.NotNil(t, s.FindToken("chat2token"))
+
+	removed, err = s.RemoveTokens(2, "ci")
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Nil(t, s.FindToken("chat2token"))
+	assert.NotNil(t, s.FindToken("chat1token"))
+
+	removed, err = s.RemoveTokens(1, "chat1token")
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Nil(t, s.FindToken("chat1token"))
+}
+
+func TestNotifierStoreInitSecret(t *testing.T) {
+	bkt := newTestDB(t).From("notifier")
+
+	s := &NotifierStore{Bkt: bkt}
+	require.NoError(t, s.InitSecret())
+	require.Len(t, s.Secret, 32)
+	require.NoError(t, s.SaveToken(1, 0, "chat1token", "", nil, time.Time{}))
+
+	restarted := &NotifierStore{Bkt: bkt}
+	require.NoError(t, restarted.InitSecret())
+	assert.Equal(t, s.Secret, restarted.Secret)
+	assert.NotNil(t, restarted.FindToken("chat1token"))
+
+	configured := &NotifierStore{Bkt: bkt, Secret: []byte("key")}
+	require.NoError(t, configured.InitSecret())
+	assert.Equal(t, []byte("key"), configured.Secret)
+	assert.Nil(t, configured.FindToken("chat1token"))
+	require.NoError(t, configured.SaveToken(1, 0, "chat1token", "", nil, time.Time{}))
+
+	configured = &NotifierStore{Bkt: bkt, Secret: []byte("key")}
+	require.NoError(t, configured.InitSecret())
+	assert.NotNil(t, configured.FindToken("chat1token"))
+}
+
+func TestNotifierTokenCmd(t *testing.T) {
+	bot, tg := newTestBot(t)
+	store := &NotifierStore{Bkt: newTestDB(t).From("notifier")}
+	require.NoError(t, store.InitSecret())
+	sapp := &NotifierApp{Bot: bot, Store: store, AppURL: "http://localhost"}
+	msg := &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: -100, Type: "supergroup"}, From: &tgbotapi.User{ID: 1}}
+
+	require.NoError(t, sapp.handleTokenCmd(context.Background(), msg, "revoker<b>"))
+	texts := tg.Texts()
+	require.Len(t, texts, 1)
+	assert.True(t, strings.HasPrefix(texts[0], "token <code>revoker&lt;b&gt;</code>: "), texts[0])
+	has, err := store.HasLabel(-100, "revoker<b>")
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	require.NoError(t, sapp.handleTokenCmd(context.Background(), msg, "revoke revoker<b>"))
+	assert.Equal(t, "Ok, token revoked", tg.Texts()[1])
+	has, err = store.HasLabel(-100, "revoker<b>")
+	require.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestNotifierStoreInitSecretWarning(t *testing.T) {
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	bkt := newTestDB(t).From("notifier")
+	require.NoError(t, bkt.Save(&chatToken{Token: "plaintext", ChatID: 1}))
+
+	s := &NotifierStore{Bkt: bkt, Secret: []byte("key")}
+	require.NoError(t, s.InitSecret())
+	assert.NotContains(t, logs.String(), "secret is changed", "no previous secret, plaintext tokens are migrated")
+	require.NoError(t, s.MigrateTokens())
+
+	s = &NotifierStore{Bkt: bkt, Secret: []byte("key")}
+	require.NoError(t, s.InitSecret())
+	assert.NotContains(t, logs.String(), "secret is changed")
+
+	s = &NotifierStore{Bkt: bkt, Secret: []byte("other")}
+	require.NoError(t, s.InitSecret())
+	assert.Contains(t, logs.String(), "notifier secret is changed, 1 tokens hashed")
+}
+
+// blockingTelegram blocks sending messages until request is canceled
+type blockingTelegram struct {
+	fakeTelegram
+	sending chan struct{}
+}
+
+func (b *blockingTelegram) RoundTrip(r *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+		close(b.sending)
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	}
+	return b.fakeTelegram.RoundTrip(r)
+}
+
+func TestNotifierCloseInterruptsOutbox(t *testing.T) {
+	tg := &blockingTelegram{sending: make(chan struct{})}
+	bot, err := tgbotapi.NewBotAPIWithClient("token", tgbotapi.APIEndpoint, &http.Client{Transport: tg})
+	require.NoError(t, err)
+	store := &NotifierStore{Bkt: newTestDB(t).From("notifier")}
+	require.NoError(t, store.InitSecret())
+	sapp := &NotifierApp{Bot: bot, Store: store}
+	item, err := store.AddOutbox("token", 1, 0, &notifyRequest{Text: "hi"})
+	require.NoError(t, err)
+
+	require.NoError(t, sapp.Init())
+	<-tg.sending
+	require.NoError(t, sapp.Close())
+
+	// loop is finished, so item isn't changed after close
+	item, err = store.OutboxItem("token", item.ID)
+	require.NoError(t, err)
+	assert.Equal(t, OutboxPending, item.Status)
+	assert.Equal(t, 1, item.Attempts)
+	assert.Contains(t, item.Error, "context canceled")
+}
+
+func TestNotifierOutboxDeniedChat(t *testing.T) {
+	bot, tg := newTestBot(t)
+	store := &NotifierStore{Bkt: newTestDB(t).From("notifier")}
+	require.NoError(t, store.InitSecret())
+	sapp := &NotifierApp{Bot: bot, Store: store}
+	sapp.Allowed = func(chatID int64, creatorID int) bool { return creatorID != 42 }
+	denied, err := store.AddOutbox("token", 1, 42, &notifyRequest{Text: "denied"})
+	require.NoError(t, err)
+	allowed, err := store.AddOutbox("token", 1, 43, &notifyRequest{Text: "allowed"})
+	require.NoError(t, err)
+
+	sapp.deliverDue(bot, time.Now())
+	assert.Equal(t, []string{"allowed"}, tg.Texts())
+	item, err := store.OutboxItem("token", denied.ID)
+	require.NoError(t, err)
+	assert.Equal(t, OutboxFailed, item.Status)
+	assert.Equal(t, 0, item.Attempts)
+	item, err = store.OutboxItem("token", allowed.ID)
+	require.NoError(t, err)
+	assert.Equal(t, OutboxSent, item.Status)
+}
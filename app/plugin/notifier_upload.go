@@ -0,0 +1,160 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/render"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/vdimir/tg-tobym/app/common"
+)
+
+// DefaultMaxUploadSize limits total size of files uploaded to notifier
+const DefaultMaxUploadSize = 20 << 20
+
+// telegram limit for photos, larger images are sent as documents
+const maxPhotoSize = 10 << 20
+
+const multipartMemory = 8 << 20
+
+var photoMimeTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+func isMultipartRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// readUploads reads all files from multipart form ordered by field name
+func readUploads(r *http.Request) ([]common.MediaUpload, error) {
+	fieldNames := make([]string, 0, len(r.MultipartForm.File))
+	for name := range r.MultipartForm.File {
+		fieldNames = append(fieldNames, name)
+	}
+	sort.Strings(fieldNames)
+
+	uploads := []common.MediaUpload{}
+	for _, name := range fieldNames {
+		for _, fh := range r.MultipartForm.File[name] {
+			f, err := fh.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err := ioutil.ReadAll(f)
+			_ = f.Close()
+			if err != nil {
+				return nil, err
+			}
+
+			upload := common.MediaUpload{Type: "document", Name: fh.Filename, Data: data}
+			if photoMimeTypes[http.DetectContentType(data)] && len(data) <= maxPhotoSize {
+				upload.Type = "photo"
+			}
+			uploads = append(uploads, upload)
+		}
+	}
+	return uploads, nil
+}
+
+// sendUploads sends single file as photo or document and several files as media group
+func sendUploads(bot *tgbotapi.BotAPI, chatID int64, uploads []common.MediaUpload, caption string, parseMode string) ([]int, error) {
+	if len(uploads) == 1 {
+		file := tgbotapi.FileBytes{Name: uploads[0].Name, Bytes: uploads[0].Data}
+		var msg tgbotapi.Chattable
+		if uploads[0].Type == "photo" {
+			photo := tgbotapi.NewPhotoUpload(chatID, file)
+			photo.Caption, photo.ParseMode = caption, parseMode
+			msg = photo
+		} else {
+			doc := tgbotapi.NewDocumentUpload(chatID, file)
+			doc.Caption, doc.ParseMode = caption, parseMode
+			msg = doc
+		}
+		sent, err := bot.Send(msg)
+		if err != nil {
+			return nil, err
+		}
+		return []int{sent.MessageID}, nil
+	}
+
+	// documents can't be mixed with photos in album
+	allPhotos := true
+	for _, u := range uploads {
+		allPhotos = allPhotos && u.Type == "photo"
+	}
+	if !allPhotos {
+		for i := range uploads {
+			uploads[i].Type = "document"
+		}
+	}
+
+	msgs, err := common.SendMediaGroupUpload(bot, chatID, uploads, caption, parseMode)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.MessageID)
+	}
+	return ids, nil
+}
+
+func (sapp *NotifierApp) handleUpload(w http.ResponseWriter, r *http.Request, token string, chatID int64) {
+	r.Body = http.MaxBytesReader(w, r.Body, sapp.MaxUploadSize)
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		status := http.StatusBadRequest
+		if strings.Contains(err.Error(), "request body too large") {
+			status = http.StatusRequestEntityTooLarge
+		}
+		render.Status(r, status)
+		render.JSON(w, r, common.JSON{"error": "can't read form", "verbose": err.Error()})
+		return
+	}
+	defer func() {
+		_ = r.MultipartForm.RemoveAll()
+	}()
+
+	parseMode, ok := notifyParseModes[strings.ToLower(r.FormValue("parse_mode"))]
+	if !ok {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, common.JSON{"error": "unknown parse mode"})
+		return
+	}
+
+	uploads, err := readUploads(r)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, common.JSON{"error": "can't read files", "verbose": err.Error()})
+		return
+	}
+	if len(uploads) == 0 || len(uploads) > 10 {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, common.JSON{"error": "from 1 to 10 files should be uploaded"})
+		return
+	}
+
+	bot, cancel := sapp.requestBot(r)
+	defer cancel()
+	ids, err := sendUploads(bot, chatID, uploads, r.FormValue("caption"), parseMode)
+	if err != nil {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, common.JSON{"error": "can't send files", "verbose": errors.Cause(err).Error()})
+		return
+	}
+	for _, id := range ids {
+		if err := sapp.Store.SaveSentMessage(token, chatID, id); err != nil {
+			log.Printf("[WARN] cannot save sent message: %v", err)
+		}
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, notifyResponse{MessageID: ids[0], MessageIDs: ids})
+}
@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	"github.com/vdimir/tg-tobym/app/common"
+)
+
+const (
+	maxWebhookBodySize = 5 << 20
+	// telegram limit of message length is 4096 characters
+	maxWebhookTextLen = 4000
+)
+
+// WebhookAdapter converts payload of external service to notification
+type WebhookAdapter interface {
+	// Name is used as route, e.g. /notify/github
+	Name() string
+	// Render returns HTML message, secret is webhook secret of token to verify payload signature,
+	// it's empty for tokens without secret. Empty message means event is ignored.
+	Render(r *http.Request, body []byte, secret string) (string, error)
+}
+
+// webhookError is returned by adapter to reply with specific status
+type webhookError struct {
+	status int
+	msg    string
+}
+
+func (e *webhookError) Error() string {
+	return e.msg
+}
+
+// DefaultWebhookAdapters returns adapters for supported services
+func DefaultWebhookAdapters() []WebhookAdapter {
+	return []WebhookAdapter{
+		&GithubAdapter{},
+		&GitlabAdapter{},
+		&AlertmanagerAdapter{},
+		&GrafanaAdapter{},
+	}
+}
+
+func (sapp *NotifierApp) webhookAdapters() []WebhookAdapter {
+	if sapp.Adapters == nil {
+		sapp.Adapters = DefaultWebhookAdapters()
+	}
+	return sapp.Adapters
+}
+
+// webhookToken gets token from request, services which can't set Authorization header may pass it
+// in GitLab secret token header or in url path, e.g. /notify/github/{token}
+func webhookToken(r *http.Request) string {
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+		return token
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return token
+	}
+	return chi.URLParam(r, "token")
+}
+
+// truncateText drops lines which don't fit to limit of telegram message,
+// adapters keep tags of each line balanced, so result is still valid HTML
+func truncateText(text string, limit int) string {
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+	res, length := []string{}, 0
+	for _, line := range strings.Split(text, "\n") {
+		length += utf8.RuneCountInString(line) + 1
+		if length > limit {
+			break
+		}
+		res = append(res, line)
+	}
+	return strings.Join(append(res, "…"), "\n")
+}
+
+// escapef escapes string arguments and formats HTML message
+func escapef(format string, args ...string) string {
+	escaped := make([]interface{}, len(args))
+	for i, arg := range args {
+		escaped[i] = html.EscapeString(arg)
+	}
+	return fmt.Sprintf(format, escaped...)
+}
+
+// htmlLink formats link, text is shown as is if url is empty
+func htmlLink(url string, text string) string {
+	if url == "" {
+		return html.EscapeString(text)
+	}
+	return escapef(`<a href="%s">%s</a>`, url, text)
+}
+
+func (sapp *NotifierApp) handleWebhook(adapter WebhookAdapter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, tok, ok := sapp.authorizeToken(w, r, webhookToken(r), TokenScopeText)
+		if !ok {
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+		if err != nil {
+			render.Status(r, http.StatusRequestEntityTooLarge)
+			render.JSON(w, r, common.JSON{"error": "can't read body", "verbose": err.Error()})
+			return
+		}
+
+		text, err := adapter.Render(r, body, tok.WebhookSecret)
+		if err != nil {
+			status := http.StatusBadRequest
+			if whErr, ok := errors.Cause(err).(*webhookError); ok {
+				status = whErr.status
+			}
+			render.Status(r, status)
+			render.JSON(w, r, common.JSON{"error": err.Error()})
+			return
+		}
+		if text == "" {
+			render.Status(r, http.StatusOK)
+			render.JSON(w, r, common.JSON{"status": "ignored"})
+			return
+		}
+
+		req := &notifyRequest{
+			Text:                  truncateText(text, maxWebhookTextLen),
+			ParseMode:             "html",
+			DisableWebPagePreview: true,
+		}
+		sapp.enqueue(w, r, token, tok, req)
+	}
+}
@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGithubAdapter(t *testing.T) {
+	body := `{
+		"ref": "refs/heads/main",
+		"compare": "https://github.com/org/repo/compare/a...b",
+		"pusher": {"name": "alice"},
+		"repository": {"full_name": "org/repo", "html_url": "https://github.com/org/repo"},
+		"commits": [{"id": "0123456789abcdef", "message": "Fix <script>\n\nlong description", "url": "https://github.com/org/repo/commit/0123456", "author": {"name": "Alice"}}]
+	}`
+	mac := hmac.New(sha256.New, []byte("secret"))
+	_, _ = mac.Write([]byte(body))
+
+	req := httptest.NewRequest("POST", "/github", strings.NewReader(body))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	adapter := &GithubAdapter{}
+	text, err := adapter.Render(req, []byte(body), "secret")
+	require.NoError(t, err)
+	assert.Equal(t, `<b><a href="https://github.com/org/repo">org/repo</a></b>: alice pushed `+
+		`<a href="https://github.com/org/repo/compare/a...b">1 commits</a> to main`+"\n"+
+		`<code><a href="https://github.com/org/repo/commit/0123456">0123456</a></code> Fix &lt;script&gt; (Alice)`, text)
+
+	_, err = adapter.Render(req, []byte(body), "other")
+	assert.Error(t, err)
+
+	req.Header.Set("X-GitHub-Event", "ping")
+	req.Header.Del("X-Hub-Signature-256")
+	_, err = adapter.Render(req, []byte(`{}`), "secret")
+	assert.Error(t, err, "signature is required if token has secret")
+
+	text, err = adapter.Render(req, []byte(`{}`), "")
+	assert.NoError(t, err)
+	assert.Equal(t, "", text)
+}
+
+func TestGitlabAdapter(t *testing.T) {
+	body := `{
+		"object_kind": "pipeline",
+		"user": {"name": "Bob"},
+		"project": {"path_with_namespace": "group/app", "web_url": "https://gitlab.com/group/app"},
+		"object_attributes": {"id": 31, "status": "failed", "ref": "main"}
+	}`
+	text, err := (&GitlabAdapter{}).Render(httptest.NewRequest("POST", "/gitlab", nil), []byte(body), "")
+	require.NoError(t, err)
+	assert.Equal(t, `❌ <b><a href="https://gitlab.com/group/app">group/app</a></b>: `+
+		`<a href="https://gitlab.com/group/app/-/pipelines/31">pipeline #31</a> failed on main`, text)
+
+	text, err = (&GitlabAdapter{}).Render(httptest.NewRequest("POST", "/gitlab", nil),
+		[]byte(`{"object_kind": "pipeline", "object_attributes": {"status": "running"}}`), "")
+	require.NoError(t, err)
+	assert.Equal(t, "", text)
+}
+
+func TestAlertmanagerAdapter(t *testing.T) {
+	body := `{
+		"status": "firing",
+		"externalURL": "http://am:9093",
+		"commonLabels": {"alertname": "HighLoad"},
+		"alerts": [
+			{"status": "firing", "labels": {"alertname": "HighLoad", "instance": "web-1"}, "annotations": {"summary": "Load is\nhigh"}},
+			{"status": "resolved", "labels": {"alertname": "HighLoad", "instance": "web-2"}, "annotations": {}}
+		]
+	}`
+	text, err := (&AlertmanagerAdapter{}).Render(httptest.NewRequest("POST", "/alertmanager", nil), []byte(body), "")
+	require.NoError(t, err)
+	assert.Equal(t, `🔥 <b><a href="http://am:9093">[FIRING] HighLoad</a></b> (1 firing, 1 resolved)`+"\n"+
+		`🔥 Load is high <i>instance=web-1</i>`+"\n"+
+		`✅ HighLoad <i>instance=web-2</i>`, text)
+}
+
+func TestGrafanaLegacyAdapter(t *testing.T) {
+	body := `{"ruleName": "CPU", "state": "alerting", "message": "CPU > 90%", "ruleUrl": "http://grafana/d/1"}`
+	text, err := (&GrafanaAdapter{}).Render(httptest.NewRequest("POST", "/grafana", nil), []byte(body), "")
+	require.NoError(t, err)
+	assert.Equal(t, `🔥 <b><a href="http://grafana/d/1">[ALERTING] CPU</a></b>`+"\n"+`CPU &gt; 90%`, text)
+}
+
+func TestTruncateText(t *testing.T) {
+	assert.Equal(t, "short", truncateText("short", 10))
+	assert.Equal(t, "<b>line1</b>\n…", truncateText("<b>line1</b>\n<b>line2</b>", 20))
+}
@@ -7,10 +7,24 @@ import (
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
+// Scopes of bot commands in Telegram clients, see https://core.telegram.org/bots/api#botcommandscope
+const (
+	CommandScopeDefault = "default"
+	CommandScopePrivate = "all_private_chats"
+	CommandScopeGroups  = "all_group_chats"
+	CommandScopeAdmins  = "all_chat_administrators"
+)
+
 type CommandDescription struct {
 	Cmd     string
 	Help    string
 	Details string
+	// Scopes limits chats where command is suggested by Telegram clients, command is suggested everywhere if it's empty
+	Scopes []string
+	// Translations are descriptions of command by language code, Help is used for other languages
+	Translations map[string]string
+	// Permission is default level required to run command, PermEveryone if it isn't set
+	Permission string
 }
 
 // PlugIn provides part of functionality for bot
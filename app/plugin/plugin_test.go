@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/asdine/storm/v3"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTelegram answers Telegram API requests made by plugins and records called methods and texts of sent messages
+type fakeTelegram struct {
+	mtx     sync.Mutex
+	methods []string
+	texts   []string
+	// fail makes sendMessage return error
+	fail bool
+}
+
+func (f *fakeTelegram) SetFail(fail bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.fail = fail
+}
+
+func (f *fakeTelegram) Texts() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]string{}, f.texts...)
+}
+
+func (f *fakeTelegram) Methods() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]string{}, f.methods...)
+}
+
+func (f *fakeTelegram) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.mtx.Lock()
+	f.methods = append(f.methods, path.Base(r.URL.Path))
+	f.mtx.Unlock()
+
+	body := `{"ok":true,"result":true}`
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/getMe"):
+		body = `{"ok":true,"result":{"id":666,"is_bot":true,"first_name":"test_bot","username":"test_bot"}}`
+	case strings.HasSuffix(r.URL.Path, "/sendMessage"):
+		f.mtx.Lock()
+		fail := f.fail
+		if !fail && r.ParseForm() == nil {
+			f.texts = append(f.texts, r.PostForm.Get("text"))
+		}
+		f.mtx.Unlock()
+		body = `{"ok":true,"result":{"message_id":42,"date":1596902693,"chat":{"id":1,"type":"private"}}}`
+		if fail {
+			body = `{"ok":false,"error_code":502,"description":"Bad Gateway"}`
+		}
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+
+func newTestBot(t *testing.T) (*tgbotapi.BotAPI, *fakeTelegram) {
+	tg := &fakeTelegram{}
+	bot, err := tgbotapi.NewBotAPIWithClient("token", tgbotapi.APIEndpoint, &http.Client{Transport: tg})
+	require.NoError(t, err)
+	return bot, tg
+}
+
+func newTestDB(t *testing.T) *storm.DB {
+	db, err := storm.Open(filepath.Join(t.TempDir(), "data.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// newTestAccess returns access where plugins are disabled in chat
+func newTestAccess(t *testing.T, db *storm.DB, chatID int64, disabled ...string) *Access {
+	acc := &Access{Store: db.From("access")}
+	require.NoError(t, acc.Store.Save(&chatAccess{ChatID: chatID, Disabled: disabled}))
+	return acc
+}
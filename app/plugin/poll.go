@@ -0,0 +1,380 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"github.com/vdimir/tg-tobym/app/common"
+)
+
+const pollCallbackDataPrefix = "poll#"
+const pollMaxOptions = 10
+const pollCheckInterval = 15 * time.Second
+
+var pollFlagRe = regexp.MustCompile(`(?:^|\s)--(until|anonymous|multi)\b`)
+
+// PollApp creates polls with multiple options and closes them at deadline
+type PollApp struct {
+	NopPlugin
+	Bot   *tgbotapi.BotAPI
+	Store *PollStore
+	// Timezones is used to parse deadline in chat timezone, optional
+	Timezones *TimezoneConverter
+	// AllowedChat checks that results of expired polls may be published in chat, everything is allowed if it's nil
+	AllowedChat func(chatID int64) bool
+
+	closeNotifier chan (struct{})
+}
+
+type pollSpec struct {
+	Question  string
+	Options   []string
+	Until     string
+	Multi     bool
+	Anonymous bool
+}
+
+// parsePollArgs parses `"Question" opt1 | opt2 [--until 18:00] [--anonymous] [--multi]`
+func parsePollArgs(args string) (*pollSpec, error) {
+	args = strings.TrimSpace(args)
+	spec := &pollSpec{}
+
+	var closing string
+	switch {
+	case strings.HasPrefix(args, `"`):
+		closing = `"`
+	case strings.HasPrefix(args, "“"):
+		closing = "”"
+	default:
+		return nil, errors.Errorf("question should be quoted")
+	}
+	_, openLen := utf8.DecodeRuneInString(args)
+	end := strings.Index(args[openLen:], closing)
+	if end < 0 {
+		return nil, errors.Errorf("question isn't closed by quote")
+	}
+	spec.Question = strings.TrimSpace(args[openLen : openLen+end])
+	if spec.Question == "" {
+		return nil, errors.Errorf("question is empty")
+	}
+	rest := args[openLen+end+len(closing):]
+
+	flags := pollFlagRe.FindAllStringSubmatchIndex(rest, -1)
+	optionsPart := rest
+	if len(flags) > 0 {
+		optionsPart = rest[:flags[0][0]]
+	}
+	for i, loc := range flags {
+		valueEnd := len(rest)
+		if i+1 < len(flags) {
+			valueEnd = flags[i+1][0]
+		}
+		value := strings.TrimSpace(rest[loc[1]:valueEnd])
+		name := rest[loc[2]:loc[3]]
+		switch name {
+		case "until":
+			if value == "" {
+				return nil, errors.Errorf("--until needs time")
+			}
+			spec.Until = value
+		case "multi":
+			spec.Multi = true
+		case "anonymous":
+			spec.Anonymous = true
+		}
+		if name != "until" && value != "" {
+			return nil, errors.Errorf("unexpected '%s' after --%s", value, name)
+		}
+	}
+
+	for _, opt := range strings.Split(optionsPart, "|") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			return nil, errors.Errorf("option shouldn't be empty")
+		}
+		spec.Options = append(spec.Options, opt)
+	}
+	if len(spec.Options) < 2 || len(spec.Options) > pollMaxOptions {
+		return nil, errors.Errorf("poll should have from 2 to %d options", pollMaxOptions)
+	}
+	return spec, nil
+}
+
+func userDisplayName(u *tgbotapi.User) string {
+	if u == nil {
+		return ""
+	}
+	name := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	if name == "" {
+		name = u.UserName
+	}
+	return name
+}
+
+func formatPollText(poll *Poll, loc *time.Location) string {
+	lines := []string{fmt.Sprintf("<b>%s</b>", html.EscapeString(poll.Question)), ""}
+
+	tally := poll.Tally()
+	totalVoters := len(poll.Ballots)
+
+	// list voters in stable order, so message is not changed on re-render without new votes
+	voters := make([]int, 0, len(poll.Ballots))
+	for uid := range poll.Ballots {
+		voters = append(voters, uid)
+	}
+	sort.Slice(voters, func(i, j int) bool {
+		ni, nj := poll.Voters[voters[i]], poll.Voters[voters[j]]
+		if ni != nj {
+			return ni < nj
+		}
+		return voters[i] < voters[j]
+	})
+
+	for i, opt := range poll.Options {
+		pct := 0
+		if totalVoters > 0 {
+			pct = tally[i] * 100 / totalVoters
+		}
+		line := fmt.Sprintf("%s — %d (%d%%)", html.EscapeString(opt), tally[i], pct)
+		if !poll.Anonymous {
+			names := []string{}
+			for _, uid := range voters {
+				for _, o := range poll.Ballots[uid] {
+					if o == i {
+						names = append(names, html.EscapeString(poll.Voters[uid]))
+					}
+				}
+			}
+			if len(names) > 0 {
+				line = fmt.Sprintf("%s\n    <i>%s</i>", line, strings.Join(names, ", "))
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	footer := []string{fmt.Sprintf("%d voted", totalVoters)}
+	if poll.Multi {
+		footer = append(footer, "multiple choice")
+	}
+	if poll.Anonymous {
+		footer = append(footer, "anonymous")
+	}
+	if poll.Closed {
+		footer = append(footer, "<b>closed, final results</b>")
+	} else if poll.Deadline != 0 {
+		deadline := time.Unix(poll.Deadline, 0).In(loc)
+		footer = append(footer, fmt.Sprintf("closes at %s", deadline.Format("Jan 2 15:04 MST")))
+	}
+	lines = append(lines, "", strings.Join(footer, ", "))
+	return strings.Join(lines, "\n")
+}
+
+func pollKeyboard(poll *Poll) tgbotapi.InlineKeyboardMarkup {
+	tally := poll.Tally()
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for i, opt := range poll.Options {
+		text := opt
+		if tally[i] > 0 {
+			text = fmt.Sprintf("%s (%d)", opt, tally[i])
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(text, pollCallbackDataPrefix+strconv.Itoa(i))))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+func (plg *PollApp) chatLocation(chatID int64) *time.Location {
+	if plg.Timezones != nil {
+		if loc := plg.Timezones.PrimaryLocation(chatID); loc != nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+func (plg *PollApp) Init() error {
+	plg.closeNotifier = make(chan struct{})
+	go plg.closeExpiredLoop()
+	return nil
+}
+
+func (plg *PollApp) Close() error {
+	close(plg.closeNotifier)
+	return nil
+}
+
+func (plg *PollApp) Name() string {
+	return "poll"
+}
+
+// RegisterHandlers declares poll commands and callbacks
+func (plg *PollApp) RegisterHandlers(r *Router) {
+	r.Command(CommandDescription{
+		Cmd:     "poll",
+		Help:    "Create poll",
+		Details: `Usage: /poll "Question" opt1 | opt2 | opt3 [--until 18:00] [--anonymous] [--multi]`,
+	}, plg.handleNewPoll)
+	r.Command(CommandDescription{
+		Cmd:  "poll_close",
+		Help: "Close poll and publish results, send it as reply to poll",
+	}, plg.handleClosePoll)
+	r.Callback(pollCallbackDataPrefix, plg.handleCallbackQuery)
+}
+
+func (plg *PollApp) closeExpiredLoop() {
+	ticker := time.NewTicker(pollCheckInterval)
+	defer ticker.Stop()
+	for {
+		plg.closeExpired(time.Now())
+		select {
+		case <-plg.closeNotifier:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (plg *PollApp) closeExpired(now time.Time) {
+	polls, err := plg.Store.Expired(now)
+	if err != nil {
+		log.Printf("[ERROR] cannot get expired polls: %v", err)
+		return
+	}
+	for _, p := range polls {
+		if plg.AllowedChat != nil && !plg.AllowedChat(p.ID.ChatID) {
+			// poll is closed silently, so it isn't selected again
+			if _, _, err := plg.Store.Close(p.ID); err != nil {
+				log.Printf("[ERROR] cannot close poll: %v", err)
+			}
+			continue
+		}
+		if err := plg.closePoll(p.ID); err != nil {
+			log.Printf("[ERROR] cannot close poll: %v", err)
+		}
+	}
+}
+
+func (plg *PollApp) closePoll(id MsgChatID) error {
+	closed, poll, err := plg.Store.Close(id)
+	if err != nil || !closed {
+		return err
+	}
+	edit := tgbotapi.NewEditMessageText(id.ChatID, id.MessageID, formatPollText(poll, plg.chatLocation(id.ChatID)))
+	edit.ParseMode = tgbotapi.ModeHTML
+	_, err = plg.Bot.Send(edit)
+	return errors.Wrapf(err, "cannot publish poll results")
+}
+
+func (plg *PollApp) handleNewPoll(_ context.Context, msg *tgbotapi.Message, args string) error {
+	spec, err := parsePollArgs(args)
+	if err != nil {
+		return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Can't create poll: %s", err), "")
+	}
+
+	poll := &Poll{
+		Question:  spec.Question,
+		Options:   spec.Options,
+		Multi:     spec.Multi,
+		Anonymous: spec.Anonymous,
+	}
+	if msg.From != nil {
+		poll.Author = msg.From.ID
+	}
+	loc := plg.chatLocation(msg.Chat.ID)
+	if spec.Until != "" {
+		deadline, err := parseFutureTime(spec.Until, time.Now().In(loc))
+		if err != nil {
+			return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Can't create poll: %s", err), "")
+		}
+		poll.Deadline = deadline.Unix()
+	}
+
+	resp := tgbotapi.NewMessage(msg.Chat.ID, formatPollText(poll, loc))
+	resp.ParseMode = tgbotapi.ModeHTML
+	resp.ReplyMarkup = pollKeyboard(poll)
+	sent, err := plg.Bot.Send(resp)
+	if err != nil {
+		return errors.Wrapf(err, "cannot send poll")
+	}
+
+	// poll is saved by id of sent message, so it can't be saved before sending
+	poll.ID = MsgChatID{MessageID: sent.MessageID, ChatID: msg.Chat.ID}
+	if err := plg.Store.NewPoll(poll); err != nil {
+		if _, delErr := plg.Bot.DeleteMessage(tgbotapi.NewDeleteMessage(msg.Chat.ID, sent.MessageID)); delErr != nil {
+			log.Printf("[WARN] cannot delete unsaved poll %d: %v", sent.MessageID, delErr)
+		}
+		_ = common.ReplyWithText(plg.Bot, msg, "Can't create poll, internal error :(", "")
+		return errors.Wrapf(err, "cannot save poll")
+	}
+	return nil
+}
+
+func (plg *PollApp) handleClosePoll(_ context.Context, msg *tgbotapi.Message, _ string) error {
+	if msg.ReplyToMessage == nil {
+		return common.ReplyWithText(plg.Bot, msg, "Send this command as reply to poll", "")
+	}
+	id := MsgChatID{MessageID: msg.ReplyToMessage.MessageID, ChatID: msg.Chat.ID}
+	poll, err := plg.Store.Get(id)
+	if err != nil {
+		return common.ReplyWithText(plg.Bot, msg, "It's not a poll", "")
+	}
+
+	allowed := msg.From != nil && poll.Author == msg.From.ID
+	if !allowed && msg.From != nil {
+		if allowed, err = common.IsChatAdmin(plg.Bot, msg.Chat, msg.From.ID); err != nil {
+			return err
+		}
+	}
+	if !allowed {
+		return common.ReplyWithText(plg.Bot, msg, "Only author or chat admin can close poll", "")
+	}
+	return plg.closePoll(id)
+}
+
+func (plg *PollApp) handleCallbackQuery(_ context.Context, query *tgbotapi.CallbackQuery) error {
+	if query.Message == nil {
+		return errors.Errorf("poll callback without message")
+	}
+	option, err := strconv.Atoi(strings.TrimPrefix(query.Data, pollCallbackDataPrefix))
+	if err != nil {
+		return errors.Wrapf(err, "wrong poll option %q", query.Data)
+	}
+
+	id := MsgChatID{MessageID: query.Message.MessageID, ChatID: query.Message.Chat.ID}
+	poll, err := plg.Store.Vote(id, query.From.ID, userDisplayName(query.From), option)
+	if err != nil {
+		_, _ = plg.Bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Poll is closed"))
+		return err
+	}
+
+	answer := "Vote retracted"
+	if ballot := poll.Ballots[query.From.ID]; len(ballot) > 0 {
+		chosen := []string{}
+		for _, opt := range ballot {
+			chosen = append(chosen, poll.Options[opt])
+		}
+		answer = fmt.Sprintf("You chose %s", strings.Join(chosen, ", "))
+	}
+
+	errs := &multierror.Error{}
+	_, err = plg.Bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, answer))
+	errs = multierror.Append(errs, err)
+
+	edit := tgbotapi.NewEditMessageTextAndMarkup(id.ChatID, id.MessageID,
+		formatPollText(poll, plg.chatLocation(id.ChatID)), pollKeyboard(poll))
+	edit.ParseMode = tgbotapi.ModeHTML
+	_, err = plg.Bot.Send(edit)
+	errs = multierror.Append(errs, err)
+	return errs.ErrorOrNil()
+}
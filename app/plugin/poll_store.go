@@ -0,0 +1,148 @@
+package plugin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+	"github.com/pkg/errors"
+)
+
+// PollStore keeps polls
+type PollStore struct {
+	Bkt storm.Node
+	mtx sync.Mutex
+}
+
+// Poll is a question with options, it's identified by message with ballot
+type Poll struct {
+	ID        MsgChatID `storm:"id"`
+	Author    int
+	Question  string
+	Options   []string
+	Multi     bool
+	Anonymous bool
+	// Deadline is unix timestamp, zero if poll is closed manually
+	Deadline int64 `storm:"index"`
+	Closed   bool  `storm:"index"`
+	// Ballots maps user to chosen options
+	Ballots map[int][]int
+	Voters  map[int]string
+}
+
+// Tally returns number of votes for each option
+func (p *Poll) Tally() []int {
+	res := make([]int, len(p.Options))
+	for _, opts := range p.Ballots {
+		for _, opt := range opts {
+			if opt >= 0 && opt < len(res) {
+				res[opt]++
+			}
+		}
+	}
+	return res
+}
+
+func (s *PollStore) NewPoll(poll *Poll) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if poll.Ballots == nil {
+		poll.Ballots = map[int][]int{}
+	}
+	if poll.Voters == nil {
+		poll.Voters = map[int]string{}
+	}
+	return s.Bkt.Save(poll)
+}
+
+func (s *PollStore) Get(id MsgChatID) (*Poll, error) {
+	poll := &Poll{}
+	err := s.Bkt.One("ID", id, poll)
+	return poll, err
+}
+
+// Vote updates user ballot, in single choice poll option replaces previous choice,
+// in multi choice poll it's toggled. Choosing the same option again retracts it.
+func (s *PollStore) Vote(id MsgChatID, userID int, userName string, option int) (*Poll, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	poll := &Poll{}
+	err := s.Bkt.One("ID", id, poll)
+	if err != nil {
+		return poll, err
+	}
+	if poll.Closed {
+		return poll, errors.Errorf("poll is closed")
+	}
+	if option < 0 || option >= len(poll.Options) {
+		return poll, errors.Errorf("option %d is out of range", option)
+	}
+
+	if poll.Ballots == nil {
+		poll.Ballots = map[int][]int{}
+	}
+	if poll.Voters == nil {
+		poll.Voters = map[int]string{}
+	}
+
+	ballot := poll.Ballots[userID]
+	newBallot := []int{}
+	found := false
+	for _, opt := range ballot {
+		if opt == option {
+			found = true
+			continue
+		}
+		if poll.Multi {
+			newBallot = append(newBallot, opt)
+		}
+	}
+	if !found {
+		newBallot = append(newBallot, option)
+	}
+
+	if len(newBallot) == 0 {
+		delete(poll.Ballots, userID)
+		delete(poll.Voters, userID)
+	} else {
+		poll.Ballots[userID] = newBallot
+		if !poll.Anonymous {
+			poll.Voters[userID] = userName
+		}
+	}
+
+	err = s.Bkt.Update(poll)
+	return poll, err
+}
+
+// Close marks poll as closed, returns false if it was closed already
+func (s *PollStore) Close(id MsgChatID) (bool, *Poll, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	poll := &Poll{}
+	err := s.Bkt.One("ID", id, poll)
+	if err != nil || poll.Closed {
+		return false, poll, err
+	}
+	poll.Closed = true
+	err = s.Bkt.UpdateField(poll, "Closed", true)
+	return err == nil, poll, err
+}
+
+// Expired returns open polls with deadline before ts
+func (s *PollStore) Expired(ts time.Time) ([]Poll, error) {
+	var polls []Poll
+	err := s.Bkt.Select(
+		q.Eq("Closed", false),
+		q.Gt("Deadline", int64(0)),
+		q.Lte("Deadline", ts.Unix()),
+	).Find(&polls)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return polls, err
+}
@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePollArgs(t *testing.T) {
+	spec, err := parsePollArgs(`"Where to eat?" pizza | sushi | burgers --until tomorrow 18:00 --multi`)
+	require.NoError(t, err)
+	assert.Equal(t, "Where to eat?", spec.Question)
+	assert.Equal(t, []string{"pizza", "sushi", "burgers"}, spec.Options)
+	assert.Equal(t, "tomorrow 18:00", spec.Until)
+	assert.True(t, spec.Multi)
+	assert.False(t, spec.Anonymous)
+
+	spec, err = parsePollArgs(`“Ok?” yes|no --anonymous`)
+	require.NoError(t, err)
+	assert.Equal(t, "Ok?", spec.Question)
+	assert.Equal(t, []string{"yes", "no"}, spec.Options)
+	assert.True(t, spec.Anonymous)
+
+	for _, args := range []string{
+		`Ok? yes | no`,
+		`"Ok? yes | no`,
+		`"Ok?" yes`,
+		`"Ok?" yes | | no`,
+		`"Ok?" yes | no --until`,
+		`"Ok?" yes | no --multi now`,
+	} {
+		_, err = parsePollArgs(args)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestNewPollSaveFailed(t *testing.T) {
+	bot, tg := newTestBot(t)
+	db := newTestDB(t)
+	plg := &PollApp{Bot: bot, Store: &PollStore{Bkt: db.From("poll")}}
+	msg := &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: -100, Type: "supergroup"}, From: &tgbotapi.User{ID: 1}}
+
+	require.NoError(t, plg.handleNewPoll(context.Background(), msg, `"Ok?" yes | no`))
+	_, err := plg.Store.Get(MsgChatID{MessageID: 42, ChatID: -100})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Close())
+	err = plg.handleNewPoll(context.Background(), msg, `"Ok?" yes | no`)
+	require.Error(t, err)
+	assert.Equal(t, []string{"getMe", "sendMessage", "sendMessage", "deleteMessage", "sendMessage"}, tg.Methods())
+	assert.Equal(t, "Can't create poll, internal error :(", tg.Texts()[2])
+}
+
+func TestFormatPollTextVotersOrder(t *testing.T) {
+	poll := &Poll{
+		Question: "Ok?",
+		Options:  []string{"yes", "no"},
+		Ballots:  map[int][]int{1: {0}, 2: {0}, 3: {1}, 4: {0}},
+		Voters:   map[int]string{1: "carol", 2: "alice", 3: "dave", 4: "bob"},
+	}
+	expected := "<b>Ok?</b>\n\nyes — 3 (75%)\n    <i>alice, bob, carol</i>\nno — 1 (25%)\n    <i>dave</i>\n\n4 voted"
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, expected, formatPollText(poll, time.UTC))
+	}
+}
+
+func TestCloseExpiredPollOfDeniedChat(t *testing.T) {
+	bot, tg := newTestBot(t)
+	plg := &PollApp{Bot: bot, Store: &PollStore{Bkt: newTestDB(t).From("poll")}}
+	plg.AllowedChat = func(chatID int64) bool { return chatID != -200 }
+	now := time.Now()
+	for _, chatID := range []int64{-100, -200} {
+		require.NoError(t, plg.Store.NewPoll(&Poll{ID: MsgChatID{MessageID: 1, ChatID: chatID}, Question: "Ok?",
+			Options: []string{"yes", "no"}, Deadline: now.Add(-time.Minute).Unix()}))
+	}
+
+	plg.closeExpired(now)
+	assert.Equal(t, []string{"getMe", "editMessageText"}, tg.Methods(), "results are published only in allowed chat")
+	for _, chatID := range []int64{-100, -200} {
+		poll, err := plg.Store.Get(MsgChatID{MessageID: 1, ChatID: chatID})
+		require.NoError(t, err)
+		assert.True(t, poll.Closed, chatID)
+	}
+}
@@ -0,0 +1,407 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/tj/go-naturaldate"
+	"github.com/vdimir/tg-tobym/app/common"
+)
+
+const reminderCheckInterval = 10 * time.Second
+const reminderMinInterval = 5 * time.Minute
+const reminderMaxAttempts = 10
+
+// Reminder sends scheduled messages to chats
+type Reminder struct {
+	NopPlugin
+	Bot   *tgbotapi.BotAPI
+	Store *ReminderStore
+	// Timezones is used to parse time in chat timezone, optional
+	Timezones *TimezoneConverter
+	// Access skips reminders of chats where plugin is disabled, everything is sent if it's nil
+	Access *Access
+	// AllowedChat skips reminders of denied chats, everything is sent if it's nil
+	AllowedChat func(chatID int64) bool
+
+	closeNotifier chan (struct{})
+	loopDone      chan (struct{})
+}
+
+// reminderRecurrence describes repeating reminder, either fixed interval or time of day on some days
+type reminderRecurrence struct {
+	Spec     string
+	Interval time.Duration
+	// Weekdays is empty for every day
+	Weekdays []time.Weekday
+	Hour     int
+	Minute   int
+}
+
+var reminderWeekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+var reminderUnits = map[string]time.Duration{
+	"minute": time.Minute, "minutes": time.Minute,
+	"hour": time.Hour, "hours": time.Hour,
+	"day": 24 * time.Hour, "days": 24 * time.Hour,
+	"week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+}
+
+// parseTimeOfDay parses '10:00', '9am', '5:30pm'
+func parseTimeOfDay(s string) (hour int, minute int, err error) {
+	for _, layout := range []string{"15:04", "3pm", "3:04pm", "3PM", "3:04PM"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Hour(), t.Minute(), nil
+		}
+	}
+	return 0, 0, errors.Errorf("can't parse time of day '%s'", s)
+}
+
+// parseRecurrence parses words after 'every', e.g. 'monday 10:00', 'weekday at 9am', 'day 18:00', '2 hours'.
+// Returns number of consumed words.
+func parseRecurrence(words []string) (*reminderRecurrence, int, error) {
+	if len(words) == 0 {
+		return nil, 0, errors.Errorf("nothing after 'every'")
+	}
+	rec := &reminderRecurrence{}
+	used := 0
+
+	count := 1
+	if n, err := strconv.Atoi(words[0]); err == nil && n > 0 {
+		count = n
+		used++
+	}
+	if used < len(words) {
+		word := strings.ToLower(words[used])
+		if unit, ok := reminderUnits[word]; ok && (unit < 24*time.Hour || count > 1) {
+			rec.Interval = time.Duration(count) * unit
+			if rec.Interval < reminderMinInterval {
+				return nil, 0, errors.Errorf("interval should be at least %s", reminderMinInterval)
+			}
+			used++
+			rec.Spec = "every " + strings.Join(words[:used], " ")
+			return rec, used, nil
+		}
+	}
+	if count != 1 || used != 0 {
+		return nil, 0, errors.Errorf("unknown interval '%s'", strings.Join(words[:used+1], " "))
+	}
+
+	switch day := strings.ToLower(words[0]); {
+	case day == "day":
+	case day == "weekday":
+		rec.Weekdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	default:
+		for _, name := range strings.Split(day, ",") {
+			wd, ok := reminderWeekdays[strings.TrimSuffix(name, "s")]
+			if !ok {
+				wd, ok = reminderWeekdays[name]
+			}
+			if !ok {
+				return nil, 0, errors.Errorf("unknown day '%s'", name)
+			}
+			rec.Weekdays = append(rec.Weekdays, wd)
+		}
+	}
+	used = 1
+
+	if used < len(words) && strings.ToLower(words[used]) == "at" {
+		used++
+	}
+	if used >= len(words) {
+		return nil, 0, errors.Errorf("time of day isn't set")
+	}
+	var err error
+	rec.Hour, rec.Minute, err = parseTimeOfDay(strings.ToLower(words[used]))
+	if err != nil {
+		return nil, 0, err
+	}
+	used++
+	rec.Spec = "every " + strings.Join(words[:used], " ")
+	return rec, used, nil
+}
+
+// next returns first occurrence strictly after ts
+func (rec *reminderRecurrence) next(ts time.Time, loc *time.Location) time.Time {
+	if rec.Interval > 0 {
+		return ts.Add(rec.Interval)
+	}
+	ts = ts.In(loc)
+	candidate := time.Date(ts.Year(), ts.Month(), ts.Day(), rec.Hour, rec.Minute, 0, 0, loc)
+	for i := 0; i < 8; i++ {
+		if candidate.After(ts) && rec.matchDay(candidate.Weekday()) {
+			return candidate
+		}
+		candidate = time.Date(candidate.Year(), candidate.Month(), candidate.Day()+1, rec.Hour, rec.Minute, 0, 0, loc)
+	}
+	return candidate
+}
+
+func (rec *reminderRecurrence) matchDay(wd time.Weekday) bool {
+	if len(rec.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range rec.Weekdays {
+		if d == wd {
+			return true
+		}
+	}
+	return false
+}
+
+// splitWhen splits arguments to time and text, time is the shortest prefix which gives the same result as whole string
+func splitWhen(words []string, now time.Time) (time.Time, int, error) {
+	full, err := naturaldate.Parse(strings.Join(words, " "), now, naturaldate.WithDirection(naturaldate.Future))
+	if err != nil {
+		return full, 0, err
+	}
+	if full.Equal(now) {
+		return full, 0, errors.Errorf("can't find time in '%s'", strings.Join(words, " "))
+	}
+	for k := 1; k < len(words); k++ {
+		d, err := naturaldate.Parse(strings.Join(words[:k], " "), now, naturaldate.WithDirection(naturaldate.Future))
+		if err == nil && d.Equal(full) {
+			return full, k, nil
+		}
+	}
+	return full, len(words), nil
+}
+
+// parseReminder parses `<when> <text>` where when is natural date or recurrence starting with 'every'
+func parseReminder(args string, now time.Time) (time.Time, *reminderRecurrence, string, error) {
+	words := strings.Fields(args)
+	if len(words) == 0 {
+		return time.Time{}, nil, "", errors.Errorf("time and text should be set")
+	}
+
+	if strings.ToLower(words[0]) == "every" {
+		rec, used, err := parseRecurrence(words[1:])
+		if err != nil {
+			return time.Time{}, nil, "", err
+		}
+		text := strings.Join(words[used+1:], " ")
+		if text == "" {
+			return time.Time{}, nil, "", errors.Errorf("text isn't set")
+		}
+		return rec.next(now, now.Location()), rec, text, nil
+	}
+
+	_, used, err := splitWhen(words, now)
+	if err != nil {
+		return time.Time{}, nil, "", err
+	}
+	text := strings.Join(words[used:], " ")
+	if text == "" {
+		return time.Time{}, nil, "", errors.Errorf("text isn't set")
+	}
+	when, err := parseFutureTime(strings.Join(words[:used], " "), now)
+	if err != nil {
+		return time.Time{}, nil, "", err
+	}
+	return when, nil, text, nil
+}
+
+func (plg *Reminder) chatLocation(chatID int64) *time.Location {
+	if plg.Timezones != nil {
+		if loc := plg.Timezones.PrimaryLocation(chatID); loc != nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+func (plg *Reminder) Init() error {
+	plg.closeNotifier = make(chan struct{})
+	plg.loopDone = make(chan struct{})
+	go plg.deliverLoop()
+	return nil
+}
+
+func (plg *Reminder) Close() error {
+	close(plg.closeNotifier)
+	select {
+	case <-plg.loopDone:
+	case <-time.After(5 * time.Second):
+		return errors.Errorf("reminder loop isn't finished")
+	}
+	return nil
+}
+
+func (plg *Reminder) Name() string {
+	return "reminder"
+}
+
+// RegisterHandlers declares reminder commands
+func (plg *Reminder) RegisterHandlers(r *Router) {
+	r.Command(CommandDescription{
+		Cmd:     "remind",
+		Help:    "Schedule message",
+		Details: "Usage: /remind <when> <text>, e.g. 'in 2 hours call mom', 'tomorrow 10am standup', 'every monday 10:00 post standup'.",
+	}, plg.handleRemind)
+	r.Command(CommandDescription{
+		Cmd:  "reminders",
+		Help: "List scheduled messages",
+	}, plg.handleList)
+	r.Command(CommandDescription{
+		Cmd:  "remind_cancel",
+		Help: "Cancel scheduled message by id",
+	}, plg.handleCancel)
+}
+
+// sendEnabled checks that reminders may be sent to chat
+func (plg *Reminder) sendEnabled(chatID int64) bool {
+	if plg.AllowedChat != nil && !plg.AllowedChat(chatID) {
+		return false
+	}
+	return plg.Access.PluginEnabled(context.Background(), chatID, plg.Name())
+}
+
+func (plg *Reminder) deliverLoop() {
+	defer close(plg.loopDone)
+	ticker := time.NewTicker(reminderCheckInterval)
+	defer ticker.Stop()
+	for {
+		plg.deliverDue(time.Now())
+		select {
+		case <-plg.closeNotifier:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (plg *Reminder) deliverDue(now time.Time) {
+	items, err := plg.Store.Due(now)
+	if err != nil {
+		log.Printf("[ERROR] cannot get reminders: %v", err)
+		return
+	}
+	for i := range items {
+		select {
+		case <-plg.closeNotifier:
+			return
+		default:
+		}
+
+		item := &items[i]
+		var next time.Time
+		if item.Recurrence != nil {
+			loc, locErr := time.LoadLocation(item.Location)
+			if locErr != nil {
+				loc = time.UTC
+			}
+			next = item.Recurrence.next(now, loc)
+		}
+
+		if !plg.sendEnabled(item.ChatID) {
+			// reminder is skipped like it's sent, so it isn't sent unexpectedly late after plugin is enabled
+			log.Printf("[INFO] skip reminder %d, chat %d is denied or plugin is disabled", item.ID, item.ChatID)
+			plg.finish(item, next)
+			continue
+		}
+
+		err := common.SentTextMessage(plg.Bot, item.ChatID, "⏰ "+html.EscapeString(item.Text), tgbotapi.ModeHTML)
+		// temporary error is retried like in notifier outbox, but not later than next run of recurring reminder
+		if err != nil && !isPermanentError(err) && item.Attempts+1 < reminderMaxAttempts {
+			retry := now.Add(outboxBackoff(item.Attempts))
+			if item.Recurrence == nil || retry.Before(next) {
+				log.Printf("[WARN] cannot send reminder %d, retry at %s: %v", item.ID, retry.Format(time.RFC3339), err)
+				if err := plg.Store.Retry(item, retry); err != nil {
+					log.Printf("[ERROR] cannot update reminder %d: %v", item.ID, err)
+				}
+				continue
+			}
+		}
+		if err != nil {
+			log.Printf("[ERROR] cannot send reminder %d: %v", item.ID, err)
+		}
+		plg.finish(item, next)
+	}
+}
+
+// finish reschedules recurring reminder to next time and removes one-time reminder
+func (plg *Reminder) finish(item *ReminderItem, next time.Time) {
+	var err error
+	if item.Recurrence != nil {
+		err = plg.Store.Reschedule(item, next)
+	} else {
+		_, err = plg.Store.Remove(item.ChatID, item.ID)
+	}
+	if err != nil {
+		log.Printf("[ERROR] cannot update reminder %d: %v", item.ID, err)
+	}
+}
+
+func (plg *Reminder) handleRemind(_ context.Context, msg *tgbotapi.Message, args string) error {
+	loc := plg.chatLocation(msg.Chat.ID)
+	when, rec, text, err := parseReminder(args, time.Now().In(loc))
+	if err != nil {
+		return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Can't schedule: %s", err), "")
+	}
+
+	item := &ReminderItem{
+		ChatID:     msg.Chat.ID,
+		Text:       text,
+		Next:       when.Unix(),
+		Location:   loc.String(),
+		Recurrence: rec,
+	}
+	if msg.From != nil {
+		item.UserID = msg.From.ID
+	}
+	if err := plg.Store.Add(item); err != nil {
+		_ = common.ReplyWithText(plg.Bot, msg, "Can't schedule, internal error :(", "")
+		return err
+	}
+	return common.ReplyWithText(plg.Bot, msg, "Ok, "+formatReminder(item, loc), tgbotapi.ModeHTML)
+}
+
+func formatReminder(item *ReminderItem, loc *time.Location) string {
+	next := time.Unix(item.Next, 0).In(loc).Format("Mon Jan 2 15:04 MST")
+	line := fmt.Sprintf("#%d at %s", item.ID, next)
+	if item.Recurrence != nil {
+		line = fmt.Sprintf("%s (%s)", line, html.EscapeString(item.Recurrence.Spec))
+	}
+	return fmt.Sprintf("%s: %s", line, html.EscapeString(item.Text))
+}
+
+func (plg *Reminder) handleList(_ context.Context, msg *tgbotapi.Message, _ string) error {
+	items, err := plg.Store.ChatReminders(msg.Chat.ID)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return common.ReplyWithText(plg.Bot, msg, "No reminders", "")
+	}
+	loc := plg.chatLocation(msg.Chat.ID)
+	lines := []string{}
+	for i := range items {
+		lines = append(lines, formatReminder(&items[i], loc))
+	}
+	return common.ReplyWithText(plg.Bot, msg, strings.Join(lines, "\n"), tgbotapi.ModeHTML)
+}
+
+func (plg *Reminder) handleCancel(_ context.Context, msg *tgbotapi.Message, args string) error {
+	id, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(args), "#"))
+	if err != nil {
+		return common.ReplyWithText(plg.Bot, msg, "Pass reminder id, see /reminders", "")
+	}
+	removed, err := plg.Store.Remove(msg.Chat.ID, id)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return common.ReplyWithText(plg.Bot, msg, "Not found", "")
+	}
+	return common.ReplyWithText(plg.Bot, msg, "Ok, reminder cancelled", "")
+}
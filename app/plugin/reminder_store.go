@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+)
+
+// ReminderStore keeps scheduled reminders
+type ReminderStore struct {
+	Bkt storm.Node
+}
+
+// ReminderItem is a message to be sent to chat at Next time
+type ReminderItem struct {
+	ID     int   `storm:"id,increment"`
+	ChatID int64 `storm:"index"`
+	UserID int
+	Text   string
+	// Next is unix timestamp of next delivery
+	Next int64 `storm:"index"`
+	// Location is IANA name of timezone used to compute recurrence
+	Location   string
+	Recurrence *reminderRecurrence
+	// Attempts is number of failed deliveries of current run
+	Attempts int
+}
+
+func (s *ReminderStore) Add(item *ReminderItem) error {
+	return s.Bkt.Save(item)
+}
+
+func (s *ReminderStore) ChatReminders(chatID int64) ([]ReminderItem, error) {
+	var items []ReminderItem
+	err := s.Bkt.Find("ChatID", chatID, &items, storm.Limit(100))
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return items, err
+}
+
+// Due returns reminders which should be delivered before ts
+func (s *ReminderStore) Due(ts time.Time) ([]ReminderItem, error) {
+	var items []ReminderItem
+	err := s.Bkt.Select(q.Lte("Next", ts.Unix())).OrderBy("Next").Find(&items)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return items, err
+}
+
+// Reschedule sets new delivery time
+func (s *ReminderStore) Reschedule(item *ReminderItem, next time.Time) error {
+	item.Next = next.Unix()
+	if err := s.Bkt.UpdateField(item, "Next", item.Next); err != nil {
+		return err
+	}
+	if item.Attempts == 0 {
+		return nil
+	}
+	item.Attempts = 0
+	return s.Bkt.UpdateField(item, "Attempts", 0)
+}
+
+// Retry postpones delivery after failed attempt
+func (s *ReminderStore) Retry(item *ReminderItem, next time.Time) error {
+	item.Next = next.Unix()
+	item.Attempts++
+	return s.Bkt.Update(&ReminderItem{ID: item.ID, Next: item.Next, Attempts: item.Attempts})
+}
+
+// Remove deletes reminder if it belongs to chat, returns false if it's not found
+func (s *ReminderStore) Remove(chatID int64, id int) (bool, error) {
+	item := &ReminderItem{}
+	err := s.Bkt.One("ID", id, item)
+	if err == storm.ErrNotFound || (err == nil && item.ChatID != chatID) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, s.Bkt.DeleteStruct(item)
+}
@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReminder(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	// Wednesday
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, loc)
+
+	tbl := []struct {
+		args string
+		when time.Time
+		spec string
+		text string
+	}{
+		{"in 2 hours buy milk", now.Add(2 * time.Hour), "", "buy milk"},
+		{"tomorrow 10am call mom", time.Date(2020, 1, 2, 10, 0, 0, 0, loc), "", "call mom"},
+		{"9:00 standup", time.Date(2020, 1, 2, 9, 0, 0, 0, loc), "", "standup"},
+		{"every monday 10:00 post standup", time.Date(2020, 1, 6, 10, 0, 0, 0, loc), "every monday 10:00", "post standup"},
+		{"every day at 18:30 go home", time.Date(2020, 1, 1, 18, 30, 0, 0, loc), "every day at 18:30", "go home"},
+		{"every weekday 9am check mail", time.Date(2020, 1, 2, 9, 0, 0, 0, loc), "every weekday 9am", "check mail"},
+		{"every 2 hours drink water", now.Add(2 * time.Hour), "every 2 hours", "drink water"},
+	}
+	for _, tt := range tbl {
+		when, rec, text, err := parseReminder(tt.args, now)
+		require.NoError(t, err, tt.args)
+		assert.True(t, tt.when.Equal(when), "%s: %v != %v", tt.args, tt.when, when)
+		assert.Equal(t, tt.text, text, tt.args)
+		if tt.spec == "" {
+			assert.Nil(t, rec, tt.args)
+		} else {
+			require.NotNil(t, rec, tt.args)
+			assert.Equal(t, tt.spec, rec.Spec, tt.args)
+		}
+	}
+
+	for _, args := range []string{"", "buy milk", "in 2 hours", "every 1 minute ping", "every someday 10:00 x", "every monday x"} {
+		_, _, _, err := parseReminder(args, now)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestRecurrenceNext(t *testing.T) {
+	rec := &reminderRecurrence{Weekdays: []time.Weekday{time.Friday}, Hour: 10}
+	// Friday 10:00
+	ts := time.Date(2020, 1, 3, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2020, 1, 10, 10, 0, 0, 0, time.UTC), rec.next(ts, time.UTC))
+	assert.Equal(t, ts, rec.next(ts.Add(-time.Second), time.UTC))
+}
+
+func TestReminderDeliveryRetry(t *testing.T) {
+	bot, tg := newTestBot(t)
+	plg := &Reminder{Bot: bot, Store: &ReminderStore{Bkt: newTestDB(t).From("reminder")}}
+	now := time.Unix(1600000000, 0).UTC()
+
+	once := &ReminderItem{ChatID: 1, Text: "buy milk", Next: now.Unix(), Location: "UTC"}
+	require.NoError(t, plg.Store.Add(once))
+	daily := &ReminderItem{ChatID: 1, Text: "standup", Next: now.Unix(), Location: "UTC",
+		Recurrence: &reminderRecurrence{Spec: "every 5 minutes", Interval: 5 * time.Minute}}
+	require.NoError(t, plg.Store.Add(daily))
+
+	tg.SetFail(true)
+	plg.deliverDue(now)
+	items, err := plg.Store.ChatReminders(1)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	for _, item := range items {
+		assert.Equal(t, now.Add(10*time.Second).Unix(), item.Next, item.Text)
+		assert.Equal(t, 1, item.Attempts, item.Text)
+	}
+	assert.Empty(t, tg.Texts())
+
+	tg.SetFail(false)
+	plg.deliverDue(now.Add(10 * time.Second))
+	assert.Equal(t, []string{"⏰ buy milk", "⏰ standup"}, tg.Texts())
+	items, err = plg.Store.ChatReminders(1)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, "standup", items[0].Text)
+	assert.Equal(t, now.Add(5*time.Minute+10*time.Second).Unix(), items[0].Next)
+	assert.Equal(t, 0, items[0].Attempts)
+
+	// retry isn't scheduled after next run of recurring reminder
+	tg.SetFail(true)
+	items[0].Attempts = 4
+	require.NoError(t, plg.Store.Retry(&items[0], now.Add(time.Hour)))
+	plg.deliverDue(now.Add(time.Hour))
+	items, err = plg.Store.ChatReminders(1)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, now.Add(time.Hour+5*time.Minute).Unix(), items[0].Next)
+	assert.Equal(t, 0, items[0].Attempts)
+}
+
+func TestReminderDisabledOrDeniedChat(t *testing.T) {
+	bot, tg := newTestBot(t)
+	db := newTestDB(t)
+	plg := &Reminder{Bot: bot, Store: &ReminderStore{Bkt: db.From("reminder")}}
+	plg.Access = newTestAccess(t, db, 1, plg.Name())
+	plg.AllowedChat = func(chatID int64) bool { return chatID != 3 }
+	now := time.Unix(1600000000, 0).UTC()
+
+	require.NoError(t, plg.Store.Add(&ReminderItem{ChatID: 1, Text: "buy milk", Next: now.Unix(), Location: "UTC"}))
+	require.NoError(t, plg.Store.Add(&ReminderItem{ChatID: 1, Text: "standup", Next: now.Unix(), Location: "UTC",
+		Recurrence: &reminderRecurrence{Spec: "every 5 minutes", Interval: 5 * time.Minute}}))
+	require.NoError(t, plg.Store.Add(&ReminderItem{ChatID: 2, Text: "other chat", Next: now.Unix(), Location: "UTC"}))
+	require.NoError(t, plg.Store.Add(&ReminderItem{ChatID: 3, Text: "denied chat", Next: now.Unix(), Location: "UTC"}))
+
+	plg.deliverDue(now)
+	assert.Equal(t, []string{"⏰ other chat"}, tg.Texts())
+	items, err := plg.Store.ChatReminders(1)
+	require.NoError(t, err)
+	require.Len(t, items, 1, "skipped reminders are handled like sent ones")
+	assert.Equal(t, "standup", items[0].Text)
+	assert.Equal(t, now.Add(5*time.Minute).Unix(), items[0].Next)
+	items, err = plg.Store.ChatReminders(3)
+	require.NoError(t, err)
+	assert.Empty(t, items)
+}
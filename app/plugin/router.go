@@ -0,0 +1,217 @@
+package plugin
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// CommandHandler handles command, args is text after command
+type CommandHandler func(ctx context.Context, msg *tgbotapi.Message, args string) error
+
+// CallbackHandler handles callback query
+type CallbackHandler func(ctx context.Context, query *tgbotapi.CallbackQuery) error
+
+// MessageHandler handles message matched by hashtag or regexp, match contains regexp submatches
+type MessageHandler func(ctx context.Context, msg *tgbotapi.Message, match []string) error
+
+// Registrar is a PlugIn that declares its handlers in Router instead of handling updates itself
+type Registrar interface {
+	RegisterHandlers(r *Router)
+}
+
+type commandRoute struct {
+	plugin  string
+	desc    CommandDescription
+	handler CommandHandler
+	// anyChat allows command without bot mention in group chats
+	anyChat bool
+}
+
+type callbackRoute struct {
+	plugin  string
+	prefix  string
+	handler CallbackHandler
+}
+
+type messageRoute struct {
+	plugin  string
+	hashtag string
+	re      *regexp.Regexp
+	handler MessageHandler
+}
+
+// Router dispatches updates to handlers declared by plugins.
+// Commands in group chats are handled only if they are addressed to bot with @botname suffix.
+type Router struct {
+	NopPlugin
+	Bot *tgbotapi.BotAPI
+	// Access checks that plugin is enabled in chat and user may run command, everything is allowed if it's nil
+	Access *Access
+
+	// plugin is name of plugin which registers handlers now
+	plugin    string
+	commands  []commandRoute
+	callbacks []callbackRoute
+	messages  []messageRoute
+}
+
+// Register declares handlers of plugin, handlers of Named plugin may be disabled in chat
+func (r *Router) Register(reg Registrar) {
+	r.plugin = ""
+	if named, ok := reg.(Named); ok {
+		r.plugin = named.Name()
+	}
+	reg.RegisterHandlers(r)
+	r.plugin = ""
+}
+
+// Plugins returns sorted names of plugins with handlers
+func (r *Router) Plugins() []string {
+	names := map[string]bool{}
+	for _, route := range r.commands {
+		names[route.plugin] = true
+	}
+	for _, route := range r.callbacks {
+		names[route.plugin] = true
+	}
+	for _, route := range r.messages {
+		names[route.plugin] = true
+	}
+	res := []string{}
+	for name := range names {
+		if name != "" {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Command registers handler for command addressed to bot, command with empty Help isn't listed in help
+func (r *Router) Command(desc CommandDescription, h CommandHandler) {
+	r.commands = append(r.commands, commandRoute{plugin: r.plugin, desc: desc, handler: h})
+}
+
+// GroupCommand registers handler for command which may be sent to group chat without bot mention
+func (r *Router) GroupCommand(desc CommandDescription, h CommandHandler) {
+	r.commands = append(r.commands, commandRoute{plugin: r.plugin, desc: desc, handler: h, anyChat: true})
+}
+
+// Callback registers handler for callback queries with data starting with prefix
+func (r *Router) Callback(prefix string, h CallbackHandler) {
+	r.callbacks = append(r.callbacks, callbackRoute{plugin: r.plugin, prefix: prefix, handler: h})
+}
+
+// Hashtag registers handler for messages containing hashtag
+func (r *Router) Hashtag(tag string, h MessageHandler) {
+	r.messages = append(r.messages, messageRoute{plugin: r.plugin, hashtag: "#" + strings.TrimPrefix(tag, "#"), handler: h})
+}
+
+// Regexp registers handler for messages matching re
+func (r *Router) Regexp(re *regexp.Regexp, h MessageHandler) {
+	r.messages = append(r.messages, messageRoute{plugin: r.plugin, re: re, handler: h})
+}
+
+// Commands returns descriptions of registered commands
+func (r *Router) Commands() []CommandDescription {
+	cmds := []CommandDescription{}
+	for _, route := range r.commands {
+		if route.desc.Help != "" {
+			cmds = append(cmds, route.desc)
+		}
+	}
+	return cmds
+}
+
+// HandleUpdate calls first matched handler
+func (r *Router) HandleUpdate(ctx context.Context, upd *tgbotapi.Update) (bool, error) {
+	if upd.CallbackQuery != nil {
+		for _, route := range r.callbacks {
+			if strings.HasPrefix(upd.CallbackQuery.Data, route.prefix) {
+				if msg := upd.CallbackQuery.Message; msg != nil && !r.Access.PluginEnabled(ctx, msg.Chat.ID, route.plugin) {
+					return false, nil
+				}
+				return true, route.handler(ctx, upd.CallbackQuery)
+			}
+		}
+		return false, nil
+	}
+
+	msg := upd.Message
+	if msg == nil {
+		return false, nil
+	}
+	ctx = r.Access.WithChat(ctx, msg.Chat.ID)
+	if msg.IsCommand() {
+		return r.handleCommand(ctx, msg)
+	}
+
+	text, entities := msg.Text, msg.Entities
+	if text == "" {
+		text, entities = msg.Caption, msg.CaptionEntities
+	}
+	for _, route := range r.messages {
+		if !r.Access.PluginEnabled(ctx, msg.Chat.ID, route.plugin) {
+			continue
+		}
+		if route.re != nil {
+			if match := route.re.FindStringSubmatch(text); match != nil {
+				return true, route.handler(ctx, msg, match)
+			}
+			continue
+		}
+		if hasHashtag(text, entities, route.hashtag) {
+			return true, route.handler(ctx, msg, []string{route.hashtag})
+		}
+	}
+	return false, nil
+}
+
+func (r *Router) handleCommand(ctx context.Context, msg *tgbotapi.Message) (bool, error) {
+	cmd, botName := msg.CommandWithAt(), ""
+	if idx := strings.Index(cmd, "@"); idx >= 0 {
+		cmd, botName = cmd[:idx], cmd[idx+1:]
+	}
+	if botName != "" && !strings.EqualFold(botName, r.Bot.Self.UserName) {
+		return false, nil
+	}
+
+	for _, route := range r.commands {
+		if route.desc.Cmd != cmd {
+			continue
+		}
+		if botName == "" && !msg.Chat.IsPrivate() && !route.anyChat {
+			return false, nil
+		}
+		if !r.Access.PluginEnabled(ctx, msg.Chat.ID, route.plugin) {
+			return false, nil
+		}
+		if allowed, err := r.Access.CheckCommand(ctx, msg, route.desc); !allowed || err != nil {
+			return true, err
+		}
+		return true, route.handler(ctx, msg, msg.CommandArguments())
+	}
+	return false, nil
+}
+
+// hasHashtag checks hashtag entities of message, tags are compared case-insensitive
+func hasHashtag(text string, entities *[]tgbotapi.MessageEntity, tag string) bool {
+	if entities == nil {
+		return false
+	}
+	encoded := utf16.Encode([]rune(text))
+	for _, e := range *entities {
+		if e.Type != "hashtag" || e.Offset < 0 || e.Offset+e.Length > len(encoded) {
+			continue
+		}
+		if strings.EqualFold(string(utf16.Decode(encoded[e.Offset:e.Offset+e.Length])), tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func routerTestMessage(text string, private bool) *tgbotapi.Update {
+	chat := &tgbotapi.Chat{ID: -100, Type: "supergroup"}
+	if private {
+		chat = &tgbotapi.Chat{ID: 100, Type: "private"}
+	}
+	entities := []tgbotapi.MessageEntity{}
+	if strings.HasPrefix(text, "/") {
+		cmdLen := len(strings.Fields(text)[0])
+		entities = append(entities, tgbotapi.MessageEntity{Type: "bot_command", Offset: 0, Length: cmdLen})
+	}
+	if idx := strings.Index(text, "#"); idx >= 0 {
+		tagLen := len(strings.Fields(text[idx:])[0])
+		entities = append(entities, tgbotapi.MessageEntity{Type: "hashtag", Offset: len([]rune(text[:idx])), Length: tagLen})
+	}
+	return &tgbotapi.Update{Message: &tgbotapi.Message{Text: text, Chat: chat, Entities: &entities}}
+}
+
+func TestRouter(t *testing.T) {
+	r := &Router{Bot: &tgbotapi.BotAPI{Self: tgbotapi.User{UserName: "test_bot"}}}
+	called := []string{}
+	record := func(name string) CommandHandler {
+		return func(_ context.Context, _ *tgbotapi.Message, args string) error {
+			called = append(called, name+":"+args)
+			return nil
+		}
+	}
+	r.Command(CommandDescription{Cmd: "help", Help: "Show usage"}, record("help"))
+	r.Command(CommandDescription{Cmd: "help_short"}, record("help_short"))
+	r.GroupCommand(CommandDescription{Cmd: "time", Help: "Show time"}, record("time"))
+	r.Callback("poll#", func(_ context.Context, q *tgbotapi.CallbackQuery) error {
+		called = append(called, "callback:"+q.Data)
+		return nil
+	})
+	r.Hashtag("vote", func(_ context.Context, _ *tgbotapi.Message, match []string) error {
+		called = append(called, "hashtag:"+match[0])
+		return nil
+	})
+	r.Regexp(regexp.MustCompile(`^ping (\d+)$`), func(_ context.Context, _ *tgbotapi.Message, match []string) error {
+		called = append(called, "regexp:"+match[1])
+		return nil
+	})
+
+	assert.Equal(t, []CommandDescription{{Cmd: "help", Help: "Show usage"}, {Cmd: "time", Help: "Show time"}}, r.Commands())
+
+	tbl := []struct {
+		upd    *tgbotapi.Update
+		caught bool
+	}{
+		{routerTestMessage("/help@test_bot short", false), true},
+		{routerTestMessage("/help@Test_Bot", false), true},
+		{routerTestMessage("/help", true), true},
+		{routerTestMessage("/help", false), false},
+		{routerTestMessage("/help_short", false), false},
+		{routerTestMessage("/help@other_bot", false), false},
+		{routerTestMessage("/time tomorrow", false), true},
+		{routerTestMessage("/unknown@test_bot", false), false},
+		{routerTestMessage("great idea #Vote", false), true},
+		{routerTestMessage("#voteless", false), false},
+		{routerTestMessage("ping 42", false), true},
+		{routerTestMessage("just text", false), false},
+		{&tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{Data: "poll#1#2"}}, true},
+		{&tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{Data: "vote+"}}, false},
+	}
+	for _, tt := range tbl {
+		caught, err := r.HandleUpdate(context.Background(), tt.upd)
+		require.NoError(t, err)
+		text := ""
+		if tt.upd.Message != nil {
+			text = tt.upd.Message.Text
+		}
+		assert.Equal(t, tt.caught, caught, text)
+	}
+	assert.Equal(t, []string{"help:short", "help:", "help:", "time:tomorrow", "hashtag:#vote", "regexp:42", "callback:poll#1#2"}, called)
+}
@@ -0,0 +1,253 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/vdimir/tg-tobym/app/common"
+)
+
+const scheduleCheckInterval = 20 * time.Second
+
+// Scheduler sends recurring messages to chats by cron expressions
+type Scheduler struct {
+	NopPlugin
+	Bot   *tgbotapi.BotAPI
+	Store *ScheduleStore
+	// Timezones is used to evaluate cron in chat timezone, optional
+	Timezones *TimezoneConverter
+	// MissedRunGrace is how late run may be fired, e.g. after downtime or slow delivery, later runs are skipped.
+	// It's never less than scheduleCheckInterval.
+	MissedRunGrace time.Duration
+	// Access skips runs in chats where plugin is disabled, everything is sent if it's nil
+	Access *Access
+	// AllowedChat skips runs in denied chats, everything is sent if it's nil
+	AllowedChat func(chatID int64) bool
+
+	closeNotifier chan (struct{})
+	loopDone      chan (struct{})
+}
+
+// parseScheduleArgs parses `"0 9 * * 1-5" text` or `0 9 * * 1-5 text`
+func parseScheduleArgs(args string) (cronExpr string, text string, err error) {
+	args = strings.TrimSpace(args)
+	if strings.HasPrefix(args, `"`) {
+		end := strings.Index(args[1:], `"`)
+		if end < 0 {
+			return "", "", errors.Errorf("cron expression isn't closed by quote")
+		}
+		cronExpr, text = args[1:end+1], args[end+2:]
+	} else {
+		fields := strings.Fields(args)
+		if len(fields) < len(cronFields) {
+			return "", "", errors.Errorf("cron expression should have %d fields", len(cronFields))
+		}
+		cronExpr = strings.Join(fields[:len(cronFields)], " ")
+		for i := 0; i < len(cronFields); i++ {
+			args = strings.TrimSpace(args)
+			args = args[len(strings.Fields(args)[0]):]
+		}
+		text = args
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", "", errors.Errorf("text isn't set")
+	}
+	return cronExpr, text, nil
+}
+
+func (plg *Scheduler) chatLocation(chatID int64) *time.Location {
+	if plg.Timezones != nil {
+		if loc := plg.Timezones.PrimaryLocation(chatID); loc != nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+func (plg *Scheduler) Init() error {
+	plg.closeNotifier = make(chan struct{})
+	plg.loopDone = make(chan struct{})
+	go plg.runLoop()
+	return nil
+}
+
+func (plg *Scheduler) Close() error {
+	close(plg.closeNotifier)
+	select {
+	case <-plg.loopDone:
+	case <-time.After(5 * time.Second):
+		return errors.Errorf("scheduler loop isn't finished")
+	}
+	return nil
+}
+
+func (plg *Scheduler) Name() string {
+	return "schedule"
+}
+
+// RegisterHandlers declares schedule commands
+func (plg *Scheduler) RegisterHandlers(r *Router) {
+	r.Command(CommandDescription{
+		Cmd:     "schedule",
+		Help:    "Add recurring message",
+		Details: `Usage: /schedule "0 9 * * 1-5" Standup time! Cron is evaluated in chat primary timezone.`,
+	}, plg.handleAdd)
+	r.Command(CommandDescription{
+		Cmd:  "schedules",
+		Help: "List recurring messages",
+	}, plg.handleList)
+	r.Command(CommandDescription{
+		Cmd:  "schedule_delete",
+		Help: "Delete recurring message by id",
+	}, plg.handleDelete)
+}
+
+// sendEnabled checks that scheduled messages may be sent to chat
+func (plg *Scheduler) sendEnabled(chatID int64) bool {
+	if plg.AllowedChat != nil && !plg.AllowedChat(chatID) {
+		return false
+	}
+	return plg.Access.PluginEnabled(context.Background(), chatID, plg.Name())
+}
+
+func (plg *Scheduler) runLoop() {
+	defer close(plg.loopDone)
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		plg.runDue(time.Now())
+		select {
+		case <-plg.closeNotifier:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runDue sends due messages, runs which are late more than MissedRunGrace are skipped
+func (plg *Scheduler) runDue(now time.Time) {
+	grace := plg.MissedRunGrace
+	if grace < scheduleCheckInterval {
+		grace = scheduleCheckInterval
+	}
+	started := time.Now()
+	items, err := plg.Store.Due(now)
+	if err != nil {
+		log.Printf("[ERROR] cannot get schedules: %v", err)
+		return
+	}
+	for i := range items {
+		select {
+		case <-plg.closeNotifier:
+			return
+		default:
+		}
+
+		item := &items[i]
+		spec, err := parseCron(item.Cron)
+		if err != nil {
+			log.Printf("[ERROR] wrong cron in schedule %d: %v", item.ID, err)
+			continue
+		}
+		loc, err := time.LoadLocation(item.Location)
+		if err != nil {
+			loc = time.UTC
+		}
+
+		// sending previous items may take long time if messages are delayed by rate limits
+		cur := now.Add(time.Since(started))
+		late := cur.Sub(time.Unix(item.Next, 0))
+		if !plg.sendEnabled(item.ChatID) {
+			log.Printf("[INFO] skip schedule %d, chat %d is denied or plugin is disabled", item.ID, item.ChatID)
+		} else if late <= grace {
+			err = common.SentTextMessage(plg.Bot, item.ChatID, html.EscapeString(item.Text), tgbotapi.ModeHTML)
+			if err != nil {
+				log.Printf("[ERROR] cannot send scheduled message %d: %v", item.ID, err)
+			}
+		} else {
+			log.Printf("[INFO] skip schedule %d missed %v ago", item.ID, late)
+		}
+
+		if err := plg.Store.SetNext(item, spec.Next(cur.In(loc))); err != nil {
+			log.Printf("[ERROR] cannot update schedule %d: %v", item.ID, err)
+		}
+	}
+}
+
+func (plg *Scheduler) handleAdd(_ context.Context, msg *tgbotapi.Message, args string) error {
+	cronExpr, text, err := parseScheduleArgs(args)
+	if err != nil {
+		return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Can't schedule: %s", err), "")
+	}
+	spec, err := parseCron(cronExpr)
+	if err != nil {
+		return common.ReplyWithText(plg.Bot, msg, fmt.Sprintf("Can't schedule: %s", err), "")
+	}
+	loc := plg.chatLocation(msg.Chat.ID)
+	next := spec.Next(time.Now().In(loc))
+	if next.IsZero() {
+		return common.ReplyWithText(plg.Bot, msg, "Can't schedule: cron never fires", "")
+	}
+
+	item := &ScheduleItem{
+		ChatID:   msg.Chat.ID,
+		Cron:     cronExpr,
+		Text:     text,
+		Location: loc.String(),
+		Next:     next.Unix(),
+	}
+	if err := plg.Store.Add(item); err != nil {
+		_ = common.ReplyWithText(plg.Bot, msg, "Can't schedule, internal error :(", "")
+		return err
+	}
+	return common.ReplyWithText(plg.Bot, msg, "Ok, "+formatSchedule(item), tgbotapi.ModeHTML)
+}
+
+func formatSchedule(item *ScheduleItem) string {
+	loc, err := time.LoadLocation(item.Location)
+	if err != nil {
+		loc = time.UTC
+	}
+	next := time.Unix(item.Next, 0).In(loc).Format("Mon Jan 2 15:04 MST")
+	return fmt.Sprintf("#%d <code>%s</code> (%s), next at %s: %s",
+		item.ID, html.EscapeString(item.Cron), loc, next, html.EscapeString(item.Text))
+}
+
+func (plg *Scheduler) handleList(_ context.Context, msg *tgbotapi.Message, _ string) error {
+	items, err := plg.Store.ChatSchedules(msg.Chat.ID)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return common.ReplyWithText(plg.Bot, msg, "No recurring messages", "")
+	}
+	lines := []string{}
+	for i := range items {
+		lines = append(lines, formatSchedule(&items[i]))
+	}
+	return common.ReplyWithText(plg.Bot, msg, strings.Join(lines, "\n"), tgbotapi.ModeHTML)
+}
+
+func (plg *Scheduler) handleDelete(_ context.Context, msg *tgbotapi.Message, args string) error {
+	id, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(args), "#"))
+	if err != nil {
+		return common.ReplyWithText(plg.Bot, msg, "Pass schedule id, see /schedules", "")
+	}
+	removed, err := plg.Store.Remove(msg.Chat.ID, id)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return common.ReplyWithText(plg.Bot, msg, "Not found", "")
+	}
+	return common.ReplyWithText(plg.Bot, msg, "Ok, recurring message deleted", "")
+}
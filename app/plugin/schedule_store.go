@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+)
+
+// ScheduleStore keeps recurring messages
+type ScheduleStore struct {
+	Bkt storm.Node
+}
+
+// ScheduleItem is a message sent to chat by cron expression
+type ScheduleItem struct {
+	ID     int   `storm:"id,increment"`
+	ChatID int64 `storm:"index"`
+	Cron   string
+	Text   string
+	// Location is IANA name of timezone cron is evaluated in
+	Location string
+	// Next is unix timestamp of next run
+	Next int64 `storm:"index"`
+}
+
+func (s *ScheduleStore) Add(item *ScheduleItem) error {
+	return s.Bkt.Save(item)
+}
+
+func (s *ScheduleStore) ChatSchedules(chatID int64) ([]ScheduleItem, error) {
+	var items []ScheduleItem
+	err := s.Bkt.Find("ChatID", chatID, &items, storm.Limit(100))
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return items, err
+}
+
+// Due returns schedules with next run before ts
+func (s *ScheduleStore) Due(ts time.Time) ([]ScheduleItem, error) {
+	var items []ScheduleItem
+	err := s.Bkt.Select(q.Lte("Next", ts.Unix())).OrderBy("Next").Find(&items)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return items, err
+}
+
+func (s *ScheduleStore) SetNext(item *ScheduleItem, next time.Time) error {
+	item.Next = next.Unix()
+	return s.Bkt.UpdateField(item, "Next", item.Next)
+}
+
+// Remove deletes schedule if it belongs to chat, returns false if it's not found
+func (s *ScheduleStore) Remove(chatID int64, id int) (bool, error) {
+	item := &ScheduleItem{}
+	err := s.Bkt.One("ID", id, item)
+	if err == storm.ErrNotFound || (err == nil && item.ChatID != chatID) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, s.Bkt.DeleteStruct(item)
+}
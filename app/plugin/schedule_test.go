@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerMissedRunGrace(t *testing.T) {
+	bot, tg := newTestBot(t)
+	plg := &Scheduler{Bot: bot, Store: &ScheduleStore{Bkt: newTestDB(t).From("schedule")}, MissedRunGrace: 10 * time.Minute}
+	// Wednesday 12:00
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tbl := []struct {
+		text string
+		late time.Duration
+		sent bool
+	}{
+		{"on time", 0, true},
+		{"next tick", scheduleCheckInterval, true},
+		{"in grace", 9 * time.Minute, true},
+		{"too late", 11 * time.Minute, false},
+		{"after downtime", 5 * time.Hour, false},
+	}
+	for _, tt := range tbl {
+		item := &ScheduleItem{ChatID: 1, Cron: "0 * * * *", Text: tt.text, Location: "UTC", Next: now.Add(-tt.late).Unix()}
+		require.NoError(t, plg.Store.Add(item))
+	}
+
+	plg.runDue(now)
+	assert.ElementsMatch(t, []string{"on time", "next tick", "in grace"}, tg.Texts())
+
+	items, err := plg.Store.ChatSchedules(1)
+	require.NoError(t, err)
+	require.Len(t, items, len(tbl))
+	for _, item := range items {
+		assert.Equal(t, now.Add(time.Hour).Unix(), item.Next, item.Text)
+	}
+}
+
+func TestSchedulerDisabledOrDeniedChat(t *testing.T) {
+	bot, tg := newTestBot(t)
+	db := newTestDB(t)
+	plg := &Scheduler{Bot: bot, Store: &ScheduleStore{Bkt: db.From("schedule")}}
+	plg.Access = newTestAccess(t, db, 1, plg.Name())
+	plg.AllowedChat = func(chatID int64) bool { return chatID != 3 }
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	require.NoError(t, plg.Store.Add(&ScheduleItem{ChatID: 1, Cron: "0 * * * *", Text: "disabled", Location: "UTC", Next: now.Unix()}))
+	require.NoError(t, plg.Store.Add(&ScheduleItem{ChatID: 2, Cron: "0 * * * *", Text: "enabled", Location: "UTC", Next: now.Unix()}))
+	require.NoError(t, plg.Store.Add(&ScheduleItem{ChatID: 3, Cron: "0 * * * *", Text: "denied", Location: "UTC", Next: now.Unix()}))
+
+	plg.runDue(now)
+	assert.Equal(t, []string{"enabled"}, tg.Texts())
+	items, err := plg.Store.ChatSchedules(1)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, now.Add(time.Hour).Unix(), items[0].Next, "skipped run isn't repeated")
+}
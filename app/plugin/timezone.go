@@ -6,28 +6,26 @@ import (
 	"log"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/asdine/storm/v3"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/pkg/errors"
 	"github.com/tj/go-naturaldate"
 )
 
-type TimezoneConverterStore struct {
-	Bkt storm.Node
-}
-
-// TimezoneConverter ...
+// TimezoneConverter shows time in timezones set for chat
 type TimezoneConverter struct {
 	NopPlugin
 	Store     *TimezoneConverterStore
 	Bot       *tgbotapi.BotAPI
 	timezones map[int64]chatToLocation
+	mtx       sync.RWMutex
 }
 
+// chatToLocation is loaded timezones of chat, it's stored as chatTimezones
 type chatToLocation struct {
-	ChatID       int64 `storm:"id"`
+	ChatID       int64
 	Locations    []*time.Location
 	PrimLocation *time.Location
 }
@@ -35,107 +33,173 @@ type chatToLocation struct {
 func (tapp *TimezoneConverter) Init() (err error) {
 	tapp.timezones = map[int64]chatToLocation{}
 
-	// var chats []chatToLocation
-	// err = tapp.Store.Bkt.All(&chats)
-	// if err != nil {
-	// 	return errors.Wrapf(err, "error loading locations")
-	// }
-	// for _, c := range chats {
-	// 	tapp.timezones[c.ChatID] = c
-	// }
-	// log.Printf("[INFO] loaded locations for %d chats", len(chats))
+	chats, err := tapp.Store.LoadAll()
+	if err != nil {
+		return errors.Wrapf(err, "error loading locations")
+	}
+	for _, c := range chats {
+		tapp.timezones[c.ChatID] = c
+	}
+	log.Printf("[INFO] loaded locations for %d chats", len(chats))
 	return nil
 }
 
-func (tapp *TimezoneConverter) Commands() []CommandDescription {
-	return []CommandDescription{}
+func (tapp *TimezoneConverter) Name() string {
+	return "timezones"
 }
 
-func (tapp *TimezoneConverter) HandleUpdate(ctx context.Context, upd *tgbotapi.Update) (caught bool, err error) {
-	if upd.Message != nil {
-		chatID := upd.Message.Chat.ID
-		if upd.Message.Command() == "set_timezones" {
-			if upd.Message.CommandArguments() == "" {
-				resp := tgbotapi.NewMessage(chatID, "command need arguments")
-				_, err = tapp.Bot.Send(resp)
-				if err != nil {
-					return true, err
-				}
-				return true, nil
-			}
-			// err := tapp.Store.Bkt.Select(q.Eq("ChatID", chatID)).Delete(&chatToken{})
-			// if err != nil {
-			// 	log.Printf("[ERROR] error deleting locations from storage %v", err)
-			// }
-			tzNames := strings.Split(upd.Message.CommandArguments(), " ")
-			tzs := []*time.Location{}
-			for _, tzName := range tzNames {
-				tz, err := time.LoadLocation(tzName)
-				if err != nil {
-					resp := tgbotapi.NewMessage(chatID, fmt.Sprintf("Can't find timezone '%s': %s", tzName, err.Error()))
-					_, err = tapp.Bot.Send(resp)
-					if err != nil {
-						return true, err
-					}
-				}
-				tzs = append(tzs, tz)
-			}
-			if len(tzs) > 0 {
-				primTz := tzs[0]
-				curTime := time.Now()
-				sort.Slice(tzs, func(i, j int) bool {
-					_, offi := curTime.In(tzs[i]).Zone()
-					_, offj := curTime.In(tzs[j]).Zone()
-					return offi < offj
-				})
-
-				tapp.timezones[chatID] = chatToLocation{chatID, tzs, primTz}
-			}
-			// err = tapp.Store.Bkt.Save(&chatToLocation{chatID, tzs})
-			// if err != nil {
-			// 	log.Printf("[ERROR] error saving location to storage %v", err)
-			// }
-			log.Printf("[INFO] set %d locations for chat", len(tzs))
-			resp := tgbotapi.NewMessage(chatID, fmt.Sprintf("Ok, set %d locations", len(tzs)))
+// RegisterHandlers declares timezone commands, they are handled in groups without bot mention
+func (tapp *TimezoneConverter) RegisterHandlers(r *Router) {
+	r.GroupCommand(CommandDescription{
+		Cmd:        "set_timezones",
+		Help:       "Set timezones for chat",
+		Details:    "Pass IANA names separated by space, first one is primary (e.g. 'Europe/Berlin Asia/Tokyo').",
+		Permission: PermAdmins,
+	}, tapp.handleSetTimezones)
+	r.GroupCommand(CommandDescription{
+		Cmd:  "timezones",
+		Help: "Show timezones set for chat",
+	}, tapp.handleTimezones)
+	r.GroupCommand(CommandDescription{
+		Cmd:     "time",
+		Help:    "Show time in chat timezones",
+		Details: "Optional argument is time in primary timezone (e.g. 'tomorrow 5pm').",
+	}, tapp.handleTime)
+}
+
+func (tapp *TimezoneConverter) chatLocations(chatID int64) (chatToLocation, bool) {
+	tapp.mtx.RLock()
+	defer tapp.mtx.RUnlock()
+	tzs, has := tapp.timezones[chatID]
+	return tzs, has
+}
+
+// PrimaryLocation returns primary timezone of chat or nil if it isn't set
+func (tapp *TimezoneConverter) PrimaryLocation(chatID int64) *time.Location {
+	if tzs, has := tapp.chatLocations(chatID); has {
+		return tzs.PrimLocation
+	}
+	return nil
+}
+
+func (tapp *TimezoneConverter) setLocations(loc chatToLocation) error {
+	tapp.mtx.Lock()
+	defer tapp.mtx.Unlock()
+
+	err := tapp.Store.Save(loc)
+	if err != nil {
+		return err
+	}
+	tapp.timezones[loc.ChatID] = loc
+	return nil
+}
+
+func (tapp *TimezoneConverter) formatLocations(chatID int64) string {
+	tzs, has := tapp.chatLocations(chatID)
+	if !has || len(tzs.Locations) == 0 {
+		return "No timezones set, use /set_timezones"
+	}
+	textLines := []string{}
+	for _, tz := range tzs.Locations {
+		line := tz.String()
+		if tz.String() == tzs.PrimLocation.String() {
+			line = fmt.Sprintf("<b>%s</b> (primary)", tz)
+		}
+		textLines = append(textLines, line)
+	}
+	return strings.Join(textLines, "\n")
+}
+
+func (tapp *TimezoneConverter) handleSetTimezones(_ context.Context, msg *tgbotapi.Message, args string) error {
+	chatID := msg.Chat.ID
+	if args == "" {
+		_, err := tapp.Bot.Send(tgbotapi.NewMessage(chatID, "command need arguments"))
+		return err
+	}
+	tzNames := strings.Fields(args)
+	tzs := []*time.Location{}
+	for _, tzName := range tzNames {
+		tz, err := time.LoadLocation(tzName)
+		if err != nil {
+			resp := tgbotapi.NewMessage(chatID, fmt.Sprintf("Can't find timezone '%s': %s", tzName, err.Error()))
 			_, err = tapp.Bot.Send(resp)
-			if err != nil {
-				return true, err
-			}
+			return err
 		}
+		tzs = append(tzs, tz)
+	}
+	if len(tzs) > 0 {
+		primTz := tzs[0]
+		curTime := time.Now()
+		sort.Slice(tzs, func(i, j int) bool {
+			_, offi := curTime.In(tzs[i]).Zone()
+			_, offj := curTime.In(tzs[j]).Zone()
+			return offi < offj
+		})
+
+		err := tapp.setLocations(chatToLocation{chatID, tzs, primTz})
+		if err != nil {
+			resp := tgbotapi.NewMessage(chatID, "Can't save timezones, internal error :(")
+			_, _ = tapp.Bot.Send(resp)
+			return errors.Wrapf(err, "error saving locations to storage")
+		}
+	}
+	log.Printf("[INFO] set %d locations for chat", len(tzs))
+	_, err := tapp.Bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Ok, set %d locations", len(tzs))))
+	return err
+}
+
+func (tapp *TimezoneConverter) handleTimezones(_ context.Context, msg *tgbotapi.Message, _ string) error {
+	resp := tgbotapi.NewMessage(msg.Chat.ID, tapp.formatLocations(msg.Chat.ID))
+	resp.ParseMode = tgbotapi.ModeHTML
+	_, err := tapp.Bot.Send(resp)
+	return err
+}
+
+func (tapp *TimezoneConverter) handleTime(_ context.Context, msg *tgbotapi.Message, args string) error {
+	chatID := msg.Chat.ID
+	tzs, has := tapp.chatLocations(chatID)
+	if !has || len(tzs.Locations) <= 1 {
+		return nil
+	}
+	textLines := []string{}
 
-		if upd.Message.Command() == "time" {
-			if tzs, has := tapp.timezones[chatID]; has && len(tzs.Locations) > 1 {
-				textLines := []string{}
-
-				args := upd.Message.CommandArguments()
-				var d time.Time
-				var err error
-				if args == "" {
-					d = time.Now().In(tzs.PrimLocation)
-				} else {
-					d, err = naturaldate.Parse(upd.Message.CommandArguments(), time.Now().In(tzs.PrimLocation))
-					if err != nil {
-						resp := tgbotapi.NewMessage(chatID, fmt.Sprintf("Can't find time '%s'", err))
-						_, err = tapp.Bot.Send(resp)
-						if err != nil {
-							return true, err
-						}
-					}
-				}
-				for _, tz := range tzs.Locations {
-					tf := fmt.Sprintf("15:04 | <i>%s (-07)</i>", tz)
-					textLines = append(textLines, d.In(tz).Format(tf))
-				}
-				resp := tgbotapi.NewMessage(chatID, strings.Join(textLines, "\n"))
-				resp.ParseMode = tgbotapi.ModeHTML
-
-				_, err = tapp.Bot.Send(resp)
-				if err != nil {
-					return true, errors.Wrapf(err, "error send message")
-				}
+	d := time.Now().In(tzs.PrimLocation)
+	if args != "" {
+		var err error
+		d, err = naturaldate.Parse(args, time.Now().In(tzs.PrimLocation))
+		if err != nil {
+			resp := tgbotapi.NewMessage(chatID, fmt.Sprintf("Can't find time '%s'", err))
+			if _, err = tapp.Bot.Send(resp); err != nil {
+				return err
 			}
-			return true, nil
 		}
 	}
-	return false, nil
+	for _, tz := range tzs.Locations {
+		tf := fmt.Sprintf("15:04 | <i>%s (-07)</i>", tz)
+		textLines = append(textLines, d.In(tz).Format(tf))
+	}
+	resp := tgbotapi.NewMessage(chatID, strings.Join(textLines, "\n"))
+	resp.ParseMode = tgbotapi.ModeHTML
+
+	_, err := tapp.Bot.Send(resp)
+	return errors.Wrapf(err, "error send message")
+}
+
+// parseFutureTime parses natural date (e.g. '18:00', 'in 2 hours', 'tomorrow 10am') as moment after now.
+// Time of day which has passed already is moved to the next day.
+func parseFutureTime(s string, now time.Time) (time.Time, error) {
+	d, err := naturaldate.Parse(s, now, naturaldate.WithDirection(naturaldate.Future))
+	if err != nil {
+		return d, err
+	}
+	if d.Equal(now) {
+		return d, errors.Errorf("can't find time in '%s'", s)
+	}
+	if !d.After(now) && d.Add(24*time.Hour).After(now) {
+		d = d.Add(24 * time.Hour)
+	}
+	if !d.After(now) {
+		return d, errors.Errorf("can't find time in the future in '%s'", s)
+	}
+	return d, nil
 }
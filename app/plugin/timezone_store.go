@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"log"
+	"time"
+
+	"github.com/asdine/storm/v3"
+)
+
+// TimezoneConverterStore keeps chat timezones
+type TimezoneConverterStore struct {
+	Bkt storm.Node
+}
+
+// chatTimezones is stored representation of chatToLocation,
+// locations are kept as IANA names
+type chatTimezones struct {
+	ChatID       int64 `storm:"id"`
+	Locations    []string
+	PrimLocation string
+}
+
+// LoadAll returns timezones of all chats, unknown zone names are logged and skipped
+func (s *TimezoneConverterStore) LoadAll() ([]chatToLocation, error) {
+	var stored []chatTimezones
+	err := s.Bkt.All(&stored)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]chatToLocation, 0, len(stored))
+	for _, c := range stored {
+		loc := chatToLocation{ChatID: c.ChatID}
+		for _, name := range c.Locations {
+			tz, err := time.LoadLocation(name)
+			if err != nil {
+				log.Printf("[WARN] skip location %q of chat %d: %v", name, c.ChatID, err)
+				continue
+			}
+			loc.Locations = append(loc.Locations, tz)
+		}
+		if len(loc.Locations) == 0 {
+			log.Printf("[WARN] no valid locations for chat %d", c.ChatID)
+			continue
+		}
+		loc.PrimLocation, err = time.LoadLocation(c.PrimLocation)
+		if err != nil {
+			log.Printf("[WARN] primary location %q of chat %d replaced with %s: %v",
+				c.PrimLocation, c.ChatID, loc.Locations[0], err)
+			loc.PrimLocation = loc.Locations[0]
+		}
+		res = append(res, loc)
+	}
+	return res, nil
+}
+
+func (s *TimezoneConverterStore) Save(loc chatToLocation) error {
+	data := &chatTimezones{
+		ChatID:       loc.ChatID,
+		Locations:    make([]string, 0, len(loc.Locations)),
+		PrimLocation: loc.PrimLocation.String(),
+	}
+	for _, tz := range loc.Locations {
+		data.Locations = append(data.Locations, tz.String())
+	}
+	return s.Bkt.Save(data)
+}
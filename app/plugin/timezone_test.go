@@ -0,0 +1,69 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimezoneStoreLoadAll(t *testing.T) {
+	store := &TimezoneConverterStore{Bkt: newTestDB(t).From("timezones")}
+	require.NoError(t, store.Bkt.Save(&chatTimezones{ChatID: 1, Locations: []string{"Europe/Berlin", "Mars/Olympus"}, PrimLocation: "Mars/Olympus"}))
+	require.NoError(t, store.Bkt.Save(&chatTimezones{ChatID: 2, Locations: []string{"Mars/Olympus"}, PrimLocation: "Mars/Olympus"}))
+	require.NoError(t, store.Bkt.Save(&chatTimezones{ChatID: 3, Locations: []string{"Asia/Tokyo", "UTC"}, PrimLocation: "UTC"}))
+
+	chats, err := store.LoadAll()
+	require.NoError(t, err)
+	require.Len(t, chats, 2)
+	assert.Equal(t, int64(1), chats[0].ChatID)
+	require.Len(t, chats[0].Locations, 1)
+	assert.Equal(t, "Europe/Berlin", chats[0].PrimLocation.String())
+	assert.Equal(t, int64(3), chats[1].ChatID)
+	assert.Equal(t, "UTC", chats[1].PrimLocation.String())
+
+	tapp := &TimezoneConverter{Store: store}
+	require.NoError(t, tapp.Init())
+	assert.Equal(t, "UTC", tapp.PrimaryLocation(3).String())
+	assert.Nil(t, tapp.PrimaryLocation(2))
+}
+
+func TestTimezoneCommands(t *testing.T) {
+	bot, tg := newTestBot(t)
+	tapp := &TimezoneConverter{Store: &TimezoneConverterStore{Bkt: newTestDB(t).From("timezones")}, Bot: bot}
+	require.NoError(t, tapp.Init())
+	msg := &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: -100, Type: "supergroup"}}
+
+	tbl := []struct {
+		cmd   string
+		args  string
+		reply string
+	}{
+		{"timezones", "", "No timezones set, use /set_timezones"},
+		{"set_timezones", "", "command need arguments"},
+		{"set_timezones", "Europe/Berlin Mars/Olympus", "Can't find timezone 'Mars/Olympus': unknown time zone Mars/Olympus"},
+		{"timezones", "", "No timezones set, use /set_timezones"},
+		{"set_timezones", "Europe/Berlin America/New_York Asia/Tokyo", "Ok, set 3 locations"},
+		{"timezones", "", "America/New_York\n<b>Europe/Berlin</b> (primary)\nAsia/Tokyo"},
+		{"set_timezones", "UTC", "Ok, set 1 locations"},
+		{"timezones", "", "<b>UTC</b> (primary)"},
+	}
+	for i, tt := range tbl {
+		var err error
+		if tt.cmd == "timezones" {
+			err = tapp.handleTimezones(context.Background(), msg, tt.args)
+		} else {
+			err = tapp.handleSetTimezones(context.Background(), msg, tt.args)
+		}
+		require.NoError(t, err, "%d: /%s %s", i, tt.cmd, tt.args)
+		texts := tg.Texts()
+		require.Len(t, texts, i+1)
+		assert.Equal(t, tt.reply, texts[i], "%d: /%s %s", i, tt.cmd, tt.args)
+	}
+
+	reloaded := &TimezoneConverter{Store: tapp.Store}
+	require.NoError(t, reloaded.Init())
+	assert.Equal(t, "UTC", reloaded.PrimaryLocation(-100).String())
+}
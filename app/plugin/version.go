@@ -13,23 +13,18 @@ type ShowVersion struct {
 	Version string
 }
 
-func (plg *ShowVersion) Commands() []CommandDescription {
-	return []CommandDescription{{
+// RegisterHandlers declares version command
+func (sapp *ShowVersion) RegisterHandlers(r *Router) {
+	r.Command(CommandDescription{
 		Cmd:     "version",
 		Help:    "Show version (CommitHash-Date_Time)",
 		Details: "",
-	}}
+	}, sapp.handleVersion)
 }
 
-// HandleUpdate processes event
-func (sapp *ShowVersion) HandleUpdate(ctx context.Context, upd *tgbotapi.Update) (caught bool, err error) {
-	if upd.Message != nil && (sapp.Bot.IsMessageToMe(*upd.Message) || upd.Message.Chat.IsPrivate()) {
-		if cmd := upd.Message.Command(); cmd == "version" {
-			resp := tgbotapi.NewMessage(upd.Message.Chat.ID, fmt.Sprintf("`%s`", sapp.Version))
-			resp.ParseMode = tgbotapi.ModeMarkdownV2
-			_, err = sapp.Bot.Send(resp)
-			return true, err
-		}
-	}
-	return false, err
+func (sapp *ShowVersion) handleVersion(_ context.Context, msg *tgbotapi.Message, _ string) error {
+	resp := tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("`%s`", sapp.Version))
+	resp.ParseMode = tgbotapi.ModeMarkdownV2
+	_, err := sapp.Bot.Send(resp)
+	return err
 }
@@ -25,43 +25,76 @@ type VoteApp struct {
 	Stat  *LastMessage
 }
 
-// HandleUpdate processes event
+// Init migrates votes saved by previous versions
+func (vapp *VoteApp) Init() error {
+	return vapp.Store.MigrateVotes()
+}
+
+func (vapp *VoteApp) Name() string {
+	return "vote"
+}
+
+// RegisterHandlers declares vote commands and callbacks
+func (vapp *VoteApp) RegisterHandlers(r *Router) {
+	r.Command(CommandDescription{
+		Cmd:  voteSettingsCmd,
+		Help: "Show or change voting settings for chat (admins only)",
+		Details: "Arguments: 'on' or 'off' to enable or disable voting, 'hashtag #tag' to change trigger, " +
+			"'prompt text' to change message, 'reset' to restore defaults.",
+		Scopes: []string{CommandScopeAdmins},
+	}, vapp.handleSettingsCmd)
+	r.Command(CommandDescription{
+		Cmd:     voteTopCmd,
+		Help:    "Show top voted authors and messages",
+		Details: "Optional period: day, week (default), month or all.",
+		Scopes:  []string{CommandScopeGroups},
+	}, vapp.handleStatCmd(voteTopCmd))
+	r.Command(CommandDescription{
+		Cmd:     voteKarmaCmd,
+		Help:    "Show karma of user",
+		Details: "Optional @username (or reply to message) and period: day, week, month or all (default).",
+		Scopes:  []string{CommandScopeGroups},
+	}, vapp.handleStatCmd(voteKarmaCmd))
+	r.Callback(voteCallbackDataPrefix, vapp.handleCallcackQuery)
+}
+
+// HandleUpdate sends vote form for votable messages, hashtag is set per chat so it isn't routed
 func (vapp *VoteApp) HandleUpdate(ctx context.Context, upd *tgbotapi.Update) (caught bool, err error) {
 	if upd.Message != nil {
 		err = vapp.handleMessage(upd.Message)
 	}
-	if upd.CallbackQuery != nil {
-		err = vapp.handleCallcackQuery(upd.CallbackQuery)
-	}
 	return false, err
 }
 
-func (vapp *VoteApp) isVotable(msg *tgbotapi.Message) int {
+// isVotable returns message to vote for or nil and options for vote with custom buttons
+func (vapp *VoteApp) isVotable(msg *tgbotapi.Message, hashtag string) (*tgbotapi.Message, []string) {
 	if msg.From == nil {
-		return 0
+		return nil, nil
 	}
 	isReply := msg.ReplyToMessage != nil
+	options, isTrigger := parseVoteTrigger(msg.Text, hashtag)
 
-	isTriggerToOther := msg.Text == "#vote" && isReply && !msg.ReplyToMessage.From.IsBot
+	isTriggerToOther := isTrigger && isReply &&
+		msg.ReplyToMessage.From != nil && !msg.ReplyToMessage.From.IsBot
 
 	if isTriggerToOther {
-		return msg.ReplyToMessage.MessageID
+		return msg.ReplyToMessage, options
 	}
 
-	if msg.Text == "#vote" && !isReply {
+	if isTrigger && !isReply {
 		msg := vapp.Stat.Select(msg.Chat.ID, func(msg *tgbotapi.Message) bool {
-			return !strings.Contains(msg.Text, "#vote") && !msg.IsCommand()
+			return !strings.Contains(msg.Text, hashtag) && !msg.IsCommand()
 		})
 		if msg != nil {
-			return msg.MessageID
+			return msg, options
 		}
 	}
 
-	containsHash := strings.Contains(msg.Text, "#vote") && len(msg.Text) > 5 && msg.ReplyToMessage == nil
-	if containsHash {
-		return msg.MessageID
+	containsHash := strings.Contains(msg.Text, hashtag) && len(msg.Text) > len(hashtag) && msg.ReplyToMessage == nil
+	if containsHash && !isTrigger {
+		return msg, nil
 	}
-	return 0
+	return nil, nil
 }
 
 type voteAggregateMsgInfo struct {
@@ -99,14 +132,34 @@ func (info voteAggregateMsgInfo) inlineKeyboardRow() []tgbotapi.InlineKeyboardBu
 	)
 }
 
+// voteWeight is contribution of user to score, it grows logarithmically with number of clicks
+func voteWeight(score int) int {
+	return int(math.Log2(1.0 + math.Abs(float64(score))))
+}
+
+// msgScore is total score of message with user votes weighted by voteWeight, see starsScore for star rating
+func msgScore(votes *MsgVote) int {
+	if votes.isStars() {
+		return starsScore(votes)
+	}
+	total := 0
+	for _, score := range votes.Users {
+		if score > 0 {
+			total += voteWeight(score)
+		} else if score < 0 {
+			total -= voteWeight(score)
+		}
+	}
+	return total
+}
+
 func (vapp *VoteApp) calcScore(votes *MsgVote, userID int) (info voteAggregateMsgInfo) {
 	info.TotalUsers = len(votes.Users)
 
 	for uid, score := range votes.Users {
-		logit := 1.0 + math.Abs(float64(score))
-		delta := int(math.Log2(logit))
+		delta := voteWeight(score)
 		if uid == userID {
-			oldDelta := int(math.Log2(logit - 1.0))
+			oldDelta := int(math.Log2(math.Abs(float64(score))))
 			info.Modified = delta != oldDelta
 
 			info.CurrentUserTotal = score
@@ -143,9 +196,23 @@ func (vapp *VoteApp) updateVote(msg *tgbotapi.CallbackQuery) (voteAggregateMsgIn
 	return info, nil
 }
 
-func (vapp *VoteApp) handleCallcackQuery(msg *tgbotapi.CallbackQuery) error {
+func (vapp *VoteApp) handleCallcackQuery(_ context.Context, msg *tgbotapi.CallbackQuery) error {
 	errs := &multierror.Error{}
-	if strings.HasPrefix(msg.Data, voteCallbackDataPrefix) {
+	if strings.HasPrefix(msg.Data, voteCallbackDataOption) {
+		if msg.Message.ReplyToMessage == nil {
+			return errors.New("vote callback is not a reply")
+		}
+		text, markup, err := vapp.handleOptionCallback(msg)
+		if err != nil {
+			return err
+		}
+
+		_, err = vapp.Bot.AnswerCallbackQuery(tgbotapi.NewCallback(msg.ID, text))
+		errs = multierror.Append(errs, err)
+
+		_, err = vapp.Bot.Send(tgbotapi.NewEditMessageReplyMarkup(msg.Message.Chat.ID, msg.Message.MessageID, *markup))
+		errs = multierror.Append(errs, err)
+	} else if strings.HasPrefix(msg.Data, voteCallbackDataPrefix) {
 		if msg.Message.ReplyToMessage == nil {
 			return errors.New("vote callback is not a reply")
 		}
@@ -176,26 +243,39 @@ func (vapp *VoteApp) handleCallcackQuery(msg *tgbotapi.CallbackQuery) error {
 }
 
 func (vapp *VoteApp) handleMessage(msg *tgbotapi.Message) (err error) {
-	if msgID := vapp.isVotable(msg); msgID != 0 {
+	settings, err := vapp.Store.Settings(msg.Chat.ID)
+	if err != nil {
+		return err
+	}
+	if settings.Disabled {
+		return nil
+	}
+	if votedMsg, options := vapp.isVotable(msg, settings.Hashtag); votedMsg != nil {
+		msgID := votedMsg.MessageID
 		msgChatID := MsgChatID{
 			MessageID: msgID,
 			ChatID:    msg.Chat.ID,
 		}
-		if has, err := vapp.Store.HasVote(msgChatID); has {
-			return nil
-		} else if err == nil {
-			_, err = vapp.Store.NewVote(msg.Time(), msgChatID, msg.From.ID)
+		has, err := vapp.Store.HasVote(msgChatID)
+		if has || err != nil {
+			return err
 		}
+		_, err = vapp.Store.NewVote(msg.Time(), msgChatID, votedMsg.From, options)
 		if err != nil {
 			return err
 		}
 
-		respMsg := tgbotapi.NewMessage(msg.Chat.ID, "let's score it, guys")
+		respMsg := tgbotapi.NewMessage(msg.Chat.ID, settings.Prompt)
 		respMsg.ReplyToMessageID = msgID
 
-		respMsg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
-			voteAggregateMsgInfo{}.inlineKeyboardRow())
+		if options != nil {
+			respMsg.ReplyMarkup = voteOptionsKeyboard(options, nil)
+		} else {
+			respMsg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+				voteAggregateMsgInfo{}.inlineKeyboardRow())
+		}
 		_, err = vapp.Bot.Send(respMsg)
+		return err
 	}
 	return err
 }
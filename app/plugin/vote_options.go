@@ -0,0 +1,188 @@
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+)
+
+// voteCallbackDataOption is followed by option index, e.g. "vote#2"
+const voteCallbackDataOption = voteCallbackDataPrefix + "#"
+
+const voteVariantStars = "stars"
+
+var voteStarOptions = []string{"1⭐", "2⭐", "3⭐", "4⭐", "5⭐"}
+
+// voteNeutralStars is rating which doesn't change score of message
+const voteNeutralStars = 3
+const voteMaxOptions = 8
+const voteMaxOptionLen = 24
+const voteOptionsPerRow = 5
+
+// parseVoteVariant parses argument of vote hashtag.
+// Supported variants are 'stars', list of emoji (e.g. '👍👎🤔') and words separated by slash (e.g. 'yes/no/maybe').
+// Returns nil options for unknown variant.
+func parseVoteVariant(variant string) []string {
+	if variant == voteVariantStars {
+		return append([]string{}, voteStarOptions...)
+	}
+
+	var options []string
+	if strings.Contains(variant, "/") {
+		for _, opt := range strings.Split(variant, "/") {
+			opt = strings.TrimSpace(opt)
+			if opt == "" || len(opt) > voteMaxOptionLen {
+				return nil
+			}
+			options = append(options, opt)
+		}
+	} else {
+		options = splitEmoji(variant)
+	}
+
+	if len(options) < 2 || len(options) > voteMaxOptions {
+		return nil
+	}
+	return options
+}
+
+// splitEmoji splits string consisting only of emoji to separate ones, returns nil if there is something else.
+// Flags (pairs of regional indicators) and keycaps (like 1️⃣) are kept as single emoji.
+func splitEmoji(s string) []string {
+	isModifier := func(r rune) bool {
+		return r == '\u200d' || r == '\ufe0f' || (r >= 0x1f3fb && r <= 0x1f3ff)
+	}
+	isRegional := func(r rune) bool {
+		return r >= 0x1f1e6 && r <= 0x1f1ff
+	}
+	isKeycapBase := func(r rune) bool {
+		return (r >= '0' && r <= '9') || r == '#' || r == '*'
+	}
+
+	var res []string
+	joinNext := false
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if isKeycapBase(r) {
+			// keycap is base symbol, optional variation selector and combining enclosing keycap
+			j := i + 1
+			if j < len(runes) && runes[j] == '\ufe0f' {
+				j++
+			}
+			if j >= len(runes) || runes[j] != '\u20e3' {
+				return nil
+			}
+			res = append(res, string(runes[i:j+1]))
+			i, joinNext = j, false
+			continue
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || unicode.IsPunct(r) {
+			return nil
+		}
+		if len(res) > 0 && (joinNext || isModifier(r)) {
+			res[len(res)-1] += string(r)
+		} else if isModifier(r) {
+			return nil
+		} else if isRegional(r) {
+			if i+1 >= len(runes) || !isRegional(runes[i+1]) {
+				return nil
+			}
+			res = append(res, string(runes[i:i+2]))
+			i++
+		} else {
+			res = append(res, string(r))
+		}
+		joinNext = r == '\u200d'
+	}
+	return res
+}
+
+// parseVoteTrigger checks that text is hashtag optionally followed by variant and returns variant options.
+// Nil options mean default +/- vote.
+func parseVoteTrigger(text string, hashtag string) (options []string, ok bool) {
+	if text == hashtag {
+		return nil, true
+	}
+	if !strings.HasPrefix(text, hashtag+" ") {
+		return nil, false
+	}
+	options = parseVoteVariant(strings.TrimSpace(strings.TrimPrefix(text, hashtag)))
+	return options, options != nil
+}
+
+// isStars checks that vote is star rating
+func (v *MsgVote) isStars() bool {
+	if len(v.Options) != len(voteStarOptions) {
+		return false
+	}
+	for i, opt := range v.Options {
+		if opt != voteStarOptions[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isScored checks that vote changes score of message in stats.
+// Emoji and custom options aren't ranked, so such votes don't have score.
+func (v *MsgVote) isScored() bool {
+	return len(v.Options) == 0 || v.isStars()
+}
+
+// starsScore sums ratings relative to neutral one, e.g. 5⭐ adds 2 and 1⭐ subtracts 2
+func starsScore(v *MsgVote) int {
+	total := 0
+	for _, opt := range v.Choices {
+		total += opt + 1 - voteNeutralStars
+	}
+	return total
+}
+
+func voteOptionsKeyboard(options []string, tally []int) tgbotapi.InlineKeyboardMarkup {
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	row := []tgbotapi.InlineKeyboardButton{}
+	for i, opt := range options {
+		text := opt
+		if i < len(tally) && tally[i] > 0 {
+			text = fmt.Sprintf("%s %d", opt, tally[i])
+		}
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(text, voteCallbackDataOption+strconv.Itoa(i)))
+		if len(row) == voteOptionsPerRow {
+			rows = append(rows, row)
+			row = []tgbotapi.InlineKeyboardButton{}
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+func (vapp *VoteApp) handleOptionCallback(msg *tgbotapi.CallbackQuery) (answer string, markup *tgbotapi.InlineKeyboardMarkup, err error) {
+	option, err := strconv.Atoi(strings.TrimPrefix(msg.Data, voteCallbackDataOption))
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "wrong vote option %q", msg.Data)
+	}
+
+	msgID := MsgChatID{
+		MessageID: msg.Message.ReplyToMessage.MessageID,
+		ChatID:    msg.Message.Chat.ID,
+	}
+	votedMsg, err := vapp.Store.SetChoice(msgID, msg.From.ID, option)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if choice, has := votedMsg.Choices[msg.From.ID]; has {
+		answer = fmt.Sprintf("You chose %s", votedMsg.Options[choice])
+	} else {
+		answer = "Vote retracted"
+	}
+	kb := voteOptionsKeyboard(votedMsg.Options, votedMsg.Tally())
+	return answer, &kb, nil
+}
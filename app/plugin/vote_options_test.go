@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVoteTrigger(t *testing.T) {
+	tbl := []struct {
+		text    string
+		options []string
+		ok      bool
+	}{
+		{"#vote", nil, true},
+		{"#vote stars", []string{"1⭐", "2⭐", "3⭐", "4⭐", "5⭐"}, true},
+		{"#vote 👍👎🤔", []string{"👍", "👎", "🤔"}, true},
+		{"#vote ❤️👍🏻", []string{"❤️", "👍🏻"}, true},
+		{"#vote 🇩🇪🇫🇷🇮🇹", []string{"🇩🇪", "🇫🇷", "🇮🇹"}, true},
+		{"#vote 1️⃣2️⃣#️⃣*️⃣", []string{"1️⃣", "2️⃣", "#️⃣", "*️⃣"}, true},
+		{"#vote 🇩🇪👍", []string{"🇩🇪", "👍"}, true},
+		{"#vote 🇩🇪🇫", nil, false},
+		{"#vote 1️⃣2", nil, false},
+		{"#vote yes/no/maybe", []string{"yes", "no", "maybe"}, true},
+		{"#vote yes/", nil, false},
+		{"#vote 👍", nil, false},
+		{"#vote it's great", nil, false},
+		{"great #vote", nil, false},
+	}
+	for _, tt := range tbl {
+		options, ok := parseVoteTrigger(tt.text, "#vote")
+		assert.Equal(t, tt.ok, ok, tt.text)
+		assert.Equal(t, tt.options, options, tt.text)
+	}
+}
+
+func TestOptionVotesScore(t *testing.T) {
+	stars := &MsgVote{Options: parseVoteVariant("stars"), Choices: map[int]int{1: 4, 2: 4, 3: 0, 4: 2}}
+	emoji := &MsgVote{Options: parseVoteVariant("👍👎"), Choices: map[int]int{1: 0, 2: 0}}
+	custom := &MsgVote{Options: parseVoteVariant("yes/no"), Choices: map[int]int{1: 0}}
+	plusMinus := &MsgVote{Users: map[int]int{1: 1, 2: -1, 3: 3}}
+
+	tbl := []struct {
+		vote   *MsgVote
+		scored bool
+		score  int
+	}{
+		{stars, true, 2},
+		{&MsgVote{Options: parseVoteVariant("stars")}, true, 0},
+		{emoji, false, 0},
+		{custom, false, 0},
+		{plusMinus, true, 2},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.scored, tt.vote.isScored(), i)
+		assert.Equal(t, tt.score, msgScore(tt.vote), i)
+	}
+
+	votes := []MsgVote{*stars, *emoji, *custom}
+	for i := range votes {
+		votes[i].ID = MsgChatID{MessageID: i + 1, ChatID: -1001}
+		votes[i].Author = 10 + i
+	}
+	stats := aggregateVoteAuthors(votes)
+	require.Len(t, stats, 1)
+	assert.Equal(t, 10, stats[0].ID)
+	assert.Equal(t, 2, stats[0].Score)
+	assert.Equal(t, "No votes for period 'week'", formatVoteTop(&tgbotapi.Chat{ID: -1001}, "week", votes[1:]))
+}
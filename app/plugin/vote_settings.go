@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vdimir/tg-tobym/app/common"
+)
+
+const voteSettingsCmd = "vote_settings"
+
+func formatVoteSettings(settings *VoteSettings) string {
+	status := "enabled"
+	if settings.Disabled {
+		status = "disabled"
+	}
+	return fmt.Sprintf("Voting is <b>%s</b>\nHashtag: %s\nPrompt: %s",
+		status, html.EscapeString(settings.Hashtag), html.EscapeString(settings.Prompt))
+}
+
+func (vapp *VoteApp) handleSettingsCmd(_ context.Context, msg *tgbotapi.Message, args string) error {
+	settings, err := vapp.Store.Settings(msg.Chat.ID)
+	if err != nil {
+		return err
+	}
+
+	args = strings.TrimSpace(args)
+	if args == "" {
+		return common.ReplyWithText(vapp.Bot, msg, formatVoteSettings(settings), tgbotapi.ModeHTML)
+	}
+
+	if msg.From == nil {
+		return nil
+	}
+	isAdmin, err := common.IsChatAdmin(vapp.Bot, msg.Chat, msg.From.ID)
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		return common.ReplyWithText(vapp.Bot, msg, "Only chat admins can change voting settings", "")
+	}
+
+	action, value := args, ""
+	if idx := strings.IndexAny(args, " \n"); idx >= 0 {
+		action, value = args[:idx], strings.TrimSpace(args[idx+1:])
+	}
+
+	switch action {
+	case "on":
+		settings.Disabled = false
+	case "off":
+		settings.Disabled = true
+	case "hashtag":
+		tag := strings.TrimPrefix(value, "#")
+		if tag == "" || strings.ContainsAny(tag, " \n#") {
+			return common.ReplyWithText(vapp.Bot, msg, "Hashtag should be a single word", "")
+		}
+		settings.Hashtag = "#" + tag
+	case "prompt":
+		if value == "" {
+			return common.ReplyWithText(vapp.Bot, msg, "Prompt shouldn't be empty", "")
+		}
+		settings.Prompt = value
+	case "reset":
+		if err := vapp.Store.ResetSettings(msg.Chat.ID); err != nil {
+			return err
+		}
+		settings = defaultVoteSettings(msg.Chat.ID)
+		return common.ReplyWithText(vapp.Bot, msg, formatVoteSettings(settings), tgbotapi.ModeHTML)
+	default:
+		return common.ReplyWithText(vapp.Bot, msg, fmt.Sprintf("Unknown argument '%s'", action), "")
+	}
+
+	if err := vapp.Store.SaveSettings(settings); err != nil {
+		_ = common.ReplyWithText(vapp.Bot, msg, "Can't save settings, internal error :(", "")
+		return err
+	}
+	return common.ReplyWithText(vapp.Bot, msg, formatVoteSettings(settings), tgbotapi.ModeHTML)
+}
@@ -0,0 +1,255 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/vdimir/tg-tobym/app/common"
+)
+
+const voteTopCmd = "top"
+const voteKarmaCmd = "karma"
+
+const voteTopAuthorsLimit = 10
+const voteTopMessagesLimit = 5
+
+var voteWindows = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"all":   0,
+}
+
+type voteAuthorStat struct {
+	ID        int
+	UserName  string
+	Name      string
+	Score     int
+	Messages  int
+	Best      *MsgVote
+	BestScore int
+}
+
+// parseVoteWindow returns start of window by name, unix epoch for 'all'
+func parseVoteWindow(name string, now time.Time) (time.Time, bool) {
+	d, ok := voteWindows[name]
+	if !ok {
+		return time.Time{}, false
+	}
+	if d == 0 {
+		return time.Unix(0, 0), true
+	}
+	return now.Add(-d), true
+}
+
+// messageLink returns link to message if it's possible to build one for chat
+func messageLink(chat *tgbotapi.Chat, msgID int) string {
+	if chat.UserName != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", chat.UserName, msgID)
+	}
+	const supergroupPrefix = -1000000000000
+	if chat.ID < supergroupPrefix {
+		return fmt.Sprintf("https://t.me/c/%d/%d", -(chat.ID - supergroupPrefix), msgID)
+	}
+	return ""
+}
+
+func linkOrText(link string, text string) string {
+	if link == "" {
+		return text
+	}
+	return fmt.Sprintf(`<a href="%s">%s</a>`, link, text)
+}
+
+func (st *voteAuthorStat) mention() string {
+	if st.ID == 0 {
+		return "unknown author"
+	}
+	name := st.Name
+	if name == "" && st.UserName != "" {
+		name = "@" + st.UserName
+	}
+	if name == "" {
+		name = fmt.Sprintf("user %d", st.ID)
+	}
+	return fmt.Sprintf(`<a href="tg://user?id=%d">%s</a>`, st.ID, html.EscapeString(name))
+}
+
+func aggregateVoteAuthors(votes []MsgVote) []*voteAuthorStat {
+	byAuthor := map[int]*voteAuthorStat{}
+	for i := range votes {
+		v := &votes[i]
+		if v.Author == 0 || !v.isScored() {
+			continue
+		}
+		st, ok := byAuthor[v.Author]
+		if !ok {
+			st = &voteAuthorStat{ID: v.Author}
+			byAuthor[v.Author] = st
+		}
+		if v.AuthorName != "" {
+			st.Name = v.AuthorName
+		}
+		if v.AuthorUserName != "" {
+			st.UserName = v.AuthorUserName
+		}
+		score := msgScore(v)
+		st.Score += score
+		st.Messages++
+		if st.Best == nil || score > st.BestScore {
+			st.Best, st.BestScore = v, score
+		}
+	}
+
+	res := make([]*voteAuthorStat, 0, len(byAuthor))
+	for _, st := range byAuthor {
+		res = append(res, st)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score > res[j].Score
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+// scoredVotes filters out votes without score
+func scoredVotes(votes []MsgVote) []MsgVote {
+	res := make([]MsgVote, 0, len(votes))
+	for _, v := range votes {
+		if v.isScored() {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func formatVoteTop(chat *tgbotapi.Chat, window string, votes []MsgVote) string {
+	votes = scoredVotes(votes)
+	if len(votes) == 0 {
+		return fmt.Sprintf("No votes for period '%s'", window)
+	}
+
+	lines := []string{fmt.Sprintf("<b>Top authors (%s)</b>", window)}
+	for i, st := range aggregateVoteAuthors(votes) {
+		if i >= voteTopAuthorsLimit {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s %+d (%d msg)", i+1, st.mention(), st.Score, st.Messages))
+	}
+
+	sort.SliceStable(votes, func(i, j int) bool {
+		return msgScore(&votes[i]) > msgScore(&votes[j])
+	})
+	lines = append(lines, "", fmt.Sprintf("<b>Top messages (%s)</b>", window))
+	for i := range votes {
+		if i >= voteTopMessagesLimit {
+			break
+		}
+		v := &votes[i]
+		st := voteAuthorStat{ID: v.Author, UserName: v.AuthorUserName, Name: v.AuthorName}
+		link := linkOrText(messageLink(chat, v.ID.MessageID), "message")
+		lines = append(lines, fmt.Sprintf("%d. %s by %s %+d", i+1, link, st.mention(), msgScore(v)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatVoteKarma(chat *tgbotapi.Chat, window string, st *voteAuthorStat) string {
+	lines := []string{
+		fmt.Sprintf("Karma of %s (%s): <b>%+d</b>", st.mention(), window, st.Score),
+		fmt.Sprintf("Messages voted: %d", st.Messages),
+	}
+	if st.Best != nil {
+		link := linkOrText(messageLink(chat, st.Best.ID.MessageID), "message")
+		lines = append(lines, fmt.Sprintf("Best %s: %+d", link, st.BestScore))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseVoteStatArgs splits arguments to window name and @username
+func parseVoteStatArgs(args string, defaultWindow string) (window string, userName string, err error) {
+	window = defaultWindow
+	for _, arg := range strings.Fields(args) {
+		if strings.HasPrefix(arg, "@") {
+			userName = strings.TrimPrefix(arg, "@")
+			continue
+		}
+		if _, ok := voteWindows[arg]; !ok {
+			return "", "", errors.Errorf("unknown period '%s', use one of day, week, month, all", arg)
+		}
+		window = arg
+	}
+	return window, userName, nil
+}
+
+func (vapp *VoteApp) handleStatCmd(cmd string) CommandHandler {
+	return func(_ context.Context, msg *tgbotapi.Message, args string) error {
+		return vapp.sendStat(cmd, msg, args)
+	}
+}
+
+func (vapp *VoteApp) sendStat(cmd string, msg *tgbotapi.Message, args string) error {
+	defaultWindow := "week"
+	if cmd == voteKarmaCmd {
+		defaultWindow = "all"
+	}
+	window, userName, err := parseVoteStatArgs(args, defaultWindow)
+	if err != nil {
+		return common.ReplyWithText(vapp.Bot, msg, err.Error(), "")
+	}
+	since, _ := parseVoteWindow(window, time.Now())
+
+	votes, err := vapp.Store.ChatVotes(msg.Chat.ID, since)
+	if err != nil {
+		_ = common.ReplyWithText(vapp.Bot, msg, "Can't load votes, internal error :(", "")
+		return err
+	}
+
+	var text string
+	if cmd == voteTopCmd {
+		text = formatVoteTop(msg.Chat, window, votes)
+	} else {
+		text, err = vapp.formatKarmaFor(msg, window, userName, votes)
+		if err != nil {
+			return common.ReplyWithText(vapp.Bot, msg, err.Error(), "")
+		}
+	}
+
+	resp := tgbotapi.NewMessage(msg.Chat.ID, text)
+	resp.ParseMode = tgbotapi.ModeHTML
+	resp.DisableWebPagePreview = true
+	_, err = vapp.Bot.Send(resp)
+	return err
+}
+
+func (vapp *VoteApp) formatKarmaFor(msg *tgbotapi.Message, window string, userName string, votes []MsgVote) (string, error) {
+	var target *voteAuthorStat
+	switch {
+	case userName != "":
+		target = &voteAuthorStat{UserName: userName}
+	case msg.ReplyToMessage != nil && msg.ReplyToMessage.From != nil:
+		from := msg.ReplyToMessage.From
+		target = &voteAuthorStat{ID: from.ID, UserName: from.UserName, Name: from.FirstName}
+	case msg.From != nil:
+		target = &voteAuthorStat{ID: msg.From.ID, UserName: msg.From.UserName, Name: msg.From.FirstName}
+	default:
+		return "", errors.Errorf("don't know whose karma to show")
+	}
+
+	for _, st := range aggregateVoteAuthors(votes) {
+		if st.ID == target.ID || (userName != "" && strings.EqualFold(st.UserName, userName)) {
+			return formatVoteKarma(msg.Chat, window, st), nil
+		}
+	}
+	if target.ID == 0 {
+		return "", errors.Errorf("no votes for @%s", userName)
+	}
+	return formatVoteKarma(msg.Chat, window, target), nil
+}
@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testVotes() []MsgVote {
+	return []MsgVote{
+		{ID: MsgChatID{MessageID: 1, ChatID: -1001}, Author: 10, AuthorName: "Alice", Users: map[int]int{1: 1, 2: 3}},
+		{ID: MsgChatID{MessageID: 2, ChatID: -1001}, Author: 20, AuthorUserName: "bob", Users: map[int]int{1: 1, 2: 1, 3: 1}},
+		{ID: MsgChatID{MessageID: 3, ChatID: -1001}, Author: 10, AuthorName: "Alice", Users: map[int]int{1: -1}},
+		{ID: MsgChatID{MessageID: 4, ChatID: -1001}, Users: map[int]int{1: 7}},
+	}
+}
+
+func TestAggregateVoteAuthors(t *testing.T) {
+	stats := aggregateVoteAuthors(testVotes())
+	require.Len(t, stats, 2)
+
+	tbl := []struct {
+		id, score, messages, bestMsg, bestScore int
+		mention                                 string
+	}{
+		{20, 3, 1, 2, 3, `<a href="tg://user?id=20">@bob</a>`},
+		{10, 2, 2, 1, 3, `<a href="tg://user?id=10">Alice</a>`},
+	}
+	for i, tt := range tbl {
+		st := stats[i]
+		assert.Equal(t, tt.id, st.ID)
+		assert.Equal(t, tt.score, st.Score, "author %d", tt.id)
+		assert.Equal(t, tt.messages, st.Messages, "author %d", tt.id)
+		require.NotNil(t, st.Best)
+		assert.Equal(t, tt.bestMsg, st.Best.ID.MessageID, "author %d", tt.id)
+		assert.Equal(t, tt.bestScore, st.BestScore, "author %d", tt.id)
+		assert.Equal(t, tt.mention, st.mention())
+	}
+	assert.Empty(t, aggregateVoteAuthors(nil))
+}
+
+func TestFormatVoteTop(t *testing.T) {
+	chat := &tgbotapi.Chat{ID: -1001463780807, Type: "supergroup"}
+	assert.Equal(t, "No votes for period 'day'", formatVoteTop(chat, "day", nil))
+
+	expected := "<b>Top authors (week)</b>\n" +
+		`1. <a href="tg://user?id=20">@bob</a> +3 (1 msg)` + "\n" +
+		`2. <a href="tg://user?id=10">Alice</a> +2 (2 msg)` + "\n" +
+		"\n<b>Top messages (week)</b>\n" +
+		`1. <a href="https://t.me/c/1463780807/1">message</a> by <a href="tg://user?id=10">Alice</a> +3` + "\n" +
+		`2. <a href="https://t.me/c/1463780807/2">message</a> by <a href="tg://user?id=20">@bob</a> +3` + "\n" +
+		`3. <a href="https://t.me/c/1463780807/4">message</a> by unknown author +3` + "\n" +
+		`4. <a href="https://t.me/c/1463780807/3">message</a> by <a href="tg://user?id=10">Alice</a> -1`
+	assert.Equal(t, expected, formatVoteTop(chat, "week", testVotes()))
+}
+
+func TestVoteStoreChatVotes(t *testing.T) {
+	s := NewVoteStore(newTestDB(t).From("vote"))
+	now := time.Unix(1600000000, 0)
+	author := &tgbotapi.User{ID: 10, FirstName: "Alice"}
+
+	_, err := s.NewVote(now, MsgChatID{MessageID: 1, ChatID: -1001}, author, nil)
+	require.NoError(t, err)
+	_, err = s.NewVote(now.Add(-48*time.Hour), MsgChatID{MessageID: 2, ChatID: -1001}, author, nil)
+	require.NoError(t, err)
+	_, err = s.NewVote(now, MsgChatID{MessageID: 3, ChatID: -1002}, author, nil)
+	require.NoError(t, err)
+	// vote saved before votes were indexed by chat, Author is user who started voting
+	require.NoError(t, s.Bkt.Save(&MsgVote{ID: MsgChatID{MessageID: 4, ChatID: -1001}, Timestamp: now.Unix(), Author: 30, Users: map[int]int{}}))
+
+	require.NoError(t, s.MigrateVotes())
+	require.NoError(t, s.MigrateVotes())
+
+	votes, err := s.ChatVotes(-1001, now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Len(t, votes, 2)
+	assert.Equal(t, 1, votes[0].ID.MessageID)
+	assert.Equal(t, 10, votes[0].Author)
+	assert.Equal(t, 4, votes[1].ID.MessageID)
+	assert.Equal(t, 0, votes[1].Author)
+
+	votes, err = s.ChatVotes(-1001, time.Unix(0, 0))
+	require.NoError(t, err)
+	assert.Len(t, votes, 3)
+
+	votes, err = s.ChatVotes(-1003, time.Unix(0, 0))
+	require.NoError(t, err)
+	assert.Empty(t, votes)
+}
@@ -1,10 +1,15 @@
 package plugin
 
 import (
+	"log"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
 )
 
 type MsgChatID struct {
@@ -20,8 +25,27 @@ type VoteStore struct {
 type MsgVote struct {
 	ID        MsgChatID `storm:"id"`
 	Timestamp int64     `storm:"index"`
-	Author    int
-	Users     map[int]int
+	// ChatID duplicates ID.ChatID to find votes of chat by index, it's zero for votes saved before stats were added
+	ChatID int64 `storm:"index"`
+	Author int
+	// AuthorUserName and AuthorName are saved to show and find author in stats
+	AuthorUserName string
+	AuthorName     string
+	Users          map[int]int
+	// Options are set for votes with custom buttons, Choices maps user to chosen option
+	Options []string
+	Choices map[int]int
+}
+
+// Tally returns number of users chose each option
+func (v *MsgVote) Tally() []int {
+	res := make([]int, len(v.Options))
+	for _, opt := range v.Choices {
+		if opt >= 0 && opt < len(res) {
+			res[opt]++
+		}
+	}
+	return res
 }
 
 func NewVoteStore(bkt storm.Node) *VoteStore {
@@ -30,6 +54,32 @@ func NewVoteStore(bkt storm.Node) *VoteStore {
 	}
 }
 
+// MigrateVotes indexes votes saved before stats were added by chat.
+// Author of such votes is user who started voting rather than author of message, so it's reset to not credit wrong user.
+func (s *VoteStore) MigrateVotes() error {
+	var votes []MsgVote
+	err := s.Bkt.Select(q.Eq("ChatID", int64(0))).Find(&votes)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "cannot load votes")
+	}
+	for _, v := range votes {
+		v.ChatID, v.Author, v.AuthorUserName, v.AuthorName = v.ID.ChatID, 0, "", ""
+		if err := s.Bkt.Save(&v); err != nil {
+			return errors.Wrapf(err, "cannot save vote")
+		}
+	}
+	log.Printf("[INFO] %d votes migrated, their authors are unknown", len(votes))
+	return nil
+}
+
+// VotesCount returns number of voted messages in all chats
+func (s *VoteStore) VotesCount() (int, error) {
+	return s.Bkt.Count(&MsgVote{})
+}
+
 func (s *VoteStore) lockChat(msg MsgChatID) *sync.RWMutex {
 	lk, ok := s.perChatMtx.Load(msg.ChatID)
 	if !ok {
@@ -54,21 +104,75 @@ func (s *VoteStore) HasVote(msg MsgChatID) (bool, error) {
 	return false, err
 }
 
-func (s *VoteStore) NewVote(ts time.Time, msg MsgChatID, userID int) (*MsgVote, error) {
+func (s *VoteStore) NewVote(ts time.Time, msg MsgChatID, author *tgbotapi.User, options []string) (*MsgVote, error) {
 	lk := s.lockChat(msg)
 	lk.Lock()
 	defer lk.Unlock()
 
 	data := &MsgVote{
 		ID:        msg,
+		ChatID:    msg.ChatID,
 		Users:     map[int]int{},
-		Author:    userID,
 		Timestamp: ts.Unix(),
+		Options:   options,
+		Choices:   map[int]int{},
+	}
+	if author != nil {
+		data.Author = author.ID
+		data.AuthorUserName = author.UserName
+		data.AuthorName = strings.TrimSpace(author.FirstName + " " + author.LastName)
 	}
 	err := s.Bkt.Save(data)
 	return data, err
 }
 
+// SetChoice sets user choice for vote with options, choosing the same option again retracts it
+func (s *VoteStore) SetChoice(msg MsgChatID, userID int, option int) (*MsgVote, error) {
+	lk := s.lockChat(msg)
+	lk.Lock()
+	defer lk.Unlock()
+
+	data := &MsgVote{ID: msg}
+	err := s.Bkt.One("ID", data.ID, data)
+	if err != nil {
+		return data, err
+	}
+	if option < 0 || option >= len(data.Options) {
+		return data, errors.Errorf("option %d is out of range", option)
+	}
+
+	if data.Choices == nil {
+		data.Choices = map[int]int{}
+	}
+	if prev, has := data.Choices[userID]; has && prev == option {
+		delete(data.Choices, userID)
+	} else {
+		data.Choices[userID] = option
+	}
+	err = s.Bkt.Update(data)
+	return data, err
+}
+
+// ChatVotes returns votes for messages in chat sent not earlier than since
+func (s *VoteStore) ChatVotes(chatID int64, since time.Time) ([]MsgVote, error) {
+	var votes []MsgVote
+	err := s.Bkt.Find("ChatID", chatID, &votes)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := votes[:0]
+	for _, v := range votes {
+		if v.Timestamp >= since.Unix() {
+			res = append(res, v)
+		}
+	}
+	return res, nil
+}
+
 func (s *VoteStore) AddVote(ts time.Time, msg MsgChatID, userID int, increment int) (bool, *MsgVote, error) {
 	lk := s.lockChat(msg)
 	lk.Lock()
@@ -86,3 +190,53 @@ func (s *VoteStore) AddVote(ts time.Time, msg MsgChatID, userID int, increment i
 	}
 	return false, data, err
 }
+
+const defaultVoteHashtag = "#vote"
+const defaultVotePrompt = "let's score it, guys"
+
+// VoteSettings is per chat voting configuration
+type VoteSettings struct {
+	ChatID   int64 `storm:"id"`
+	Disabled bool
+	Hashtag  string
+	Prompt   string
+}
+
+func defaultVoteSettings(chatID int64) *VoteSettings {
+	return &VoteSettings{
+		ChatID:  chatID,
+		Hashtag: defaultVoteHashtag,
+		Prompt:  defaultVotePrompt,
+	}
+}
+
+// Settings returns chat settings or default ones if chat didn't set anything
+func (s *VoteStore) Settings(chatID int64) (*VoteSettings, error) {
+	data := &VoteSettings{}
+	err := s.Bkt.One("ChatID", chatID, data)
+	if err == storm.ErrNotFound {
+		return defaultVoteSettings(chatID), nil
+	}
+	if err != nil {
+		return defaultVoteSettings(chatID), err
+	}
+	if data.Hashtag == "" {
+		data.Hashtag = defaultVoteHashtag
+	}
+	if data.Prompt == "" {
+		data.Prompt = defaultVotePrompt
+	}
+	return data, nil
+}
+
+func (s *VoteStore) SaveSettings(settings *VoteSettings) error {
+	return s.Bkt.Save(settings)
+}
+
+func (s *VoteStore) ResetSettings(chatID int64) error {
+	err := s.Bkt.DeleteStruct(&VoteSettings{ChatID: chatID})
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,322 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/vdimir/tg-tobym/app/plugin"
+)
+
+// ACL modes
+const (
+	// ACLOpen handles updates from everyone except denylist
+	ACLOpen = "open"
+	// ACLAllowlist handles updates only from allowed chats and users
+	ACLAllowlist = "allowlist"
+	// ACLApprove is allowlist mode where owners are asked to approve new chats
+	ACLApprove = "approve"
+)
+
+// ACL lists and kinds of entries
+const (
+	aclAllow   = "allow"
+	aclDeny    = "deny"
+	aclPending = "pending"
+
+	aclChat = "chat"
+	aclUser = "user"
+)
+
+const aclCallbackDataPrefix = "acl#"
+
+// aclEntry is chat or user in allowlist, denylist or waiting for approval
+type aclEntry struct {
+	// ID is kind and id of chat or user separated by ':'
+	ID        string `storm:"id"`
+	Kind      string
+	TargetID  int64
+	List      string
+	Title     string
+	UpdatedAt int64
+}
+
+func aclEntryID(kind string, id int64) string {
+	return kind + ":" + strconv.FormatInt(id, 10)
+}
+
+// chatACL drops updates from chats and users which aren't allowed
+type chatACL struct {
+	plugin.NopPlugin
+	Bkt    storm.Node
+	Bot    *tgbotapi.BotAPI
+	Mode   string
+	Access *plugin.Access
+	Chats  *chatTracker
+
+	mtx sync.Mutex
+}
+
+func (acl *chatACL) list(kind string, id int64) string {
+	entry := aclEntry{}
+	if err := acl.Bkt.One("ID", aclEntryID(kind, id), &entry); err != nil {
+		if err != storm.ErrNotFound {
+			log.Printf("[WARN] cannot get acl entry: %v", err)
+		}
+		return ""
+	}
+	return entry.List
+}
+
+func (acl *chatACL) set(kind string, id int64, list string, title string) error {
+	acl.mtx.Lock()
+	defer acl.mtx.Unlock()
+	return acl.setLocked(kind, id, list, title)
+}
+
+func (acl *chatACL) setLocked(kind string, id int64, list string, title string) error {
+	entry := aclEntry{}
+	err := acl.Bkt.One("ID", aclEntryID(kind, id), &entry)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	entry.ID, entry.Kind, entry.TargetID, entry.List = aclEntryID(kind, id), kind, id, list
+	if title != "" {
+		entry.Title = title
+	}
+	entry.UpdatedAt = time.Now().Unix()
+	return acl.Bkt.Save(&entry)
+}
+
+func (acl *chatACL) remove(kind string, id int64) (bool, error) {
+	acl.mtx.Lock()
+	defer acl.mtx.Unlock()
+	err := acl.Bkt.DeleteStruct(&aclEntry{ID: aclEntryID(kind, id)})
+	if err == storm.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (acl *chatACL) entries() ([]aclEntry, error) {
+	entries := []aclEntry{}
+	if err := acl.Bkt.All(&entries); err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].List != entries[j].List {
+			return entries[i].List < entries[j].List
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+func updateChatAndUser(update *tgbotapi.Update) (*tgbotapi.Chat, *tgbotapi.User) {
+	switch {
+	case update.Message != nil:
+		return update.Message.Chat, update.Message.From
+	case update.EditedMessage != nil:
+		return update.EditedMessage.Chat, update.EditedMessage.From
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+		return update.CallbackQuery.Message.Chat, update.CallbackQuery.From
+	case update.CallbackQuery != nil:
+		return nil, update.CallbackQuery.From
+	}
+	return nil, nil
+}
+
+// allowed checks update, owners are always allowed and denylist is checked in any mode
+func (acl *chatACL) allowed(update *tgbotapi.Update) bool {
+	chat, user := updateChatAndUser(update)
+	if user != nil && acl.Access.IsOwner(user.ID) {
+		return true
+	}
+	if user != nil && acl.list(aclUser, int64(user.ID)) == aclDeny {
+		return false
+	}
+	chatList := ""
+	if chat != nil {
+		chatList = acl.list(aclChat, chat.ID)
+	}
+	if chatList == aclDeny {
+		return false
+	}
+	if acl.Mode == ACLOpen {
+		return true
+	}
+	if chatList == aclAllow || (user != nil && acl.list(aclUser, int64(user.ID)) == aclAllow) {
+		return true
+	}
+	if acl.Mode == ACLApprove && chat != nil && chatList == "" {
+		if err := acl.requestApproval(chat, user); err != nil {
+			log.Printf("[WARN] cannot request approval of chat %d: %v", chat.ID, err)
+		}
+	}
+	return false
+}
+
+// tokenAllowed checks chat and creator of notifier token like author of update, but approval isn't requested.
+// Creator is zero for tokens created before it was saved, only chat is checked then.
+func (acl *chatACL) tokenAllowed(chatID int64, creatorID int) bool {
+	if creatorID != 0 && acl.Access.IsOwner(creatorID) {
+		return true
+	}
+	if creatorID != 0 && acl.list(aclUser, int64(creatorID)) == aclDeny {
+		return false
+	}
+	chatList := acl.list(aclChat, chatID)
+	if chatList == aclDeny {
+		return false
+	}
+	if acl.Mode == ACLOpen || chatList == aclAllow {
+		return true
+	}
+	return creatorID != 0 && acl.list(aclUser, int64(creatorID)) == aclAllow
+}
+
+// chatAllowed checks that bot may send background messages to chat, e.g. reminders or alerts.
+// Private chat has id of user, so user lists are checked for it as well.
+func (acl *chatACL) chatAllowed(chatID int64) bool {
+	if chatID > 0 {
+		return acl.tokenAllowed(chatID, int(chatID))
+	}
+	return acl.tokenAllowed(chatID, 0)
+}
+
+func chatTitle(chat *tgbotapi.Chat) string {
+	switch {
+	case chat.Title != "":
+		return chat.Title
+	case chat.UserName != "":
+		return "@" + chat.UserName
+	}
+	return strings.TrimSpace(chat.FirstName + " " + chat.LastName)
+}
+
+// requestApproval marks chat as pending and asks owners to approve it
+func (acl *chatACL) requestApproval(chat *tgbotapi.Chat, from *tgbotapi.User) error {
+	acl.mtx.Lock()
+	if acl.list(aclChat, chat.ID) != "" {
+		acl.mtx.Unlock()
+		return nil
+	}
+	err := acl.setLocked(aclChat, chat.ID, aclPending, chatTitle(chat))
+	acl.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	text := fmt.Sprintf("New %s <b>%s</b> (<code>%d</code>) wants to use bot", chat.Type, html.EscapeString(chatTitle(chat)), chat.ID)
+	if from != nil {
+		text += fmt.Sprintf(", first message from %s (<code>%d</code>)", html.EscapeString(strings.TrimSpace(from.String())), from.ID)
+	}
+	idStr := strconv.FormatInt(chat.ID, 10)
+	markup := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Approve", aclCallbackDataPrefix+aclAllow+"#"+idStr),
+		tgbotapi.NewInlineKeyboardButtonData("Deny", aclCallbackDataPrefix+aclDeny+"#"+idStr),
+	))
+	for _, ownerID := range acl.Access.OwnerIDs {
+		msg := tgbotapi.NewMessage(int64(ownerID), text)
+		msg.ParseMode = tgbotapi.ModeHTML
+		msg.ReplyMarkup = markup
+		if _, err := acl.Bot.Send(msg); err != nil {
+			log.Printf("[WARN] cannot ask owner %d to approve chat: %v", ownerID, err)
+		}
+	}
+	return nil
+}
+
+// RegisterHandlers declares callback of approve and deny buttons
+func (acl *chatACL) RegisterHandlers(r *plugin.Router) {
+	r.Callback(aclCallbackDataPrefix, acl.handleCallback)
+}
+
+func (acl *chatACL) handleCallback(_ context.Context, query *tgbotapi.CallbackQuery) error {
+	if query.From == nil || !acl.Access.IsOwner(query.From.ID) {
+		_, err := acl.Bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Only bot owner can do it"))
+		return err
+	}
+	parts := strings.Split(strings.TrimPrefix(query.Data, aclCallbackDataPrefix), "#")
+	if len(parts) != 2 || (parts[0] != aclAllow && parts[0] != aclDeny) {
+		return errors.Errorf("wrong acl callback data %q", query.Data)
+	}
+	chatID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "wrong acl callback data %q", query.Data)
+	}
+
+	if err := acl.set(aclChat, chatID, parts[0], ""); err != nil {
+		return err
+	}
+	answer := "Approved"
+	if parts[0] == aclDeny {
+		answer = "Denied"
+		if err := acl.leave(chatID); err != nil {
+			log.Printf("[WARN] cannot leave denied chat %d: %v", chatID, err)
+		}
+	}
+
+	if _, err := acl.Bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, answer)); err != nil {
+		return err
+	}
+	if query.Message == nil {
+		return nil
+	}
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID,
+		fmt.Sprintf("%s\n%s", query.Message.Text, answer))
+	_, err = acl.Bot.Send(edit)
+	return err
+}
+
+// leave makes bot leave denied group chat
+func (acl *chatACL) leave(chatID int64) error {
+	if chatID > 0 {
+		return nil
+	}
+	if _, err := acl.Bot.LeaveChat(tgbotapi.ChatConfig{ChatID: chatID}); err != nil {
+		return err
+	}
+	if err := acl.Chats.markLeft(chatID); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func (acl *chatACL) formatEntries() (string, error) {
+	entries, err := acl.entries()
+	if err != nil {
+		return "", err
+	}
+	lines := []string{fmt.Sprintf("Mode: %s", acl.Mode)}
+	for _, e := range entries {
+		line := fmt.Sprintf("%s %s <code>%d</code>", e.List, e.Kind, e.TargetID)
+		if e.Title != "" {
+			line += " " + html.EscapeString(e.Title)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// parseACLArgs parses `chat|user <id>`
+func parseACLArgs(args string) (kind string, id int64, err error) {
+	fields := strings.Fields(args)
+	if len(fields) != 2 || (fields[0] != aclChat && fields[0] != aclUser) {
+		return "", 0, errors.Errorf("pass 'chat <id>' or 'user <id>'")
+	}
+	id, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", 0, errors.Errorf("wrong id '%s'", fields[1])
+	}
+	return fields[0], id, nil
+}
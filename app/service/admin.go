@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/vdimir/tg-tobym/app/common"
+	"github.com/vdimir/tg-tobym/app/plugin"
+)
+
+const maxListedChats = 50
+
+const adminUsage = "Usage: /admin stats | chats | leave <chat id> | broadcast <text> | reset_failures | " +
+	"acl | allow|deny|unlist chat|user <id>. " +
+	"Chats are tracked by updates, so only chats seen since tracking was deployed are listed."
+
+// adminConsole provides /admin command for bot owners in private chat
+type adminConsole struct {
+	plugin.NopPlugin
+	srv      *BotService
+	notifier *plugin.NotifierStore
+	votes    *plugin.VoteStore
+}
+
+// RegisterHandlers declares hidden /admin command
+func (adm *adminConsole) RegisterHandlers(r *plugin.Router) {
+	r.Command(plugin.CommandDescription{Cmd: "admin"}, adm.handleAdmin)
+}
+
+func (adm *adminConsole) handleAdmin(_ context.Context, msg *tgbotapi.Message, args string) error {
+	if !msg.Chat.IsPrivate() || msg.From == nil || !adm.srv.access.IsOwner(msg.From.ID) {
+		return nil
+	}
+
+	args = strings.TrimSpace(args)
+	cmd := args
+	if idx := strings.IndexAny(args, " \n"); idx >= 0 {
+		cmd, args = args[:idx], strings.TrimSpace(args[idx+1:])
+	} else {
+		args = ""
+	}
+
+	switch cmd {
+	case "stats":
+		text, err := adm.stats()
+		if err != nil {
+			return err
+		}
+		return common.ReplyWithText(adm.srv.bot, msg, text, tgbotapi.ModeHTML)
+	case "chats":
+		return common.ReplyWithText(adm.srv.bot, msg, adm.formatChats(), tgbotapi.ModeHTML)
+	case "leave":
+		return adm.leave(msg, args)
+	case "broadcast":
+		if args == "" {
+			return common.ReplyWithText(adm.srv.bot, msg, "Pass text to broadcast", "")
+		}
+		return adm.broadcast(msg, args)
+	case "acl":
+		text, err := adm.srv.acl.formatEntries()
+		if err != nil {
+			return err
+		}
+		return common.ReplyWithText(adm.srv.bot, msg, text, tgbotapi.ModeHTML)
+	case "allow", "deny", "unlist":
+		return adm.setACL(msg, cmd, args)
+	case "reset_failures":
+		prev := atomic.SwapUint32(&adm.srv.failuresNumber, 0)
+		return common.ReplyWithText(adm.srv.bot, msg, fmt.Sprintf("Ok, failure counter reset from %d", prev), "")
+	}
+	return common.ReplyWithText(adm.srv.bot, msg, adminUsage, "")
+}
+
+// broadcast sends text to subscribers in background, messages are queued by rate limits and may take a while
+func (adm *adminConsole) broadcast(msg *tgbotapi.Message, text string) error {
+	subscribers, err := adm.srv.monitor.Subscribers()
+	if err != nil {
+		return errors.Wrapf(err, "cannot get subscribers")
+	}
+	go func() {
+		sent := adm.srv.monitor.Broadcast(html.EscapeString(text))
+		report := fmt.Sprintf("Broadcast is finished, sent to %d of %d subscribers", sent, len(subscribers))
+		if err := common.SentTextMessage(adm.srv.bot, msg.Chat.ID, report, ""); err != nil {
+			log.Printf("[WARN] cannot report broadcast result: %v", err)
+		}
+	}()
+	return common.ReplyWithText(adm.srv.bot, msg, fmt.Sprintf("Ok, sending to %d subscribers", len(subscribers)), "")
+}
+
+func (adm *adminConsole) stats() (string, error) {
+	tokens, err := adm.notifier.TokensCount()
+	if err != nil && err != storm.ErrNotFound {
+		return "", errors.Wrapf(err, "cannot count tokens")
+	}
+	votes, err := adm.votes.VotesCount()
+	if err != nil && err != storm.ErrNotFound {
+		return "", errors.Wrapf(err, "cannot count votes")
+	}
+	subscribers, err := adm.srv.monitor.Subscribers()
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot get subscribers")
+	}
+
+	lines := []string{
+		fmt.Sprintf("Version: <code>%s</code>", html.EscapeString(adm.srv.cfg.AppVersion)),
+		fmt.Sprintf("Chats: %d", len(adm.srv.chats.list())),
+		fmt.Sprintf("Notify tokens: %d", tokens),
+		fmt.Sprintf("Subscribers: %d", len(subscribers)),
+		fmt.Sprintf("Votes: %d", votes),
+		fmt.Sprintf("Failures: %d", atomic.LoadUint32(&adm.srv.failuresNumber)),
+		fmt.Sprintf("Send queue: %d", adm.srv.dispatcher.QueueDepth()),
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (adm *adminConsole) formatChats() string {
+	chats := adm.srv.chats.list()
+	if len(chats) == 0 {
+		return "No chats"
+	}
+	lines := []string{}
+	for i, c := range chats {
+		if i == maxListedChats {
+			lines = append(lines, fmt.Sprintf("… and %d more", len(chats)-maxListedChats))
+			break
+		}
+		name := c.Title
+		if name == "" {
+			name = "@" + c.UserName
+		}
+		lines = append(lines, fmt.Sprintf("<code>%d</code> %s (%s), seen %s", c.ID, html.EscapeString(name), c.Type,
+			time.Unix(c.LastSeen, 0).UTC().Format("2006-01-02")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (adm *adminConsole) leave(msg *tgbotapi.Message, args string) error {
+	chatID, err := strconv.ParseInt(args, 10, 64)
+	if err != nil {
+		return common.ReplyWithText(adm.srv.bot, msg, "Pass chat id, see /admin chats", "")
+	}
+	if _, err := adm.srv.bot.LeaveChat(tgbotapi.ChatConfig{ChatID: chatID}); err != nil {
+		_ = common.ReplyWithText(adm.srv.bot, msg, fmt.Sprintf("Can't leave chat: %v", err), "")
+		return errors.Wrapf(err, "cannot leave chat %d", chatID)
+	}
+	if err := adm.srv.chats.markLeft(chatID); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return common.ReplyWithText(adm.srv.bot, msg, "Ok, left chat", "")
+}
+
+func (adm *adminConsole) setACL(msg *tgbotapi.Message, action string, args string) error {
+	kind, id, err := parseACLArgs(args)
+	if err != nil {
+		return common.ReplyWithText(adm.srv.bot, msg, err.Error(), "")
+	}
+	if action == "unlist" {
+		removed, err := adm.srv.acl.remove(kind, id)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return common.ReplyWithText(adm.srv.bot, msg, "Not found", "")
+		}
+		return common.ReplyWithText(adm.srv.bot, msg, fmt.Sprintf("Ok, %s %d removed from lists", kind, id), "")
+	}
+
+	if err := adm.srv.acl.set(kind, id, action, ""); err != nil {
+		return err
+	}
+	if action == aclDeny && kind == aclChat {
+		if err := adm.srv.acl.leave(id); err != nil {
+			_ = common.ReplyWithText(adm.srv.bot, msg, fmt.Sprintf("Chat is denied, but can't leave it: %v", err), "")
+			return errors.Wrapf(err, "cannot leave chat %d", id)
+		}
+	}
+	status := "allowed"
+	if action == aclDeny {
+		status = "denied"
+	}
+	return common.ReplyWithText(adm.srv.bot, msg, fmt.Sprintf("Ok, %s %d is %s", kind, id, status), "")
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// chatSeenSaveInterval limits how often last seen time of chat is saved
+const chatSeenSaveInterval = time.Hour
+
+// knownChat is a chat where bot gets updates
+type knownChat struct {
+	ID       int64 `storm:"id"`
+	Title    string
+	Type     string
+	UserName string
+	LastSeen int64
+	Left     bool
+}
+
+// chatTracker saves chats bot is in, Telegram API doesn't provide such list
+type chatTracker struct {
+	Bkt   storm.Node
+	BotID int
+
+	mtx   sync.Mutex
+	chats map[int64]knownChat
+}
+
+func (ct *chatTracker) load() error {
+	ct.mtx.Lock()
+	defer ct.mtx.Unlock()
+	chats := []knownChat{}
+	if err := ct.Bkt.All(&chats); err != nil {
+		return err
+	}
+	ct.chats = map[int64]knownChat{}
+	for _, c := range chats {
+		ct.chats[c.ID] = c
+	}
+	return nil
+}
+
+// track saves chat of message, it's saved only if chat is changed or wasn't seen for a while
+func (ct *chatTracker) track(msg *tgbotapi.Message, now time.Time) {
+	if msg == nil || msg.Chat == nil {
+		return
+	}
+	chat := knownChat{
+		ID:       msg.Chat.ID,
+		Title:    msg.Chat.Title,
+		Type:     msg.Chat.Type,
+		UserName: msg.Chat.UserName,
+		LastSeen: now.Unix(),
+	}
+	if msg.LeftChatMember != nil && msg.LeftChatMember.ID == ct.BotID {
+		chat.Left = true
+	}
+
+	ct.mtx.Lock()
+	defer ct.mtx.Unlock()
+	if ct.chats == nil {
+		ct.chats = map[int64]knownChat{}
+	}
+	prev, ok := ct.chats[chat.ID]
+	if ok && prev.Title == chat.Title && prev.Left == chat.Left &&
+		now.Sub(time.Unix(prev.LastSeen, 0)) < chatSeenSaveInterval {
+		return
+	}
+	if err := ct.Bkt.Save(&chat); err != nil {
+		log.Printf("[WARN] cannot save chat %d: %v", chat.ID, err)
+		return
+	}
+	ct.chats[chat.ID] = chat
+}
+
+// markLeft saves that bot isn't in chat anymore
+func (ct *chatTracker) markLeft(chatID int64) error {
+	ct.mtx.Lock()
+	defer ct.mtx.Unlock()
+	chat, ok := ct.chats[chatID]
+	if !ok {
+		return storm.ErrNotFound
+	}
+	chat.Left = true
+	if err := ct.Bkt.Save(&chat); err != nil {
+		return err
+	}
+	ct.chats[chatID] = chat
+	return nil
+}
+
+// list returns chats bot is in, recently seen first
+func (ct *chatTracker) list() []knownChat {
+	ct.mtx.Lock()
+	defer ct.mtx.Unlock()
+	res := []knownChat{}
+	for _, c := range ct.chats {
+		if !c.Left {
+			res = append(res, c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastSeen > res[j].LastSeen
+	})
+	return res
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/asdine/storm/v3"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/vdimir/tg-tobym/app/plugin"
+)
+
+const maxCommandDescriptionLen = 256
+
+var commandScopes = []string{
+	plugin.CommandScopeDefault,
+	plugin.CommandScopePrivate,
+	plugin.CommandScopeGroups,
+	plugin.CommandScopeAdmins,
+}
+
+// botCommand is an item of setMyCommands list
+type botCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+// publishedCommands is command list sent to Telegram for scope and language
+type publishedCommands struct {
+	// Key is scope and language code separated by '/'
+	Key  string `storm:"id"`
+	Hash string
+}
+
+func commandListKey(scope string, lang string) string {
+	return scope + "/" + lang
+}
+
+func splitCommandListKey(key string) (scope string, lang string) {
+	idx := strings.Index(key, "/")
+	if idx < 0 {
+		return key, ""
+	}
+	return key[:idx], key[idx+1:]
+}
+
+// inCommandScope checks that command should be listed in scope,
+// Telegram uses the most specific list, so wider lists are repeated in narrower ones
+func inCommandScope(cmd plugin.CommandDescription, scope string) bool {
+	if len(cmd.Scopes) == 0 {
+		return true
+	}
+	for _, s := range cmd.Scopes {
+		if s == scope || (s == plugin.CommandScopeGroups && scope == plugin.CommandScopeAdmins) {
+			return true
+		}
+	}
+	return false
+}
+
+func commandDescription(cmd plugin.CommandDescription, lang string) string {
+	text := cmd.Help
+	if tr, ok := cmd.Translations[lang]; ok && lang != "" {
+		text = tr
+	}
+	text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "."))
+	if utf8.RuneCountInString(text) > maxCommandDescriptionLen {
+		text = string([]rune(text)[:maxCommandDescriptionLen-1]) + "…"
+	}
+	return text
+}
+
+// buildCommandLists splits commands by scope and language, list for scope is built only if some command is limited to it
+func buildCommandLists(cmds []plugin.CommandDescription) map[string][]botCommand {
+	usedScopes := map[string]bool{plugin.CommandScopeDefault: true}
+	langs := []string{""}
+	for _, cmd := range cmds {
+		for _, s := range cmd.Scopes {
+			usedScopes[s] = true
+		}
+		for lang := range cmd.Translations {
+			langs = append(langs, lang)
+		}
+	}
+	sort.Strings(langs)
+
+	lists := map[string][]botCommand{}
+	for _, scope := range commandScopes {
+		if !usedScopes[scope] {
+			continue
+		}
+		for _, lang := range langs {
+			list := []botCommand{}
+			for _, cmd := range cmds {
+				if scope == plugin.CommandScopeDefault && len(cmd.Scopes) > 0 {
+					continue
+				}
+				if !inCommandScope(cmd, scope) {
+					continue
+				}
+				list = append(list, botCommand{Command: cmd.Cmd, Description: commandDescription(cmd, lang)})
+			}
+			if len(list) > 0 {
+				lists[commandListKey(scope, lang)] = list
+			}
+		}
+	}
+	return lists
+}
+
+func requestCommands(bot *tgbotapi.BotAPI, method string, key string, list []botCommand) error {
+	scope, lang := splitCommandListKey(key)
+	scopeData, err := json.Marshal(map[string]string{"type": scope})
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	params.Set("scope", string(scopeData))
+	if lang != "" {
+		params.Set("language_code", lang)
+	}
+	if list != nil {
+		data, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		params.Set("commands", string(data))
+	}
+	_, err = bot.MakeRequest(method, params)
+	return errors.Wrapf(err, "%s for %s", method, key)
+}
+
+// syncCommands publishes commands to Telegram with setMyCommands,
+// lists published before but missing now are removed with deleteMyCommands
+func syncCommands(bot *tgbotapi.BotAPI, bkt storm.Node, cmds []plugin.CommandDescription) error {
+	published := []publishedCommands{}
+	if err := bkt.All(&published); err != nil {
+		return errors.Wrapf(err, "cannot load published commands")
+	}
+	hashes := map[string]string{}
+	for _, p := range published {
+		hashes[p.Key] = p.Hash
+	}
+
+	lists := buildCommandLists(cmds)
+	keys := make([]string, 0, len(lists))
+	for key := range lists {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		data, err := json.Marshal(lists[key])
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		if hashes[key] == hash {
+			continue
+		}
+		if err := requestCommands(bot, "setMyCommands", key, lists[key]); err != nil {
+			return err
+		}
+		if err := bkt.Save(&publishedCommands{Key: key, Hash: hash}); err != nil {
+			return err
+		}
+		log.Printf("[INFO] published %d commands for %s", len(lists[key]), key)
+	}
+
+	for _, p := range published {
+		if _, ok := lists[p.Key]; ok {
+			continue
+		}
+		if err := requestCommands(bot, "deleteMyCommands", p.Key, nil); err != nil {
+			return err
+		}
+		if err := bkt.DeleteStruct(&p); err != nil {
+			return err
+		}
+		log.Printf("[INFO] removed commands for %s", p.Key)
+	}
+	return nil
+}
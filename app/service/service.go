@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
@@ -30,6 +31,21 @@ type Config struct {
 
 	HTTPRootPath string
 	AppVersion   string
+	// OwnerIDs are telegram user ids of bot owners, owners may run any command and use /admin
+	OwnerIDs []int
+	// ACLMode is one of ACLOpen (default), ACLAllowlist or ACLApprove
+	ACLMode string
+
+	// ScheduleMissedRunGrace is how late recurring message may be sent, e.g. after downtime
+	ScheduleMissedRunGrace time.Duration
+	// NotifierMaxUploadSize limits size of files uploaded to notifier in bytes
+	NotifierMaxUploadSize int64
+	// NotifierSecret is key to hash notifier tokens, random one is generated and saved if it isn't set
+	NotifierSecret string
+	// NotifierLimits restricts request rate of notifier tokens
+	NotifierLimits plugin.NotifierLimits
+	// ProbePrivateAddresses allows /probe of loopback, private and link-local addresses
+	ProbePrivateAddresses bool
 }
 
 // BotService contains common application data
@@ -44,6 +60,8 @@ type BotService struct {
 	webSrv    *http.Server
 	plugins   []plugin.PlugIn
 	rootRoute chi.Router
+	// dispatcher queues all outgoing messages of bot
+	dispatcher *common.Dispatcher
 
 	mainLoopDone chan (struct{})
 	ctx          context.Context
@@ -52,6 +70,18 @@ type BotService struct {
 	sem *semaphore.Weighted
 
 	failuresNumber uint32
+	// handledUpdates counts updates which handling is finished
+	handledUpdates uint32
+	// monitor notifies service subscribers about shutdown and failures
+	monitor *plugin.Monitor
+	// router holds commands of all plugins
+	router *plugin.Router
+	// access keeps plugins enabled in chats and command permissions
+	access *plugin.Access
+	// chats tracks chats bot is in
+	chats *chatTracker
+	// acl drops updates from chats and users which aren't allowed
+	acl *chatACL
 }
 
 // NewBotService creates BotService
@@ -59,6 +89,11 @@ func NewBotService(cfg *Config) (*BotService, error) {
 	if cfg.WebAppURL == "" && cfg.UseWebHook {
 		return nil, errors.Errorf("url should be set for web hook")
 	}
+	switch cfg.ACLMode {
+	case "", ACLOpen, ACLAllowlist, ACLApprove:
+	default:
+		return nil, errors.Errorf("unknown acl mode %q", cfg.ACLMode)
+	}
 	store, err := store.NewStorage(cfg.DataPath)
 	if err != nil {
 		return nil, err
@@ -73,6 +108,8 @@ func NewBotService(cfg *Config) (*BotService, error) {
 		return nil, err
 	}
 	bot.Debug = cfg.Debug
+	dispatcher := common.NewDispatcher(bot.Client)
+	bot.Client = dispatcher
 
 	ctx, ctxCancel := context.WithCancel(context.Background())
 	srv := &BotService{
@@ -86,6 +123,7 @@ func NewBotService(cfg *Config) (*BotService, error) {
 		ctx:          ctx,
 		ctxCancel:    ctxCancel,
 		sem:          semaphore.NewWeighted(10),
+		dispatcher:   dispatcher,
 	}
 	srv.rootRoute = srv.Routes()
 	setupPlugins(srv)
@@ -95,34 +133,105 @@ func NewBotService(cfg *Config) (*BotService, error) {
 
 func setupPlugins(srv *BotService) {
 	statPlugin := &plugin.LastMessage{}
+	timezonePlugin := &plugin.TimezoneConverter{
+		Bot: srv.bot,
+		Store: &plugin.TimezoneConverterStore{
+			Bkt: srv.store.GetBucket("timezone_converter"),
+		},
+	}
+	srv.router = &plugin.Router{Bot: srv.bot}
+	srv.access = &plugin.Access{
+		Bot:      srv.bot,
+		Store:    srv.store.GetBucket("access"),
+		OwnerIDs: srv.cfg.OwnerIDs,
+		Router:   srv.router,
+	}
+	srv.router.Access = srv.access
+	srv.chats = &chatTracker{Bkt: srv.store.GetBucket("chats"), BotID: srv.bot.Self.ID}
+	srv.acl = &chatACL{
+		Bkt:    srv.store.GetBucket("acl"),
+		Bot:    srv.bot,
+		Mode:   srv.cfg.ACLMode,
+		Access: srv.access,
+		Chats:  srv.chats,
+	}
+	if srv.acl.Mode == "" {
+		srv.acl.Mode = ACLOpen
+	}
+	voteStore := plugin.NewVoteStore(srv.store.GetBucket("vote"))
 	srv.plugins = []plugin.PlugIn{
 		statPlugin,
+		srv.router,
 		&plugin.ShowVersion{
 			Bot:     srv.bot,
 			Version: srv.cfg.AppVersion,
 		},
-		&plugin.TimezoneConverter{
-			Bot: srv.bot,
-			Store: &plugin.TimezoneConverterStore{
-				Bkt: srv.store.GetBucket("timezone_converter"),
-			},
-		},
-		&plugin.Monitor{
+		timezonePlugin,
+		&plugin.VoteApp{
 			Bot:   srv.bot,
-			Store: srv.store.GetBucket("service_subscribers"),
+			Store: voteStore,
+			Stat:  statPlugin,
+		},
+		&plugin.PollApp{
+			Bot:       srv.bot,
+			Store:     &plugin.PollStore{Bkt: srv.store.GetBucket("poll")},
+			Timezones: timezonePlugin,
+
+			AllowedChat: srv.acl.chatAllowed,
 		},
+		&plugin.Reminder{
+			Bot:       srv.bot,
+			Store:     &plugin.ReminderStore{Bkt: srv.store.GetBucket("reminder")},
+			Timezones: timezonePlugin,
+			Access:    srv.access,
+
+			AllowedChat: srv.acl.chatAllowed,
+		},
+		&plugin.Scheduler{
+			Bot:            srv.bot,
+			Store:          &plugin.ScheduleStore{Bkt: srv.store.GetBucket("schedule")},
+			Timezones:      timezonePlugin,
+			MissedRunGrace: srv.cfg.ScheduleMissedRunGrace,
+			Access:         srv.access,
+			AllowedChat:    srv.acl.chatAllowed,
+		},
+	}
+
+	srv.monitor = &plugin.Monitor{
+		Bot:            srv.bot,
+		Store:          srv.store.GetBucket("service_subscribers"),
+		HeartbeatStore: srv.store.GetBucket("heartbeat"),
+		ProbeStore:     srv.store.GetBucket("probe"),
+		StateStore:     srv.store.GetBucket("service_state"),
+		AppURL:         srv.cfg.WebAppURL,
+		Version:        srv.cfg.AppVersion,
+
+		AllowPrivateProbes: srv.cfg.ProbePrivateAddresses,
+		Access:             srv.access,
+		AllowedChat:        srv.acl.chatAllowed,
 	}
 
+	notifierStore := &plugin.NotifierStore{Bkt: srv.store.GetBucket("notifier"), Secret: []byte(srv.cfg.NotifierSecret)}
+
 	webPlugin := []struct {
 		path string
 		app  plugin.WebApp
 	}{
+		{
+			path: "/monitor",
+			app:  srv.monitor,
+		},
 		{
 			path: "/notify",
 			app: &plugin.NotifierApp{
 				Bot:    srv.bot,
-				Store:  &plugin.NotifierStore{Bkt: srv.store.GetBucket("notifier")},
+				Store:  notifierStore,
 				AppURL: srv.cfg.WebAppURL,
+
+				MaxUploadSize: srv.cfg.NotifierMaxUploadSize,
+				Limits:        srv.cfg.NotifierLimits,
+				Access:        srv.access,
+				Allowed:       srv.acl.tokenAllowed,
 			},
 		},
 	}
@@ -132,14 +241,19 @@ func setupPlugins(srv *BotService) {
 		srv.plugins = append(srv.plugins, sapp.app)
 	}
 
-	helpPlugin := &plugin.Help{
-		Bot:  srv.bot,
-		Cmds: []plugin.CommandDescription{},
-	}
-	srv.plugins = append(srv.plugins, helpPlugin)
+	srv.plugins = append(srv.plugins, srv.access, srv.acl, &adminConsole{
+		srv:      srv,
+		notifier: notifierStore,
+		votes:    voteStore,
+	}, &plugin.Help{
+		Bot:    srv.bot,
+		Router: srv.router,
+	})
 
 	for _, p := range srv.plugins {
-		helpPlugin.Cmds = append(helpPlugin.Cmds, p.Commands()...)
+		if reg, ok := p.(plugin.Registrar); ok {
+			srv.router.Register(reg)
+		}
 	}
 }
 
@@ -201,6 +315,12 @@ func (s *BotService) Init() error {
 	if err != nil {
 		return errors.Wrapf(err, "error inialize server")
 	}
+	if err = s.chats.load(); err != nil {
+		return errors.Wrapf(err, "cannot load chats")
+	}
+	if s.cfg.ACLMode == ACLApprove && len(s.cfg.OwnerIDs) == 0 {
+		log.Printf("[WARN] owners aren't set, nobody can approve new chats")
+	}
 	for _, sapp := range s.plugins {
 		err = sapp.Init()
 		if err != nil {
@@ -208,14 +328,42 @@ func (s *BotService) Init() error {
 		}
 	}
 
+	err = syncCommands(s.bot, s.store.GetBucket("bot_commands"), s.router.Commands())
+	if err != nil {
+		log.Printf("[WARN] cannot publish bot commands: %v", err)
+	}
+
 	go s.mainLoop()
 
 	return nil
 }
 
+// updateChatID returns chat of message or callback query
+func updateChatID(update *tgbotapi.Update) (int64, bool) {
+	switch {
+	case update.Message != nil:
+		return update.Message.Chat.ID, true
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+		return update.CallbackQuery.Message.Chat.ID, true
+	}
+	return 0, false
+}
+
 func (s *BotService) handleUpdate(update tgbotapi.Update) {
+	if !s.acl.allowed(&update) {
+		return
+	}
+	s.chats.track(update.Message, time.Now())
+	ctx := s.ctx
+	chatID, hasChat := updateChatID(&update)
+	if hasChat {
+		ctx = s.access.WithChat(ctx, chatID)
+	}
 	for _, sapp := range s.plugins {
-		eventCaught, err := sapp.HandleUpdate(s.ctx, &update)
+		if named, ok := sapp.(plugin.Named); ok && hasChat && !s.access.PluginEnabled(ctx, chatID, named.Name()) {
+			continue
+		}
+		eventCaught, err := sapp.HandleUpdate(ctx, &update)
 		if err != nil {
 			log.Printf("[WARN] Error during handling update %v", err)
 		}
@@ -254,10 +402,14 @@ func (s *BotService) mainLoop() {
 		}
 		go func(update tgbotapi.Update) {
 			defer s.sem.Release(1)
+			defer atomic.AddUint32(&s.handledUpdates, 1)
 			defer func() {
 				if r := recover(); r != nil {
-					_ = atomic.AddUint32(&s.failuresNumber, 1)
+					failures := atomic.AddUint32(&s.failuresNumber, 1)
 					log.Printf("[ERROR] Ooops! MainLoop failed: %v", r)
+					if s.MaxFailNum > 0 && failures == uint32(s.MaxFailNum) {
+						s.monitor.NotifyFailures(failures, fmt.Sprint(r))
+					}
 				}
 			}()
 			s.handleUpdate(update)
@@ -267,11 +419,20 @@ func (s *BotService) mainLoop() {
 
 // Close service
 func (s *BotService) Close() error {
+	return s.CloseWithReason("")
+}
+
+// CloseWithReason notifies service subscribers with reason and closes service
+func (s *BotService) CloseWithReason(reason string) error {
 	errs := &multierror.Error{}
 	if s.cfg == nil {
 		return errors.Errorf("close uninialized service")
 	}
 
+	if s.bot != nil && s.monitor != nil {
+		s.monitor.NotifyShutdown(reason)
+	}
+
 	if s.bot != nil {
 		s.bot.StopReceivingUpdates()
 	}
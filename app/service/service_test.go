@@ -3,13 +3,22 @@ package service
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -46,6 +55,43 @@ func GetPort(t *testing.T) int {
 type MockTelegramServer struct {
 	Client       *http.Client
 	SentMessages int32
+
+	mtx         sync.Mutex
+	lastRequest url.Values
+	lastMethod  string
+	// commands are lists set with setMyCommands by scope and language
+	commands        map[string]string
+	commandRequests int
+	// memberStatus is returned by getChatMember, user is administrator if it isn't set
+	memberStatus string
+}
+
+func (m *MockTelegramServer) SetMemberStatus(status string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.memberStatus = status
+}
+
+func (m *MockTelegramServer) Commands() (map[string]string, int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	commands := map[string]string{}
+	for k, v := range m.commands {
+		commands[k] = v
+	}
+	return commands, m.commandRequests
+}
+
+func (m *MockTelegramServer) LastMethod() string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.lastMethod
+}
+
+func (m *MockTelegramServer) LastRequest() url.Values {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.lastRequest
 }
 
 func (m *MockTelegramServer) RoundTrip(r *http.Request) (*http.Response, error) {
@@ -102,8 +148,79 @@ func (m *MockTelegramServer) RoundTrip(r *http.Request) (*http.Response, error)
 		setBodyOk(resp, `{"ok":true,"result":{"url":"","has_custom_certificate":false,"pending_update_count":0}}`)
 	}
 
+	if strings.HasSuffix(r.URL.Path, "/getChatMember") {
+		m.mtx.Lock()
+		status := m.memberStatus
+		m.mtx.Unlock()
+		if status == "" {
+			status = "administrator"
+		}
+		setBodyOk(resp, fmt.Sprintf(`{"ok":true,"result":{"user":{"id":199999999,"is_bot":false,"first_name":"Name"},"status":%q}}`, status))
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/editMessageText") {
+		setBodyOk(resp, `{"ok":true,"result":{"message_id":42,"date":1596902693,"chat":{"id":1,"type":"private"}}}`)
+	}
+
+	for _, method := range []string{"sendPhoto", "sendDocument"} {
+		if strings.HasSuffix(r.URL.Path, "/"+method) {
+			m.mtx.Lock()
+			m.lastMethod = method
+			m.mtx.Unlock()
+			setBodyOk(resp, `{"ok":true,"result":{"message_id":50,"date":1596902693,"chat":{"id":1,"type":"private"}}}`)
+		}
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/sendMediaGroup") {
+		if err := r.ParseMultipartForm(1 << 20); err == nil {
+			m.mtx.Lock()
+			m.lastMethod = "sendMediaGroup"
+			m.lastRequest = url.Values(r.MultipartForm.Value)
+			m.mtx.Unlock()
+		}
+		setBodyOk(resp, `{"ok":true,"result":[
+			{"message_id":51,"date":1596902693,"chat":{"id":1,"type":"private"}},
+			{"message_id":52,"date":1596902693,"chat":{"id":1,"type":"private"}}]}`)
+	}
+
+	for _, method := range []string{"setMyCommands", "deleteMyCommands"} {
+		if strings.HasSuffix(r.URL.Path, "/"+method) {
+			if err := r.ParseForm(); err == nil {
+				key := r.PostForm.Get("scope") + r.PostForm.Get("language_code")
+				m.mtx.Lock()
+				if m.commands == nil {
+					m.commands = map[string]string{}
+				}
+				m.commands[key] = r.PostForm.Get("commands")
+				if method == "deleteMyCommands" {
+					delete(m.commands, key)
+				}
+				m.commandRequests++
+				m.mtx.Unlock()
+			}
+			setBodyOk(resp, `{"ok":true,"result":true}`)
+		}
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/answerCallbackQuery") {
+		setBodyOk(resp, `{"ok":true,"result":true}`)
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/leaveChat") {
+		setBodyOk(resp, `{"ok":true,"result":true}`)
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/deleteMessage") {
+		setBodyOk(resp, `{"ok":true,"result":true}`)
+	}
+
 	if strings.HasSuffix(r.URL.Path, "/sendMessage") {
-		setBodyOk(resp, "")
+		if err := r.ParseForm(); err == nil {
+			m.mtx.Lock()
+			m.lastRequest = r.PostForm
+			m.mtx.Unlock()
+		}
+		setBodyOk(resp, `{"ok":true,"result":{"message_id":42,"date":1596902693,"chat":{"id":1,"type":"private"}}}`)
 		atomic.AddInt32(&m.SentMessages, 1)
 	}
 
@@ -205,7 +322,6 @@ func sendVoteMsg(t *testing.T, webHookEndpoint string) {
 }
 
 func TestVoteSendMsg(t *testing.T) {
-	t.Skip()
 	botService, mockTg, tearDown := setUp(t, nil)
 	defer tearDown()
 	webHookEndpoint := "http://" + botService.cfg.Addr + "/_webhook/" + botService.bot.Token
@@ -216,6 +332,108 @@ func TestVoteSendMsg(t *testing.T) {
 	assert.Equal(t, uint32(0), atomic.LoadUint32(&botService.failuresNumber))
 }
 
+func sendTextMsg(t *testing.T, webHookEndpoint string, text string) {
+	testMsg := fmt.Sprintf(`{
+		"update_id": 617777778,
+		"message": {
+		  "message_id": 151,
+		  "from": {"id": 199999999, "is_bot": false, "first_name": "Name", "username": "name"},
+		  "chat": {"id": -1001463780807, "title": "int32", "type": "supergroup"},
+		  "date": 1596902693,
+		  "text": %q,
+		  "entities": [{"offset": 0, "length": %d, "type": "bot_command"}]
+		}
+	}`, text, len(strings.Fields(text)[0]))
+
+	resp, err := http.Post(webHookEndpoint, "application/json", strings.NewReader(testMsg))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+}
+
+// testChat sends messages to bot with send and checks replies
+type testChat struct {
+	t          *testing.T
+	botService *BotService
+	mockTg     *MockTelegramServer
+	send       func(t *testing.T, webHookEndpoint string, text string)
+}
+
+func (c *testChat) endpoint() string {
+	return "http://" + c.botService.cfg.Addr + "/_webhook/" + c.botService.bot.Token
+}
+
+// expectReply sends message and waits for reply containing text
+func (c *testChat) expectReply(msg string, text string) {
+	c.send(c.t, c.endpoint(), msg)
+	require.Eventually(c.t, func() bool {
+		return strings.Contains(c.mockTg.LastRequest().Get("text"), text)
+	}, 3*time.Second, 50*time.Millisecond, msg)
+}
+
+// expectNoReply sends message and checks that nothing is sent when it's handled
+func (c *testChat) expectNoReply(msg string, reason string) {
+	handled := atomic.LoadUint32(&c.botService.handledUpdates)
+	sent := atomic.LoadInt32(&c.mockTg.SentMessages)
+	c.send(c.t, c.endpoint(), msg)
+	require.Eventually(c.t, func() bool {
+		return atomic.LoadUint32(&c.botService.handledUpdates) > handled
+	}, 3*time.Second, 10*time.Millisecond, msg)
+	assert.Equal(c.t, sent, atomic.LoadInt32(&c.mockTg.SentMessages), reason)
+}
+
+func sendPrivateTextMsg(t *testing.T, webHookEndpoint string, text string) {
+	testMsg := fmt.Sprintf(`{
+		"update_id": 617777779,
+		"message": {
+		  "message_id": 152,
+		  "from": {"id": 199999999, "is_bot": false, "first_name": "Name", "username": "name"},
+		  "chat": {"id": 199999999, "first_name": "Name", "username": "name", "type": "private"},
+		  "date": 1596902693,
+		  "text": %q,
+		  "entities": [{"offset": 0, "length": %d, "type": "bot_command"}]
+		}
+	}`, text, len(strings.Fields(text)[0]))
+
+	resp, err := http.Post(webHookEndpoint, "application/json", strings.NewReader(testMsg))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+}
+
+func sendCallbackQuery(t *testing.T, webHookEndpoint string, userID int, data string) {
+	testQuery := fmt.Sprintf(`{
+		"update_id": 617777780,
+		"callback_query": {
+		  "id": "4382",
+		  "from": {"id": %d, "is_bot": false, "first_name": "Owner"},
+		  "message": {
+		    "message_id": 42,
+		    "chat": {"id": %d, "first_name": "Owner", "type": "private"},
+		    "date": 1596902693,
+		    "text": "New chat"
+		  },
+		  "data": %q
+		}
+	}`, userID, userID, data)
+
+	resp, err := http.Post(webHookEndpoint, "application/json", strings.NewReader(testQuery))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+}
+
+func TestVoteDisabled(t *testing.T) {
+	botService, mockTg, tearDown := setUp(t, nil)
+	defer tearDown()
+	webHookEndpoint := "http://" + botService.cfg.Addr + "/_webhook/" + botService.bot.Token
+	sendTextMsg(t, webHookEndpoint, "/vote_settings@test_bot off")
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mockTg.SentMessages))
+
+	sendVoteMsg(t, webHookEndpoint)
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mockTg.SentMessages))
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&botService.failuresNumber))
+}
+
 type BrokenPlugin struct{ plugin.NopPlugin }
 
 func (sapp *BrokenPlugin) HandleUpdate(_ context.Context, _ *tgbotapi.Update) (bool, error) {
@@ -237,3 +455,651 @@ func TestMainLoopPanic(t *testing.T) {
 	assert.Equal(t, int32(1), atomic.LoadInt32(&mockTg.SentMessages))
 	assert.Equal(t, uint32(1), atomic.LoadUint32(&botService.failuresNumber))
 }
+
+func findPlugin(botService *BotService, pred func(plugin.PlugIn) bool) plugin.PlugIn {
+	for _, p := range botService.plugins {
+		if pred(p) {
+			return p
+		}
+	}
+	return nil
+}
+
+func TestNotifierJSON(t *testing.T) {
+	botService, mockTg, tearDown := setUp(t, nil)
+	defer tearDown()
+
+	notifier := findPlugin(botService, func(p plugin.PlugIn) bool {
+		_, ok := p.(*plugin.NotifierApp)
+		return ok
+	}).(*plugin.NotifierApp)
+	require.NoError(t, notifier.Store.SaveToken(1, 0, "secret", "ci", nil, time.Time{}))
+
+	ts := httptest.NewServer(botService.rootRoute)
+	defer ts.Close()
+	endpoint := ts.URL + "/notify"
+	body := `{"text": "<b>build</b> passed", "parse_mode": "html", "disable_notification": true,
+		"buttons": [{"text": "logs", "url": "https://example.com/logs"}]}`
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, string(respBody))
+	assert.JSONEq(t, `{"message_id": 42}`, string(respBody))
+
+	sent := mockTg.LastRequest()
+	assert.Equal(t, "HTML", sent.Get("parse_mode"))
+	assert.Equal(t, "true", sent.Get("disable_notification"))
+	assert.Contains(t, sent.Get("reply_markup"), "https://example.com/logs")
+
+	req, err = http.NewRequest("POST", endpoint, strings.NewReader(`{"text": "x", "buttons": [{"text": "no url"}]}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func notifyRequest(t *testing.T, method, url, token, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(respBody)
+}
+
+func TestNotifierEditDelete(t *testing.T) {
+	botService, _, tearDown := setUp(t, nil)
+	defer tearDown()
+
+	notifier := findPlugin(botService, func(p plugin.PlugIn) bool {
+		_, ok := p.(*plugin.NotifierApp)
+		return ok
+	}).(*plugin.NotifierApp)
+	require.NoError(t, notifier.Store.SaveToken(1, 0, "secret", "ci", nil, time.Time{}))
+	require.NoError(t, notifier.Store.SaveToken(1, 0, "other", "other", nil, time.Time{}))
+
+	ts := httptest.NewServer(botService.rootRoute)
+	defer ts.Close()
+
+	status, body := notifyRequest(t, "POST", ts.URL+"/notify", "secret", `{"text": "build started"}`)
+	require.Equal(t, http.StatusOK, status, body)
+
+	status, _ = notifyRequest(t, "PUT", ts.URL+"/notify/42", "other", `{"text": "build passed"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = notifyRequest(t, "PUT", ts.URL+"/notify/43", "secret", `{"text": "build passed"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = notifyRequest(t, "PUT", ts.URL+"/notify/42", "unknown", `{"text": "build passed"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, body = notifyRequest(t, "PUT", ts.URL+"/notify/42", "secret", `{"text": "build passed"}`)
+	assert.Equal(t, http.StatusOK, status, body)
+
+	status, _ = notifyRequest(t, "DELETE", ts.URL+"/notify/42", "other", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, body = notifyRequest(t, "DELETE", ts.URL+"/notify/42", "secret", "")
+	assert.Equal(t, http.StatusOK, status, body)
+	status, _ = notifyRequest(t, "DELETE", ts.URL+"/notify/42", "secret", "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestNotifierTokenScopes(t *testing.T) {
+	botService, _, tearDown := setUp(t, nil)
+	defer tearDown()
+
+	notifier := findPlugin(botService, func(p plugin.PlugIn) bool {
+		_, ok := p.(*plugin.NotifierApp)
+		return ok
+	}).(*plugin.NotifierApp)
+	require.NoError(t, notifier.Store.SaveToken(1, 0, "texttoken", "text", []string{plugin.TokenScopeText}, time.Time{}))
+	require.NoError(t, notifier.Store.SaveToken(1, 0, "expired", "old", nil, time.Now().Add(-time.Minute)))
+
+	ts := httptest.NewServer(botService.rootRoute)
+	defer ts.Close()
+
+	status, body := notifyRequest(t, "POST", ts.URL+"/notify", "texttoken", `{"text": "build started"}`)
+	require.Equal(t, http.StatusOK, status, body)
+	status, _ = notifyRequest(t, "PUT", ts.URL+"/notify/42", "texttoken", `{"text": "build passed"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = notifyRequest(t, "POST", ts.URL+"/notify", "expired", `{"text": "build started"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	tokens, err := notifier.Store.ChatTokens(1)
+	require.NoError(t, err)
+	for _, tok := range tokens {
+		if tok.Label == "text" {
+			assert.Equal(t, 1, tok.UseCount)
+		}
+	}
+}
+
+func TestNotifierRateLimit(t *testing.T) {
+	var notifier *plugin.NotifierApp
+	botService, _, tearDown := setUp(t, func(bsrv *BotService) {
+		notifier = findPlugin(bsrv, func(p plugin.PlugIn) bool {
+			_, ok := p.(*plugin.NotifierApp)
+			return ok
+		}).(*plugin.NotifierApp)
+		notifier.Limits = plugin.NotifierLimits{Token: plugin.RateLimit{Burst: 2, PerMinute: 1}}
+	})
+	defer tearDown()
+	require.NoError(t, notifier.Store.SaveToken(1, 0, "secret", "ci", nil, time.Time{}))
+
+	ts := httptest.NewServer(botService.rootRoute)
+	defer ts.Close()
+
+	status, body := notifyRequest(t, "POST", ts.URL+"/notify?async=1", "secret", `{"text": "build started"}`)
+	require.Equal(t, http.StatusAccepted, status, body)
+	delivery := struct {
+		DeliveryID string `json:"delivery_id"`
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &delivery))
+	// status checks aren't counted to limits
+	for i := 0; i < 3; i++ {
+		status, body = notifyRequest(t, "GET", ts.URL+"/notify/status/"+delivery.DeliveryID, "secret", "")
+		require.Equal(t, http.StatusOK, status, body)
+	}
+	status, body = notifyRequest(t, "POST", ts.URL+"/notify", "secret", `{"text": "build started"}`)
+	require.Equal(t, http.StatusOK, status, body)
+
+	req, err := http.NewRequest("POST", ts.URL+"/notify", strings.NewReader("build started"))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	require.NoError(t, err)
+	assert.True(t, retryAfter > 0 && retryAfter <= 60, retryAfter)
+}
+
+func TestNotifierAsync(t *testing.T) {
+	botService, _, tearDown := setUp(t, nil)
+	defer tearDown()
+
+	notifier := findPlugin(botService, func(p plugin.PlugIn) bool {
+		_, ok := p.(*plugin.NotifierApp)
+		return ok
+	}).(*plugin.NotifierApp)
+	require.NoError(t, notifier.Store.SaveToken(1, 0, "secret", "ci", nil, time.Time{}))
+	require.NoError(t, notifier.Store.SaveToken(1, 0, "other", "other", nil, time.Time{}))
+
+	ts := httptest.NewServer(botService.rootRoute)
+	defer ts.Close()
+
+	status, body := notifyRequest(t, "POST", ts.URL+"/notify?async=1", "secret", `{"text": "build started"}`)
+	require.Equal(t, http.StatusAccepted, status, body)
+	delivery := struct {
+		DeliveryID string `json:"delivery_id"`
+		Status     string `json:"status"`
+		MessageID  int    `json:"message_id"`
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &delivery))
+	assert.Equal(t, plugin.OutboxPending, delivery.Status)
+	require.NotEmpty(t, delivery.DeliveryID)
+
+	require.Eventually(t, func() bool {
+		status, body := notifyRequest(t, "GET", ts.URL+"/notify/status/"+delivery.DeliveryID, "secret", "")
+		require.Equal(t, http.StatusOK, status, body)
+		require.NoError(t, json.Unmarshal([]byte(body), &delivery))
+		return delivery.Status == plugin.OutboxSent
+	}, 3*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 42, delivery.MessageID)
+
+	status, _ = notifyRequest(t, "GET", ts.URL+"/notify/status/"+delivery.DeliveryID, "other", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, body = notifyRequest(t, "PUT", ts.URL+"/notify/42", "secret", `{"text": "build passed"}`)
+	assert.Equal(t, http.StatusOK, status, body)
+}
+
+func TestNotifierWebhook(t *testing.T) {
+	botService, _, tearDown := setUp(t, nil)
+	defer tearDown()
+
+	notifier := findPlugin(botService, func(p plugin.PlugIn) bool {
+		_, ok := p.(*plugin.NotifierApp)
+		return ok
+	}).(*plugin.NotifierApp)
+	require.NoError(t, notifier.Store.SaveToken(1, 0, "secret", "ci", nil, time.Time{}))
+
+	ts := httptest.NewServer(botService.rootRoute)
+	defer ts.Close()
+
+	payload := `{"status": "firing", "alerts": [{"status": "firing", "labels": {"alertname": "Down"}}]}`
+	resp, err := http.Post(ts.URL+"/notify/alertmanager/secret", "application/json", strings.NewReader(payload))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	resp, err = http.Post(ts.URL+"/notify/alertmanager/wrong", "application/json", strings.NewReader(payload))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// token isn't accepted in query, it leaks to logs
+	resp, err = http.Post(ts.URL+"/notify/alertmanager?token=secret", "application/json", strings.NewReader(payload))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// github payload is signed with webhook secret of token instead of token itself
+	body := `{"zen": "ok"}`
+	sign := func(key string) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		_, _ = mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	for signature, status := range map[string]int{
+		"":             http.StatusUnauthorized,
+		sign("secret"): http.StatusUnauthorized,
+		sign(notifier.Store.FindToken("secret").WebhookSecret): http.StatusOK,
+	} {
+		req, err := http.NewRequest("POST", ts.URL+"/notify/github/secret", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("X-GitHub-Event", "ping")
+		if signature != "" {
+			req.Header.Set("X-Hub-Signature-256", signature)
+		}
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, signature)
+	}
+
+	req, err := http.NewRequest("POST", ts.URL+"/notify/gitlab", strings.NewReader(`{"object_kind": "push"}`))
+	require.NoError(t, err)
+	req.Header.Set("X-Gitlab-Token", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	status, body := notifyRequest(t, "POST", ts.URL+"/notify/html", "secret", `{"text": "<b>ok</b>"}`)
+	assert.Equal(t, http.StatusOK, status, body)
+}
+
+func TestNotifierTemplate(t *testing.T) {
+	botService, mockTg, tearDown := setUp(t, nil)
+	defer tearDown()
+
+	notifier := findPlugin(botService, func(p plugin.PlugIn) bool {
+		_, ok := p.(*plugin.NotifierApp)
+		return ok
+	}).(*plugin.NotifierApp)
+	require.NoError(t, notifier.Store.SaveToken(1, 0, "secret", "sentry", nil, time.Time{}))
+	tok, err := notifier.Store.SetTemplate(1, "sentry", "{{.project}}: {{.event.title}}")
+	require.NoError(t, err)
+	require.NotNil(t, tok)
+
+	ts := httptest.NewServer(botService.rootRoute)
+	defer ts.Close()
+
+	status, body := notifyRequest(t, "POST", ts.URL+"/notify", "secret", `{"project": "api", "event": {"title": "NullPointer"}}`)
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, "api: NullPointer", mockTg.LastRequest().Get("text"))
+
+	status, body = notifyRequest(t, "POST", ts.URL+"/notify", "secret", `{"project": "api", "event": "oops"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Contains(t, body, "template error")
+
+	status, body = notifyRequest(t, "POST", ts.URL+"/notify", "secret",
+		fmt.Sprintf(`{"project": "api", "event": {"title": "%s"}}`, strings.Repeat("x", 5000)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status, body)
+}
+
+func TestMonitorHeartbeat(t *testing.T) {
+	botService, mockTg, tearDown := setUp(t, func(bsrv *BotService) {
+		monitor := findPlugin(bsrv, func(p plugin.PlugIn) bool {
+			_, ok := p.(*plugin.Monitor)
+			return ok
+		}).(*plugin.Monitor)
+		monitor.CheckInterval = 50 * time.Millisecond
+	})
+	defer tearDown()
+
+	ts := httptest.NewServer(botService.rootRoute)
+	defer ts.Close()
+
+	webHookEndpoint := "http://" + botService.cfg.Addr + "/_webhook/" + botService.bot.Token
+	sendTextMsg(t, webHookEndpoint, "/watch@test_bot backup 1s 0")
+	require.Eventually(t, func() bool {
+		return strings.Contains(mockTg.LastRequest().Get("text"), "/monitor/ping/")
+	}, 3*time.Second, 50*time.Millisecond)
+	text := mockTg.LastRequest().Get("text")
+	pingURL := text[strings.Index(text, "https://example.com"):]
+	pingURL = pingURL[:strings.Index(pingURL, "<")]
+	pingURL = strings.Replace(pingURL, "https://example.com", ts.URL, 1)
+
+	resp, err := http.Get(pingURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(mockTg.LastRequest().Get("text"), "backup</b> is down")
+	}, 5*time.Second, 50*time.Millisecond)
+
+	resp, err = http.Post(pingURL, "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Eventually(t, func() bool {
+		return strings.Contains(mockTg.LastRequest().Get("text"), "backup</b> is up again")
+	}, 3*time.Second, 50*time.Millisecond)
+
+	resp, err = http.Get(ts.URL + "/monitor/ping/unknown")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestMonitorProbe(t *testing.T) {
+	botService, mockTg, tearDown := setUp(t, func(bsrv *BotService) {
+		monitor := findPlugin(bsrv, func(p plugin.PlugIn) bool {
+			_, ok := p.(*plugin.Monitor)
+			return ok
+		}).(*plugin.Monitor)
+		monitor.CheckInterval = 50 * time.Millisecond
+		monitor.AllowPrivateProbes = true
+		monitor.MaxChatProbes = 2
+	})
+	defer tearDown()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer target.Close()
+
+	webHookEndpoint := "http://" + botService.cfg.Addr + "/_webhook/" + botService.bot.Token
+	sendTextMsg(t, webHookEndpoint, "/probe@test_bot add "+target.URL)
+	require.Eventually(t, func() bool {
+		return strings.Contains(mockTg.LastRequest().Get("text"), "is down: status 500")
+	}, 5*time.Second, 50*time.Millisecond)
+
+	sendTextMsg(t, webHookEndpoint, "/probe@test_bot list")
+	require.Eventually(t, func() bool {
+		return strings.Contains(mockTg.LastRequest().Get("text"), "<b>down</b>: status 500")
+	}, 5*time.Second, 50*time.Millisecond)
+
+	sendTextMsg(t, webHookEndpoint, "/probe@test_bot add "+target.URL+"/second every 1h status=500")
+	require.Eventually(t, func() bool {
+		return strings.Contains(mockTg.LastRequest().Get("text"), "Ok, #2")
+	}, 5*time.Second, 50*time.Millisecond)
+	sendTextMsg(t, webHookEndpoint, "/probe@test_bot add "+target.URL+"/extra every 1h")
+	require.Eventually(t, func() bool {
+		return strings.Contains(mockTg.LastRequest().Get("text"), "chat may have at most 2 probes")
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func multipartBody(t *testing.T, files map[string][]byte) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	require.NoError(t, mw.WriteField("caption", "build artifacts"))
+	for name, data := range files {
+		part, err := mw.CreateFormFile(name, name)
+		require.NoError(t, err)
+		_, err = part.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+	return body, mw.FormDataContentType()
+}
+
+func TestNotifierUpload(t *testing.T) {
+	botService, mockTg, tearDown := setUp(t, nil)
+	defer tearDown()
+
+	notifier := findPlugin(botService, func(p plugin.PlugIn) bool {
+		_, ok := p.(*plugin.NotifierApp)
+		return ok
+	}).(*plugin.NotifierApp)
+	require.NoError(t, notifier.Store.SaveToken(1, 0, "secret", "ci", nil, time.Time{}))
+	notifier.MaxUploadSize = 1024
+
+	ts := httptest.NewServer(botService.rootRoute)
+	defer ts.Close()
+
+	upload := func(files map[string][]byte) (int, string) {
+		body, contentType := multipartBody(t, files)
+		req, err := http.NewRequest("POST", ts.URL+"/notify", body)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(respBody)
+	}
+
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A" + strings.Repeat("\x00", 32))
+	status, body := upload(map[string][]byte{"screenshot.png": png})
+	assert.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, "sendPhoto", mockTg.LastMethod())
+
+	status, body = upload(map[string][]byte{"build.log": []byte("ok")})
+	assert.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, "sendDocument", mockTg.LastMethod())
+
+	status, body = upload(map[string][]byte{"a.log": []byte("a"), "b.png": png})
+	assert.Equal(t, http.StatusOK, status, body)
+	assert.JSONEq(t, `{"message_id": 51, "message_ids": [51, 52]}`, body)
+	assert.Equal(t, "sendMediaGroup", mockTg.LastMethod())
+	assert.Contains(t, mockTg.LastRequest().Get("media"), `"type":"document"`)
+	assert.NotContains(t, mockTg.LastRequest().Get("media"), `"type":"photo"`)
+
+	status, _ = upload(map[string][]byte{"big.log": bytes.Repeat([]byte("x"), 2048)})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+}
+
+func TestMonitorServiceNotifications(t *testing.T) {
+	botService, mockTg, tearDown := setUp(t, nil)
+	defer tearDown()
+
+	webHookEndpoint := "http://" + botService.cfg.Addr + "/_webhook/" + botService.bot.Token
+	sendTextMsg(t, webHookEndpoint, "/subscibe_to_service@test_bot")
+	require.Eventually(t, func() bool {
+		return strings.Contains(mockTg.LastRequest().Get("text"), "Subscibed")
+	}, 3*time.Second, 50*time.Millisecond)
+
+	botService.monitor.NotifyFailures(10, "boom <nil>")
+	assert.Contains(t, mockTg.LastRequest().Get("text"), "10 failures")
+	assert.Contains(t, mockTg.LastRequest().Get("text"), "boom &lt;nil&gt;")
+
+	botService.monitor.NotifyShutdown("received terminated")
+	assert.Equal(t, "Going down for a while: received terminated", mockTg.LastRequest().Get("text"))
+}
+
+func TestSyncCommands(t *testing.T) {
+	botService, mockTg, tearDown := setUp(t, nil)
+	defer tearDown()
+
+	commands, requests := mockTg.Commands()
+	defaultList := commands[`{"type":"default"}`]
+	assert.Contains(t, defaultList, `{"command":"help","description":"Show usage"}`)
+	assert.NotContains(t, defaultList, "vote_settings")
+	assert.NotContains(t, defaultList, `"command":"top"`)
+	assert.Contains(t, commands[`{"type":"all_group_chats"}`], `"command":"top"`)
+	assert.NotContains(t, commands[`{"type":"all_group_chats"}`], "vote_settings")
+	assert.Contains(t, commands[`{"type":"all_chat_administrators"}`], "vote_settings")
+	assert.Contains(t, commands[`{"type":"all_chat_administrators"}`], `"command":"top"`)
+	assert.Contains(t, commands[`{"type":"all_chat_administrators"}`], "help")
+	assert.Equal(t, 3, requests)
+
+	bkt := botService.store.GetBucket("bot_commands")
+	cmds := botService.router.Commands()
+	require.NoError(t, syncCommands(botService.bot, bkt, cmds))
+	_, requests = mockTg.Commands()
+	assert.Equal(t, 3, requests, "unchanged lists aren't sent again")
+
+	cmds = []plugin.CommandDescription{
+		{Cmd: "help", Help: "Show usage", Translations: map[string]string{"ru": "Показать справку"}},
+		{Cmd: "version", Help: "Show version"},
+	}
+	require.NoError(t, syncCommands(botService.bot, bkt, cmds))
+	commands, requests = mockTg.Commands()
+	assert.Equal(t, 2, len(commands))
+	assert.Contains(t, commands[`{"type":"default"}ru`], "Показать справку")
+	assert.Contains(t, commands[`{"type":"default"}ru`], `"version"`)
+	assert.NotContains(t, commands[`{"type":"default"}`], `"command":"top"`)
+	assert.Equal(t, 7, requests)
+}
+
+func TestPluginsAccess(t *testing.T) {
+	botService, mockTg, tearDown := setUp(t, nil)
+	defer tearDown()
+
+	chat := &testChat{t: t, botService: botService, mockTg: mockTg, send: sendTextMsg}
+	chat.expectReply("/plugins@test_bot", "timezones: on")
+	chat.expectReply("/plugins@test_bot off timezones", "Ok, timezones is off")
+	chat.expectReply("/plugins@test_bot", "timezones: <b>off</b>")
+	chat.expectNoReply("/timezones@test_bot", "disabled plugin doesn't reply")
+
+	chat.expectReply("/plugins@test_bot on timezones", "Ok, timezones is on")
+	chat.expectReply("/plugins@test_bot perm timezones admins", "Ok, /timezones is allowed to admins")
+	chat.expectReply("/plugins@test_bot perm help owner", "Only bot owner can change owner level")
+	chat.expectReply("/plugins@test_bot perm unknown admins", "Unknown command")
+
+	// tokens of chat with disabled notifier are rejected
+	notifier := findPlugin(botService, func(p plugin.PlugIn) bool {
+		_, ok := p.(*plugin.NotifierApp)
+		return ok
+	}).(*plugin.NotifierApp)
+	require.NoError(t, notifier.Store.SaveToken(-1001463780807, 0, "secret", "ci", nil, time.Time{}))
+	ts := httptest.NewServer(botService.rootRoute)
+	defer ts.Close()
+	chat.expectReply("/plugins@test_bot off notifier", "Ok, notifier is off")
+	status, body := notifyRequest(t, "POST", ts.URL+"/notify", "secret", `{"text": "hi"}`)
+	assert.Equal(t, http.StatusForbidden, status, body)
+	chat.expectReply("/plugins@test_bot on notifier", "Ok, notifier is on")
+	status, body = notifyRequest(t, "POST", ts.URL+"/notify", "secret", `{"text": "hi"}`)
+	assert.Equal(t, http.StatusOK, status, body)
+
+	mockTg.SetMemberStatus("member")
+	chat.expectReply("/timezones@test_bot", "Only chat admins can use /timezones")
+	chat.expectReply("/set_timezones@test_bot Europe/Berlin", "Only chat admins can use /set_timezones")
+	chat.expectReply("/plugins@test_bot off vote", "Only chat admins can use /plugins")
+
+	botService.access.OwnerIDs = []int{199999999}
+	chat.expectReply("/plugins@test_bot perm help owner", "Ok, /help is allowed to owner")
+	chat.expectReply("/set_timezones@test_bot Europe/Berlin", "Ok, set 1 locations")
+}
+
+func TestAdminConsole(t *testing.T) {
+	botService, mockTg, tearDown := setUp(t, func(bsrv *BotService) {
+		bsrv.access.OwnerIDs = []int{199999999}
+	})
+	defer tearDown()
+
+	group := &testChat{t: t, botService: botService, mockTg: mockTg, send: sendTextMsg}
+	group.expectNoReply("/admin@test_bot stats", "admin console works only in private chat")
+
+	chat := &testChat{t: t, botService: botService, mockTg: mockTg, send: sendPrivateTextMsg}
+	chat.expectReply("/subscibe_to_service", "Subscibed")
+	chat.expectReply("/admin", "only chats seen since tracking was deployed")
+	chat.expectReply("/admin stats", "Chats: 2\nNotify tokens: 0\nSubscribers: 1\nVotes: 0\nFailures: 0")
+	chat.expectReply("/admin chats", "<code>-1001463780807</code> int32 (supergroup)")
+	chat.expectReply("/admin broadcast maintenance <soon>", "Broadcast is finished, sent to 1 of 1 subscribers")
+	chat.expectReply("/admin leave -1001463780807", "Ok, left chat")
+	chat.expectReply("/admin stats", "Chats: 1")
+
+	atomic.StoreUint32(&botService.failuresNumber, 3)
+	chat.expectReply("/admin reset_failures", "reset from 3")
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&botService.failuresNumber))
+
+	botService.access.OwnerIDs = nil
+	chat.expectNoReply("/admin stats", "admin console works only for owners")
+}
+
+func TestACLApprove(t *testing.T) {
+	botService, mockTg, tearDown := setUp(t, func(bsrv *BotService) {
+		bsrv.access.OwnerIDs = []int{111}
+		bsrv.acl.Mode = ACLApprove
+	})
+	defer tearDown()
+
+	webHookEndpoint := "http://" + botService.cfg.Addr + "/_webhook/" + botService.bot.Token
+	sendTextMsg(t, webHookEndpoint, "/help@test_bot")
+	require.Eventually(t, func() bool {
+		req := mockTg.LastRequest()
+		return req.Get("chat_id") == "111" && strings.Contains(req.Get("text"), "<b>int32</b> (<code>-1001463780807</code>)")
+	}, 3*time.Second, 50*time.Millisecond)
+	assert.Contains(t, mockTg.LastRequest().Get("reply_markup"), "acl#allow#-1001463780807")
+
+	chat := &testChat{t: t, botService: botService, mockTg: mockTg, send: sendTextMsg}
+	chat.expectNoReply("/help@test_bot", "pending chat is ignored and owner is asked once")
+	assert.Empty(t, botService.chats.list(), "chat isn't tracked before it's allowed")
+
+	sendCallbackQuery(t, webHookEndpoint, 199999999, "acl#allow#-1001463780807")
+	sendCallbackQuery(t, webHookEndpoint, 111, "acl#allow#-1001463780807")
+	require.Eventually(t, func() bool {
+		return botService.acl.list(aclChat, -1001463780807) == aclAllow
+	}, 3*time.Second, 50*time.Millisecond)
+
+	chat.expectReply("/help@test_bot", "/help@test_bot - Show usage")
+	assert.Len(t, botService.chats.list(), 1)
+
+	require.NoError(t, botService.acl.set(aclUser, 199999999, aclDeny, ""))
+	chat.expectNoReply("/help@test_bot", "denied user is ignored in allowed chat")
+}
+
+func TestACLAdmin(t *testing.T) {
+	botService, mockTg, tearDown := setUp(t, func(bsrv *BotService) {
+		bsrv.access.OwnerIDs = []int{199999999}
+	})
+	defer tearDown()
+
+	notifier := findPlugin(botService, func(p plugin.PlugIn) bool {
+		_, ok := p.(*plugin.NotifierApp)
+		return ok
+	}).(*plugin.NotifierApp)
+	require.NoError(t, notifier.Store.SaveToken(-1001463780807, 0, "chattoken", "ci", nil, time.Time{}))
+	require.NoError(t, notifier.Store.SaveToken(1, 42, "usertoken", "ci", nil, time.Time{}))
+	require.NoError(t, notifier.Store.SaveToken(1, 43, "othertoken", "other", nil, time.Time{}))
+	ts := httptest.NewServer(botService.rootRoute)
+	defer ts.Close()
+
+	chat := &testChat{t: t, botService: botService, mockTg: mockTg, send: sendPrivateTextMsg}
+	chat.expectReply("/admin deny chat -1001463780807", "Ok, chat -1001463780807 is denied")
+	chat.expectReply("/admin allow user 42", "Ok, user 42 is allowed")
+	chat.expectReply("/admin deny user", "pass 'chat <id>' or 'user <id>'")
+	chat.expectReply("/admin acl", "Mode: open\nallow user <code>42</code>\ndeny chat <code>-1001463780807</code>")
+	chat.expectReply("/admin unlist user 42", "Ok, user 42 removed from lists")
+	chat.expectReply("/admin unlist user 42", "Not found")
+	assert.Equal(t, aclDeny, botService.acl.list(aclChat, -1001463780807))
+
+	// tokens of denied chat and created by denied user are rejected
+	chat.expectReply("/admin deny user 42", "Ok, user 42 is denied")
+	for token, expected := range map[string]int{
+		"chattoken":  http.StatusForbidden,
+		"usertoken":  http.StatusForbidden,
+		"othertoken": http.StatusOK,
+	} {
+		status, body := notifyRequest(t, "POST", ts.URL+"/notify", token, `{"text": "hi"}`)
+		assert.Equal(t, expected, status, token+": "+body)
+	}
+	// background messages aren't sent to denied chats and to chats which aren't allowed in allowlist mode
+	assert.False(t, botService.acl.chatAllowed(-1001463780807))
+	assert.False(t, botService.acl.chatAllowed(42), "private chat of denied user")
+	assert.True(t, botService.acl.chatAllowed(1))
+	botService.acl.Mode = ACLAllowlist
+	assert.False(t, botService.acl.chatAllowed(1))
+	assert.True(t, botService.acl.chatAllowed(199999999), "private chat of owner")
+	chat.expectReply("/admin allow chat 1", "Ok, chat 1 is allowed")
+	assert.True(t, botService.acl.chatAllowed(1))
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
 )
 
 func (s *BotService) Routes() chi.Router {
@@ -25,6 +26,7 @@ func (s *BotService) Routes() chi.Router {
 	r.Use(middleware.StripSlashes)
 
 	r.Get("/robots.txt", s.handleRobotsTxt)
+	r.Get("/status", s.handleStatus)
 
 	return r
 }
@@ -37,3 +39,11 @@ func (s *BotService) handleRobotsTxt(w http.ResponseWriter, r *http.Request) {
 	}
 	buf.WriteTo(w)
 }
+
+// handleStatus shows service state, e.g. number of messages waiting to be sent
+func (s *BotService) handleStatus(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, struct {
+		Version    string `json:"version"`
+		QueueDepth int    `json:"queue_depth"`
+	}{s.cfg.AppVersion, s.dispatcher.QueueDepth()})
+}